@@ -0,0 +1,3066 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestInterpreter returns an interpreter that writes to a buffer instead
+// of stdout, with opts applied.
+func newTestInterpreter(opts ...func(*Interpreter)) (*Interpreter, *bytes.Buffer) {
+	var out bytes.Buffer
+	interp := NewInterpreter()
+	interp.SetOutput(&out)
+	for _, opt := range opts {
+		opt(interp)
+	}
+	return interp, &out
+}
+
+// Options for newTestInterpreter and runScript.
+func dryRun(i *Interpreter) { i.SetDryRun(true) }
+
+// runScript executes src on a test interpreter and returns the interpreter,
+// its output and the error of the run.
+func runScript(t *testing.T, src string, opts ...func(*Interpreter)) (*Interpreter, string, error) {
+	t.Helper()
+	interp, out := newTestInterpreter(opts...)
+	err := interp.ExecuteString(src)
+	return interp, out.String(), err
+}
+
+func TestExecuteString(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string // empty for success
+		wantX   interface{}
+	}{
+		{name: "valid", src: "x = 3\n", wantX: float64(3)},
+		{name: "valid with a block", src: "x = 1\nif x == 1 {\n  x = 2\n}\n", wantX: float64(2)},
+		{name: "stray brace", src: "x = 1\n}\n", wantErr: `line 2, column 1: unexpected token "}"`},
+		{name: "unterminated block", src: "x = 1\nrepeat 2 {\n  x = 5\n", wantErr: "parse error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ExecuteString() error = %v", err)
+				}
+				if got := interp.variables["x"]; got != tt.wantX {
+					t.Errorf("x = %v, want %v", got, tt.wantX)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ExecuteString() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Errorf("error %v does not wrap a *ParseError", err)
+			}
+			if _, ran := interp.variables["x"]; ran {
+				t.Errorf("the program ran despite the parse error")
+			}
+		})
+	}
+}
+
+// stepDetails returns the detail of every step the interpreter ran.
+func stepDetails(interp *Interpreter) []string {
+	var details []string
+	for _, step := range interp.Steps() {
+		details = append(details, step.Detail)
+	}
+	return details
+}
+
+func TestHookModes(t *testing.T) {
+	src := `before {
+  shell "echo before"
+}
+after {
+  shell "echo after"
+}
+shell "echo body"
+`
+	tests := []struct {
+		name      string
+		only      bool
+		skip      bool
+		wantSteps []string
+		wantErr   bool
+	}{
+		{name: "default", wantSteps: []string{"echo before", "echo body", "echo after"}},
+		{name: "only hooks", only: true, wantSteps: []string{"echo before", "echo after"}},
+		{name: "skip hooks", skip: true, wantSteps: []string{"echo body"}},
+		{name: "both", only: true, skip: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, src, func(i *Interpreter) {
+				i.SetOnlyHooks(tt.only)
+				i.SetSkipHooks(tt.skip)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := stepDetails(interp); strings.Join(got, "|") != strings.Join(tt.wantSteps, "|") {
+				t.Errorf("steps = %q, want %q", got, tt.wantSteps)
+			}
+		})
+	}
+}
+
+// resultOf runs src and returns the value it assigned to result.
+func resultOf(t *testing.T, src string, opts ...func(*Interpreter)) interface{} {
+	t.Helper()
+	interp, _, err := runScript(t, src, opts...)
+	if err != nil {
+		t.Fatalf("run %q: %v", src, err)
+	}
+	return interp.variables["result"]
+}
+
+// valueTest is a script and the value it should assign to result.
+type valueTest struct {
+	name string
+	src  string
+	want interface{}
+}
+
+// runValueTests checks the result of each script against its wanted value.
+func runValueTests(t *testing.T, tests []valueTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resultOf(t, tt.src); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringBuiltins(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"contains", `result = contains("hello world", "wor")`, true},
+		{"contains missing", `result = contains("hello", "xyz")`, false},
+		{"replace", `result = replace("a-b-c", "-", "+")`, "a+b+c"},
+		{"replace nothing", `result = replace("abc", "x", "y")`, "abc"},
+		{"split", `result = split("a,b,c", ",")`, []interface{}{"a", "b", "c"}},
+		{"split without separator", `result = split("abc", ",")`, []interface{}{"abc"}},
+		{"split in a for loop", "result = \"\"\nfor part in split(\"x y z\", \" \") {\n  result = result + part + \";\"\n}", "x;y;z;"},
+	})
+}
+
+func TestProfileCategories(t *testing.T) {
+	dir := t.TempDir()
+	src := "ask \"build it\"\nshell \"true\"\nfs.mkdir \"" + filepath.Join(dir, "out") + "\"\n"
+	var events bytes.Buffer
+	interp, _, err := runScript(t, src, func(i *Interpreter) {
+		i.SetProfile(true)
+		i.SetClaudeCLI("true")
+		i.SetEventStream(&events)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := interp.Profile()
+	for _, category := range append(profileCategories, "total") {
+		if profile[category] <= 0 {
+			t.Errorf("profile[%q] = %v, want it populated", category, profile[category])
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+	var end StreamEvent
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &end); err != nil {
+		t.Fatal(err)
+	}
+	if end.Event != "run_end" || len(end.Profile) != len(profile) {
+		t.Errorf("last event = %+v, want run_end with the profile", end)
+	}
+}
+
+// dumpPrompts runs src with --dump-prompts and returns the instruction of
+// every ask.
+func dumpPrompts(t *testing.T, src string, opts ...func(*Interpreter)) []string {
+	t.Helper()
+	opts = append(opts, func(i *Interpreter) { i.SetDumpPrompts(true) })
+	interp, _, err := runScript(t, src, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var instructions []string
+	for _, prompt := range interp.DumpedPrompts() {
+		instructions = append(instructions, prompt.Instruction)
+	}
+	return instructions
+}
+
+func TestNamedPrompts(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"defined and used", "prompt scaffold = \"Create the folders\"\nask scaffold\nask scaffold\n",
+			[]string{"Create the folders", "Create the folders"}},
+		{"interpolated when used", "prompt build = \"Build ${project}\"\nproject = \"shop\"\nask build\n",
+			[]string{"Build shop"}},
+		{"prompt as a variable name", "prompt = \"a variable\"\nask \"${prompt}\"\n",
+			[]string{"a variable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dumpPrompts(t, tt.src); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("instructions = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	_, _, err := runScript(t, "ask missing\n", func(i *Interpreter) { i.SetDumpPrompts(true) })
+	if err == nil || !strings.Contains(err.Error(), "undefined prompt: missing") {
+		t.Errorf("undefined prompt error = %v", err)
+	}
+}
+
+func TestRepeatWhileGuard(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"stops when the guard fails", "result = 0\nrepeat 10 while result < 3 {\n  result++\n}", float64(3)},
+		{"count still caps it", "result = 0\nrepeat 2 while result < 3 {\n  result++\n}", float64(2)},
+		{"false guard skips the body", "result = 0\nrepeat 5 while False {\n  result++\n}", float64(0)},
+		{"guard without a count", "result = 0\nrepeat while result < 1 {\n  result++\n}", float64(1)},
+	})
+}
+
+func TestGroupBlocks(t *testing.T) {
+	src := `group "build" {
+  shell "echo compile"
+  group "tests" {
+    shell "echo unit"
+  }
+}
+shell "echo done"
+`
+	interp, out, err := runScript(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"─── build ───\n", "  ─── tests ───\n", "  ─── end tests ───\n", "─── end build ───\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+
+	wantGroups := map[string]string{"echo compile": "build", "echo unit": "build/tests", "echo done": ""}
+	for _, step := range interp.Steps() {
+		if step.Group != wantGroups[step.Detail] {
+			t.Errorf("step %q ran in group %q, want %q", step.Detail, step.Group, wantGroups[step.Detail])
+		}
+	}
+	if len(interp.Steps()) != len(wantGroups) {
+		t.Errorf("ran %d steps, want %d", len(interp.Steps()), len(wantGroups))
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	start := time.Now()
+	interp, _, err := runScript(t, "shell \"sleep 5\"\nshell \"echo never\"\n", func(i *Interpreter) {
+		i.SetDeadline(200 * time.Millisecond)
+	})
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Step != "" {
+		t.Fatalf("error = %v, want the run's deadline to be exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("run took %s, the sleeping step was not cut short", elapsed)
+	}
+	if got := stepDetails(interp); len(got) != 1 {
+		t.Errorf("steps = %q, want only the sleeping step", got)
+	}
+}
+
+func TestConditionsReadCurrentValues(t *testing.T) {
+	loops := map[string]string{
+		"while":  "while count < 5 {",
+		"repeat": "repeat 5 {",
+	}
+	for name, header := range loops {
+		t.Run(name, func(t *testing.T) {
+			src := "count = 0\nhits = 0\nfired_at = 0\n" + header + `
+  count++
+  if count == 3 {
+    hits++
+    fired_at = count
+  }
+}
+`
+			interp, _, err := runScript(t, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hits, at := interp.variables["hits"], interp.variables["fired_at"]; hits != float64(1) || at != float64(3) {
+				t.Errorf("branch fired %v time(s), last at count %v; want once at 3", hits, at)
+			}
+		})
+	}
+}
+
+func TestElifChains(t *testing.T) {
+	chain := `if n > 10 {
+  result = "big"
+} elif n > 5 {
+  result = "medium"
+} else if n > 0 {
+  result = "small"
+} else {
+  result = "none"
+}`
+	runValueTests(t, []valueTest{
+		{"first branch", "n = 11\n" + chain, "big"},
+		{"elif", "n = 6\n" + chain, "medium"},
+		{"else if", "n = 1\n" + chain, "small"},
+		{"else", "n = 0\n" + chain, "none"},
+		{"consecutive ifs stay separate", "result = \"\"\nif True {\n  result = result + \"a\"\n}\nif True {\n  result = result + \"b\"\n}", "ab"},
+	})
+}
+
+func TestNumericEquality(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"number and number", "result = 3 == 3.0", true},
+		{"number and numeric string", `result = 3 == "3.0"`, true},
+		{"different numbers", "result = 3 != 4", true},
+		{"strings", `result = "a" == "a"`, true},
+		{"string and number", `result = "abc" == 0`, false},
+	})
+}
+
+func TestNoShellPolicy(t *testing.T) {
+	noShell := func(i *Interpreter) { i.SetAllowShell(false) }
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{"shell", `shell "echo hi"`, true},
+		{"shell.run", `shell.run "echo hi"`, true},
+		{"ask", `ask "build it"`, true},
+		{"captured shell", `x = shell "echo hi"`, true},
+		{"assignments and conditions", "x = 1\nif x == 1 {\n  x = 2\n}\nrepeat 2 {\n  x++\n}", false},
+		{"fs", `fs.mkdir "` + filepath.Join(t.TempDir(), "out") + `"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := runScript(t, tt.src, noShell)
+			if tt.wantErr != errors.Is(err, errExecDisabled) || (!tt.wantErr && err != nil) {
+				t.Errorf("error = %v, want policy error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMCPValidation(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string // empty for success
+	}{
+		{"fs.write without path", `fs.write content="x"`, "fs.write requires 'path'"},
+		{"fs.write with a bad JSON argument", `fs.write "{not json"`, "fs.write expects named arguments or a JSON object argument"},
+		{"fs.write with an unknown argument", `fs.write path="a" mode="x"`, "fs.write does not take mode="},
+		{"fs.mkdir without an argument", `fs.mkdir`, "fs.mkdir requires an argument"},
+		{"fs.copy with one argument", `fs.copy "a"`, "fs.copy requires 2 arguments, got 1"},
+		{"fs.read with two arguments", `fs.read "a" "b"`, "fs.read takes 1 argument(s), got 2"},
+		{"unknown fs method", `fs.chmod "a"`, "unknown MCP method: fs.chmod"},
+		{"unknown service", `docker.push "app"`, ""},
+		{"complete fs.write", `fs.write path="` + filepath.Join(dir, "a.txt") + `" content="hi"`, ""},
+		{"JSON fs.write", `fs.write "{\"path\": \"` + filepath.Join(dir, "b.txt") + `\"}"`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := runScript(t, tt.src)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A dry run previews invalid calls instead of stopping at the first
+	_, out, err := runScript(t, "fs.write content=\"x\"\nfs.mkdir\n", dryRun)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	for _, want := range []string{"⚠ fs.write requires 'path'", "⚠ fs.mkdir requires an argument"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dry run output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestListAppend(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"append builtin", `result = append(["a"], "b")`, []interface{}{"a", "b"}},
+		{"append to a scalar", `result = append("a", "b")`, []interface{}{"a", "b"}},
+		{"plus an element", "result = [\"a\"]\nresult = result + \"b\"", []interface{}{"a", "b"}},
+		{"plus a list concatenates", `result = ["a"] + ["b", "c"]`, []interface{}{"a", "b", "c"}},
+		{"original list unchanged", "a = [1]\nb = a + 2\nresult = a", []interface{}{float64(1)}},
+	})
+}
+
+func TestDumpPrompts(t *testing.T) {
+	src := `project = "shop"
+repeat 2 {
+  ask "refactor"
+}
+if False {
+  ask "never"
+}
+ask "write docs for ${project}"
+`
+	interp, _, err := runScript(t, src, func(i *Interpreter) {
+		i.SetDumpPrompts(true)
+		i.SetClaudeCLI("false") // fails the run if it were called
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts := interp.DumpedPrompts()
+	wantInstructions := []string{"refactor", "refactor", "write docs for shop"}
+	if len(prompts) != len(wantInstructions) {
+		t.Fatalf("dumped %d prompts, want %d: %+v", len(prompts), len(wantInstructions), prompts)
+	}
+	for n, prompt := range prompts {
+		if prompt.Step != n+1 || prompt.Instruction != wantInstructions[n] {
+			t.Errorf("prompt %d = step %d %q, want step %d %q", n, prompt.Step, prompt.Instruction, n+1, wantInstructions[n])
+		}
+		if !strings.Contains(prompt.Prompt, "Project Name: shop") || !strings.Contains(prompt.Prompt, "Current Step: "+wantInstructions[n]) {
+			t.Errorf("prompt %d lacks the project or the step:\n%s", n, prompt.Prompt)
+		}
+	}
+	if _, err := json.Marshal(prompts); err != nil {
+		t.Errorf("prompts do not encode as JSON: %v", err)
+	}
+}
+
+// stubClaude writes an executable shell script standing in for the Claude
+// CLI and returns its path. body runs with the CLI's arguments in "$@".
+func stubClaude(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub CLI is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "claude")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStepTimeouts(t *testing.T) {
+	slowClaude := stubClaude(t, "sleep 5")
+	tests := []struct {
+		name      string
+		src       string
+		wantLimit time.Duration
+	}{
+		{"shell duration", `shell "sleep 5" timeout="100ms"`, 100 * time.Millisecond},
+		{"shell seconds", `shell "sleep 5" timeout=0.2`, 200 * time.Millisecond},
+		{"ask", `ask "build it" timeout="150ms"`, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			_, _, err := runScript(t, tt.src, func(i *Interpreter) {
+				i.SetClaudeCLI(slowClaude)
+				i.SetShellTimeout(time.Minute)
+				i.SetClaudeTimeout(time.Minute)
+			})
+			var timeoutErr *TimeoutError
+			if !errors.As(err, &timeoutErr) || timeoutErr.Limit != tt.wantLimit {
+				t.Fatalf("error = %v, want a timeout after %s", err, tt.wantLimit)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("step ran for %s", elapsed)
+			}
+		})
+	}
+
+	if _, _, err := runScript(t, `shell "true" timeout="soon"`); err == nil || !strings.Contains(err.Error(), `invalid timeout "soon"`) {
+		t.Errorf("invalid timeout error = %v", err)
+	}
+}
+
+func TestListComprehensions(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"map", `result = [x + 1 for x in [1, 2, 3]]`, []interface{}{float64(2), float64(3), float64(4)}},
+		{"filter", `result = [x for x in [1, 2, 3, 4] if x > 2]`, []interface{}{float64(3), float64(4)}},
+		{"filter drops everything", `result = [x for x in ["a"] if x == "b"]`, []interface{}{}},
+		{"empty list", `result = [x for x in []]`, []interface{}{}},
+		{"loop variable restored", "x = \"kept\"\nys = [x for x in [1, 2]]\nresult = x", "kept"},
+		{"for as a name", "for = [\"a\", \"b\"]\nresult = [f + \"!\" for f in for]", []interface{}{"a!", "b!"}},
+	})
+
+	if _, _, err := runScript(t, `result = [x for x in "abc"]`); err == nil || !strings.Contains(err.Error(), "not a list") {
+		t.Errorf("iterating a string: error = %v", err)
+	}
+}
+
+func TestAllowedTools(t *testing.T) {
+	// Print the arguments that come before the prompt
+	echoArgs := stubClaude(t, `for a; do [ "$a" = -p ] && break; printf '%s|' "$a"; done`)
+	tests := []struct {
+		name   string
+		global []string
+		src    string
+		want   string
+	}{
+		{"none", nil, `result = ask "go"`, "--print|"},
+		{"global", []string{"Read", "Edit"}, `result = ask "go"`, "--print|--allowedTools|Read|Edit|"},
+		{"step", nil, `result = ask "go" tools=["Grep"]`, "--print|--allowedTools|Grep|"},
+		{"step overrides global", []string{"Read"}, `result = ask "go" tools=["Grep", "Bash"]`, "--print|--allowedTools|Grep|Bash|"},
+		{"empty list inherits global", []string{"Read"}, `result = ask "go" tools=[]`, "--print|--allowedTools|Read|"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resultOf(t, tt.src, func(i *Interpreter) {
+				i.SetClaudeCLI(echoArgs)
+				i.SetSkipPermissions(false)
+				i.SetAllowedTools(tt.global)
+			})
+			if got != tt.want {
+				t.Errorf("claude args = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskCapture(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		src    string
+		want   map[string]interface{}
+	}{
+		{"single variable", "hello", `a = ask "go"`, map[string]interface{}{"a": "hello"}},
+		{"json array", `["index.html", 2]`, `a, b = ask "go"`, map[string]interface{}{"a": "index.html", "b": float64(2)}},
+		{"lines", "first\\n\\nsecond\\n", `a, b = ask "go"`, map[string]interface{}{"a": "first", "b": "second"}},
+		{"too few values", "only", `a, b = ask "go"`, map[string]interface{}{"a": "only", "b": ""}},
+		{"runs in order", "out", "a = ask \"go\"\nb = a + \"!\"", map[string]interface{}{"a": "out", "b": "out!"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claude := stubClaude(t, "printf '"+tt.output+"'")
+			interp, _, err := runScript(t, tt.src, func(i *Interpreter) { i.SetClaudeCLI(claude) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := interp.variables[name]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHookFailurePolicies(t *testing.T) {
+	src := `before {
+  shell "false"
+}
+after {
+  shell "false"
+}
+after {
+  shell "echo after"
+}
+shell "echo body"
+`
+	tests := []struct {
+		name                          string
+		beforeFailFast, afterFailFast bool
+		wantErr                       string
+		wantSteps                     []string
+	}{
+		{"default", true, false, "before hook failed", []string{"false"}},
+		{"lenient", false, false, "", []string{"false", "echo body", "false", "echo after"}},
+		{"fail fast", true, true, "before hook failed", []string{"false"}},
+		{"strict after only", false, true, "after hook failed", []string{"false", "echo body", "false"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, src, func(i *Interpreter) {
+				i.SetBeforeFailFast(tt.beforeFailFast)
+				i.SetAfterFailFast(tt.afterFailFast)
+			})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if got := stepDetails(interp); strings.Join(got, "|") != strings.Join(tt.wantSteps, "|") {
+				t.Errorf("steps = %q, want %q", got, tt.wantSteps)
+			}
+		})
+	}
+}
+
+func TestFakeSeed(t *testing.T) {
+	src := "a = ask \"name it\"\nb = shell \"date\"\nresult = [a, b]"
+	fake := func(seed int64) func(*Interpreter) {
+		return func(i *Interpreter) {
+			i.SetFake(true)
+			i.SetSeed(seed)
+		}
+	}
+
+	first := resultOf(t, src, fake(42))
+	if again := resultOf(t, src, fake(42)); !reflect.DeepEqual(first, again) {
+		t.Errorf("seed 42 gave %v, then %v", first, again)
+	}
+	if other := resultOf(t, src, fake(7)); reflect.DeepEqual(first, other) {
+		t.Errorf("seeds 42 and 7 both gave %v", first)
+	}
+	values := first.([]interface{})
+	if !strings.HasPrefix(values[0].(string), "claude-stub-") || !strings.HasPrefix(values[1].(string), "shell-stub-") {
+		t.Errorf("stub values = %q", values)
+	}
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	if _, _, err := runScript(t, `shell "touch `+marker+`"`, fake(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("fake mode ran the shell command")
+	}
+}
+
+func TestSetupBlocks(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		wantSteps []string
+		wantErr   string
+	}{
+		{"not run unless invoked", "setup \"db\" {\n  shell \"echo db\"\n}\nshell \"echo app\"", []string{"echo app"}, ""},
+		{"run", "setup \"db\" {\n  shell \"echo db\"\n}\nrun \"db\"\nrun \"db\"", []string{"echo db", "echo db"}, ""},
+		{"defined after use", "run \"db\"\nsetup \"db\" {\n  shell \"echo db\"\n}", []string{"echo db"}, ""},
+		{"nested", "setup \"a\" {\n  run \"b\"\n}\nsetup \"b\" {\n  shell \"echo b\"\n}\nrun \"a\"", []string{"echo b"}, ""},
+		{"undefined", `run "db"`, nil, "undefined setup: db"},
+		{"recursive", "setup \"a\" {\n  run \"a\"\n}\nrun \"a\"", nil, `setup "a" invokes itself`},
+		{"shell.run is an MCP call", "shell.run \"echo mcp\"", []string{"shell.run echo mcp"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if got := stepDetails(interp); strings.Join(got, "|") != strings.Join(tt.wantSteps, "|") {
+				t.Errorf("steps = %q, want %q", got, tt.wantSteps)
+			}
+		})
+	}
+}
+
+func TestBooleanLiterals(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"True", "result = True", true},
+		{"true", "result = true", true},
+		{"False", "result = False", false},
+		{"false", "result = false", false},
+		{"lowercase in a condition", "result = \"no\"\nif true {\n  result = \"yes\"\n}", "yes"},
+		{"mixed cases compare equal", "result = False\nif true == True {\n  result = True\n}", true},
+	})
+}
+
+func TestClaudeJSONMode(t *testing.T) {
+	dir := t.TempDir()
+	argsFile, stdinFile := filepath.Join(dir, "args"), filepath.Join(dir, "stdin")
+	claude := stubClaude(t, `printf '%s\n' "$@" > `+argsFile+`
+cat > `+stdinFile+`
+echo '{"type":"system","subtype":"init"}'
+echo '{"type":"assistant","message":{"content":[{"type":"text","text":"working"}]}}'
+echo '{"type":"result","subtype":"success","is_error":false,"result":"done"}'`)
+
+	interp, _, err := runScript(t, `result = ask "build it" tools=["Read"]`, func(i *Interpreter) {
+		i.SetClaudeCLI(claude)
+		i.SetClaudeMode("json")
+		i.SetModel("haiku")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := interp.variables["result"]; got != "done" {
+		t.Errorf("result = %q, want the result event's text", got)
+	}
+
+	args, _ := os.ReadFile(argsFile)
+	wantArgs := "--print --dangerously-skip-permissions --model haiku --allowedTools Read --input-format stream-json --output-format stream-json --verbose"
+	if got := strings.Join(strings.Fields(string(args)), " "); got != wantArgs {
+		t.Errorf("args = %q, want %q", got, wantArgs)
+	}
+
+	stdin, _ := os.ReadFile(stdinFile)
+	var message claudeInput
+	if err := json.Unmarshal(stdin, &message); err != nil {
+		t.Fatalf("stdin %q: %v", stdin, err)
+	}
+	if message.Type != "user" || message.Message.Role != "user" || len(message.Message.Content) != 1 ||
+		message.Message.Content[0].Type != "text" || !strings.Contains(message.Message.Content[0].Text, "build it") {
+		t.Errorf("stdin message = %s", stdin)
+	}
+}
+
+func TestClaudeStreamResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    string
+		wantErr bool
+	}{
+		{"result", `{"type":"assistant"}` + "\n" + `{"type":"result","result":"ok"}` + "\n", "ok", false},
+		{"stderr mixed in", "warning: slow\n" + `{"type":"result","result":"ok"}`, "ok", false},
+		{"error result", `{"type":"result","is_error":true,"result":"quota"}`, "", true},
+		{"no result", `{"type":"assistant"}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := claudeStreamResult(tt.out)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("claudeStreamResult = %q, %v; want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAggregateBuiltins(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"sum", `result = sum([3, 9, 4])`, float64(16)},
+		{"sum of empty", `result = sum([])`, float64(0)},
+		{"sum of numeric strings", `result = sum(["1", "2.5"])`, float64(3.5)},
+		{"min", `result = min([3, 9, 4])`, float64(3)},
+		{"max", `result = max([3, 9, 4])`, float64(9)},
+		{"single", `result = max([7])`, float64(7)},
+	})
+
+	for _, name := range []string{"min", "max"} {
+		if _, _, err := runScript(t, "result = "+name+"([])"); err == nil || !strings.Contains(err.Error(), name+" of an empty list") {
+			t.Errorf("%s([]) error = %v", name, err)
+		}
+	}
+}
+
+func TestInterpolation(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"variable", "name = \"app\"\nresult = \"hi ${name}\"", "hi app"},
+		{"list element", "tools = [\"vite\", \"jwt\"]\nresult = \"${tools[1]}\"", "jwt"},
+		{"unknown kept", `result = "${missing}"`, "${missing}"},
+		{"backslash escape", "name = \"app\"\nresult = \"\\${name}\"", "${name}"},
+		{"dollar escape", "name = \"app\"\nresult = \"$${name}\"", "${name}"},
+		{"not rescanned", "a = \"${b}\"\nb = \"x\"\nresult = \"${a}\"", "${b}"},
+	})
+}
+
+func TestShellInterpolationQuoting(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		src   string
+		want  string
+	}{
+		{"spaces", `"My App"`, `out = shell "printf '%s|' ${v}"`, "My App|"},
+		{"single quote", `"it's"`, `out = shell "printf '%s|' ${v}"`, "it's|"},
+		{"command substitution", `"$(echo pwned)"`, `out = shell "printf '%s|' ${v}"`, "$(echo pwned)|"},
+		{"separator", `"x; echo pwned"`, `out = shell "printf '%s|' ${v}"`, "x; echo pwned|"},
+		{"list elements are words", `["a b", "c"]`, `out = shell "printf '%s|' ${v}"`, "a b|c|"},
+		{"shell.run", `"a b"`, "shell.run \"printf '%s|' ${v} > ${f}\"\nout = shell \"cat ${f}\"", "a b|"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := filepath.Join(t.TempDir(), "out")
+			src := "v = " + tt.value + "\nf = \"" + f + "\"\n" + tt.src
+			interp, _, err := runScript(t, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := interp.variables["out"]; got != tt.want {
+				t.Errorf("out = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := shellQuote("it's"); got != `'it'\''s'` {
+		t.Errorf("shellQuote = %s", got)
+	}
+}
+
+func TestJUnitReport(t *testing.T) {
+	steps := []StepRecord{
+		{Index: 1, Kind: "shell", Detail: "npm ci", Status: "passed", Duration: 1500 * time.Millisecond},
+		{Index: 2, Kind: "claude", Detail: "add tests", Group: "backend", Status: "failed", Duration: time.Second, Err: "exit status 1"},
+		{Index: 3, Kind: "shell", Detail: "npm test", Status: "skipped", Output: "not run"},
+	}
+	var buf bytes.Buffer
+	if err := writeJUnitReport(&buf, "shop", steps); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), xml.Header) {
+		t.Errorf("report does not start with the XML header:\n%s", buf.String())
+	}
+
+	var suite junitTestSuite
+	if err := xml.Unmarshal(buf.Bytes(), &suite); err != nil {
+		t.Fatal(err)
+	}
+	if suite.Name != "shop" || suite.Tests != 3 || suite.Failures != 1 || suite.Skipped != 1 || suite.Time != "2.500" {
+		t.Errorf("suite = %+v", suite)
+	}
+	tests := []struct {
+		name, classname string
+		failed, skipped bool
+	}{
+		{"1: npm ci", "vibe.shell", false, false},
+		{"2: add tests", "backend.vibe.claude", true, false},
+		{"3: npm test", "vibe.shell", false, true},
+	}
+	for n, tt := range tests {
+		tc := suite.TestCases[n]
+		if tc.Name != tt.name || tc.Classname != tt.classname || (tc.Failure != nil) != tt.failed || (tc.Skipped != nil) != tt.skipped {
+			t.Errorf("testcase %d = %+v, want %+v", n, tc, tt)
+		}
+	}
+	if f := suite.TestCases[1].Failure; f != nil && f.Message != "exit status 1" {
+		t.Errorf("failure message = %q", f.Message)
+	}
+	if out := suite.TestCases[2].SystemOut; out != "not run" {
+		t.Errorf("system-out = %q", out)
+	}
+}
+
+func TestTernaryExpressions(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"then", "env = \"prod\"\nresult = env == \"prod\" ? \"strict\" : \"loose\"", "strict"},
+		{"else", "env = \"dev\"\nresult = env == \"prod\" ? \"strict\" : \"loose\"", "loose"},
+		{"bare boolean", "ci = True\nresult = ci ? 1 : 2", float64(1)},
+		{"numeric comparison", "n = 10\nresult = n > 9 ? \"big\" : \"small\"", "big"},
+		{"nested in else", "n = 2\nresult = n == 1 ? \"one\" : n == 2 ? \"two\" : \"many\"", "two"},
+		{"sum operands", "result = 1 + 2 == 3 ? \"yes\" : \"no\"", "yes"},
+		{"comparison value", "result = 2 < 3", true},
+		{"across lines", "result = True ?\n  \"a\" :\n  \"b\"", "a"},
+	})
+	if errs := parseErrors(`x = True ? "a"`); len(errs) == 0 || !strings.Contains(errs[0], "expected ':'") {
+		t.Errorf("missing ':' errors = %q", errs)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"new file", "", "a\nb\n", "--- a/f\n+++ b/f\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"changed line", "a\nb\nc\n", "a\nB\nc\n", "--- a/f\n+++ b/f\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"appended", "a\n", "a\nb\n", "--- a/f\n+++ b/f\n@@ -1,1 +1,2 @@\n a\n+b\n"},
+		{"distant changes", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "x\n2\n3\n4\n5\n6\n7\n8\n9\ny\n",
+			"--- a/f\n+++ b/f\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+y\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unifiedDiff("a/f", "b/f", tt.old, tt.new)
+			if err != nil || got != tt.want {
+				t.Errorf("unifiedDiff:\n%s\nwant:\n%s (err %v)", got, tt.want, err)
+			}
+		})
+	}
+
+	// Appending to a long file only compares the new lines
+	long := strings.Repeat("line\n", 20000)
+	got, err := unifiedDiff("a/f", "b/f", long, long+"more\n")
+	if want := "--- a/f\n+++ b/f\n@@ -19998,3 +19998,4 @@\n line\n line\n line\n+more\n"; err != nil || got != want {
+		t.Errorf("append to a long file:\n%s\nwant:\n%s (err %v)", got, want, err)
+	}
+	if _, err := unifiedDiff("a/f", "b/f", long, strings.Repeat("other\n", 20000)); !errors.Is(err, errDiffTooLarge) {
+		t.Errorf("rewriting a long file: err = %v, want errDiffTooLarge", err)
+	}
+}
+
+func TestDryRunFS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := `fs.append path="` + path + `" content="two\n"
+fs.write path="` + path + `.new" content="fresh\n"`
+	_, out, err := runScript(t, src, func(i *Interpreter) { i.SetDryRunFS(true) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"changes to " + path, " one\n+two\n", "new file: " + path + ".new", "--- /dev/null\n", "+fresh\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "one\n" {
+		t.Errorf("file was changed to %q", data)
+	}
+	if _, err := os.Stat(path + ".new"); !os.IsNotExist(err) {
+		t.Error("new file was created")
+	}
+
+	// The diff is part of the log, which quiet hides and events carry
+	var events bytes.Buffer
+	_, out, err = runScript(t, src, func(i *Interpreter) {
+		i.SetDryRunFS(true)
+		i.SetVerbose(false)
+		i.SetEventStream(&events)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "+two") {
+		t.Errorf("quiet run printed the diff:\n%s", out)
+	}
+	if !strings.Contains(events.String(), `"detail":"+two"`) {
+		t.Errorf("no log event for the diff:\n%s", events.String())
+	}
+}
+
+func TestForLoops(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"value", "result = \"\"\nfor t in [\"a\", \"b\"] {\n  result = result + t\n}", "ab"},
+		{"index and value", "result = \"\"\nfor n, t in [\"a\", \"b\"] {\n  result = result + \"${n}=${t};\"\n}", "0=a;1=b;"},
+		{"empty list", "result = \"none\"\nfor t in [] {\n  result = t\n}", "none"},
+		{"variables restored", "t = \"kept\"\nn = 9\nfor n, t in [\"a\"] {\n  x = 1\n}\nresult = \"${n} ${t}\"", "9 kept"},
+		{"list from a comprehension", "result = 0\nfor x in [y + 1 for y in [1, 2]] {\n  result = result + x\n}", float64(5)},
+	})
+
+	if _, _, err := runScript(t, "for t in \"abc\" {\n  x = t\n}"); err == nil || !strings.Contains(err.Error(), "not a list") {
+		t.Errorf("iterating a string: error = %v", err)
+	}
+	if errs := parseErrors("for a, b, c in [] {\n}"); len(errs) == 0 {
+		t.Error("three loop variables parsed")
+	}
+}
+
+func TestImportEnv(t *testing.T) {
+	t.Setenv("VIBETEST_PROJECT", "shop")
+	t.Setenv("VIBETEST_WORKERS", "4")
+	t.Setenv("VIBETEST_CI", "true")
+	t.Setenv("VIBETEST_VERSION", "1.2.3")
+	t.Setenv("VIBETEST_OVERRIDDEN", "env")
+	t.Setenv("OTHER_PROJECT", "ignored")
+
+	interp, _ := newTestInterpreter()
+	if n := interp.ImportEnv("VIBETEST_"); n != 5 {
+		t.Errorf("ImportEnv imported %d variables, want 5", n)
+	}
+	if err := interp.Execute(parse(t, `overridden = "script"`)); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"project":    "shop",
+		"workers":    float64(4),
+		"ci":         true,
+		"version":    "1.2.3",
+		"overridden": "script",
+	}
+	for name, value := range want {
+		if got := interp.variables[name]; got != value {
+			t.Errorf("%s = %#v, want %#v", name, got, value)
+		}
+	}
+}
+
+// countingClaude returns a stub Claude CLI that records each call in a
+// file and exits with status 1 on the calls listed in failOn (1-based), and
+// a function returning the number of calls so far.
+func countingClaude(t *testing.T, failOn ...int) (string, func() int) {
+	t.Helper()
+	calls := filepath.Join(t.TempDir(), "calls")
+	body := "echo x >> " + calls + "\nn=$(wc -l < " + calls + ")\n"
+	for _, n := range failOn {
+		body += fmt.Sprintf("[ $n -eq %d ] && exit 1\n", n)
+	}
+	claude := stubClaude(t, body+"exit 0")
+	return claude, func() int {
+		data, _ := os.ReadFile(calls)
+		return strings.Count(string(data), "\n")
+	}
+}
+
+// fastRetries shortens the retry backoff for the rest of the test.
+func fastRetries(t *testing.T) {
+	saved := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = saved })
+}
+
+func TestRetryBudget(t *testing.T) {
+	fastRetries(t)
+	src := "ask \"first\"\nask \"second\""
+	tests := []struct {
+		name      string
+		src       string
+		retries   int
+		budget    int
+		failOn    []int
+		wantCalls int
+		wantErr   string
+	}{
+		{"no failures", src, 0, 2, nil, 2, ""},
+		{"retry succeeds", src, 0, 1, []int{1}, 3, ""},
+		{"shared by steps", src, 0, 2, []int{1, 3}, 4, ""},
+		{"exhausted", src, 0, 2, []int{1, 2, 3}, 3, "retry budget exhausted"},
+		{"no budget", src, 0, -1, []int{1}, 1, "exit status 1"},
+		{"retries without a budget", src, 2, -1, []int{1, 2}, 4, ""},
+		{"budget caps step retries", src, 3, 1, []int{1, 2}, 2, "retry budget exhausted"},
+		{"step retries cap the budget", src, 1, 5, []int{1, 2}, 2, "exit status 1"},
+		{"retries= on the ask", "ask \"first\" retries=0", 0, 5, []int{1}, 1, "exit status 1"},
+		{"zero budget", src, 0, 0, []int{1}, 1, "exit status 1"},
+		{"step retries run out with the budget", src, 1, 1, []int{1, 2}, 2, "exit status 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claude, calls := countingClaude(t, tt.failOn...)
+			_, _, err := runScript(t, tt.src, func(i *Interpreter) {
+				i.SetClaudeCLI(claude)
+				i.SetRetries(tt.retries)
+				i.SetRetryBudget(tt.budget)
+			})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(tt.wantErr, "budget") && strings.Contains(err.Error(), "budget") {
+				t.Errorf("error = %v, but the budget did not stop a retry", err)
+			}
+			if got := calls(); got != tt.wantCalls {
+				t.Errorf("Claude was called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+
+	// Failures that would fail again are not retried
+	interp, _, err := runScript(t, `ask "first"`, func(i *Interpreter) {
+		i.SetClaudeCLI(filepath.Join(t.TempDir(), "no-such-claude"))
+		i.SetRetryBudget(3)
+	})
+	if err == nil || strings.Contains(err.Error(), "retry budget") || interp.retryBudget != 3 {
+		t.Errorf("err = %v, budget left = %d", err, interp.retryBudget)
+	}
+}
+
+func TestStepModel(t *testing.T) {
+	// Print the value passed with --model
+	claude := stubClaude(t, `while [ $# -gt 0 ]; do [ "$1" = --model ] && printf '%s' "$2"; shift; done`)
+	modelFor := map[string]string{"scaffold": "haiku-fast"}
+	tests := []struct {
+		name     string
+		flag     string
+		modelFor map[string]string
+		src      string
+		want     string
+	}{
+		{"none", "", nil, `result = ask "go"`, ""},
+		{"script", "", nil, "model = \"haiku\"\nresult = ask \"go\"", "haiku"},
+		{"flag beats script", "sonnet", nil, "model = \"haiku\"\nresult = ask \"go\"", "sonnet"},
+		{"step beats flag", "sonnet", nil, "model = \"haiku\"\nresult = ask \"go\" model=\"opus\"", "opus"},
+		{"kind beats flag", "sonnet", modelFor, `result = ask "go" kind="scaffold"`, "haiku-fast"},
+		{"unmapped kind", "sonnet", modelFor, `result = ask "go" kind="review"`, "sonnet"},
+		{"step beats kind", "", modelFor, `result = ask "go" kind="scaffold" model="opus"`, "opus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resultOf(t, tt.src, func(i *Interpreter) {
+				i.SetClaudeCLI(claude)
+				i.SetModel(tt.flag)
+				i.SetModelFor(tt.modelFor)
+			})
+			if got != tt.want {
+				t.Errorf("model = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkippedSteps(t *testing.T) {
+	src := "shell \"echo one\"\nshell \"echo two\"\nask \"go\""
+	approve := func(answers string, terminal bool) func(*Interpreter) {
+		return func(i *Interpreter) {
+			i.SetClaudeCLI("true")
+			i.SetInteractiveApprove(true)
+			i.SetApproveInput(strings.NewReader(answers), terminal)
+		}
+	}
+	tests := []struct {
+		name string
+		opts []func(*Interpreter)
+		want []string
+	}{
+		{"approved", []func(*Interpreter){approve("y\nyes\n", true)}, []string{"passed", "passed", "passed"}},
+		{"declined", []func(*Interpreter){approve("n\ny\n", true)}, []string{"skipped", "passed", "passed"}},
+		{"no terminal", []func(*Interpreter){approve("", false)}, []string{"skipped", "skipped", "passed"}},
+		{"dry run", []func(*Interpreter){dryRun}, []string{"skipped", "skipped", "skipped"}},
+		{"fake", []func(*Interpreter){func(i *Interpreter) { i.SetFake(true) }}, []string{"skipped", "skipped", "skipped"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, src, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, step := range interp.Steps() {
+				got = append(got, step.Status)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statuses = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeclinedFileActions(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"append", `fs.append path="a.txt" content=" more"`},
+		{"write", `fs.write path="a.txt" content="replaced"`},
+		{"mkdir", `fs.mkdir "a.txt.d"`},
+		{"copy", `fs.copy "a.txt" "b.txt"`},
+		{"move", `fs.move "a.txt" "b.txt"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("original"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			interp, _, err := runScript(t, tt.src, func(i *Interpreter) {
+				i.SetWorkDir(dir)
+				i.SetInteractiveApprove(true)
+				i.SetApproveInput(strings.NewReader(""), false)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := interp.Steps()[0].Status; status != "skipped" {
+				t.Errorf("status = %s, want skipped", status)
+			}
+			entries, _ := os.ReadDir(dir)
+			data, _ := os.ReadFile(filepath.Join(dir, "a.txt"))
+			if len(entries) != 1 || string(data) != "original" {
+				t.Errorf("declined %s changed the directory: %d entries, a.txt = %q", tt.name, len(entries), data)
+			}
+		})
+	}
+}
+
+func TestJSONGet(t *testing.T) {
+	doc := `{"data": {"items": [{"id": 7, "tags": ["a", "b"]}], "ok": true, "name": null}}`
+	tests := []struct {
+		path    string
+		want    interface{}
+		wantErr string
+	}{
+		{"data.items.0.id", float64(7), ""},
+		{"data.items[0].id", float64(7), ""},
+		{"data.items[0].tags", []interface{}{"a", "b"}, ""},
+		{"data.ok", true, ""},
+		{"data.name", nil, ""},
+		{"data.items[0]", `{"id":7,"tags":["a","b"]}`, ""},
+		{"data.missing", nil, "json_get: no data.missing in document"},
+		{"data.items[3]", nil, "json_get: no data.items.3 in document (array of 1)"},
+		{"data.ok.x", nil, "json_get: no data.ok.x in document (not an object or array)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := jsonGet(doc, tt.path)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jsonGet(%q) = %#v, want %#v", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := jsonGet("{", "a"); err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Errorf("invalid document: error = %v", err)
+	}
+	runValueTests(t, []valueTest{
+		{"builtin", "doc = \"{\\\"a\\\": {\\\"b\\\": 2}}\"\nresult = json_get(json_get(doc, \"a\"), \"b\")", float64(2)},
+	})
+}
+
+func TestEachHooks(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		wantSteps []string
+		wantErr   string
+	}{
+		{"for", "for t in [\"a\", \"b\"] {\n  before each {\n    shell \"echo before\"\n  }\n  after each {\n    shell \"echo after\"\n  }\n  shell \"echo ${t}\"\n}",
+			[]string{"echo before", "echo 'a'", "echo after", "echo before", "echo 'b'", "echo after"}, ""},
+		{"repeat", "repeat 2 {\n  after each {\n    shell \"echo after\"\n  }\n  shell \"echo body\"\n}",
+			[]string{"echo body", "echo after", "echo body", "echo after"}, ""},
+		{"after each runs when the body fails", "for t in [1, 2] {\n  after each {\n    shell \"echo after\"\n  }\n  shell \"false\"\n}",
+			[]string{"false", "echo after"}, "exit status 1"},
+		{"failing after each", "for t in [1, 2] {\n  after each {\n    shell \"false\"\n  }\n  shell \"echo body\"\n}",
+			[]string{"echo body", "false"}, "after each failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if got := stepDetails(interp); strings.Join(got, "|") != strings.Join(tt.wantSteps, "|") {
+				t.Errorf("steps = %q, want %q", got, tt.wantSteps)
+			}
+		})
+	}
+
+	if errs := parseErrors("before each {\n  shell \"true\"\n}"); len(errs) == 0 || !strings.Contains(errs[0], "is only allowed inside a repeat") {
+		t.Errorf("top-level before each: errors = %q", errs)
+	}
+}
+
+func TestStepSummary(t *testing.T) {
+	steps := []StepRecord{
+		{Index: 1, Kind: "shell", Detail: "npm ci", Status: "passed", Duration: 1500 * time.Millisecond},
+		{Index: 2, Kind: "claude", Detail: "add\n  tests", Group: "backend", Status: "failed", Err: "exit status 1"},
+		{Index: 3, Kind: "shell", Detail: "npm test", Status: "skipped"},
+	}
+	var buf bytes.Buffer
+	printStepSummary(&buf, steps)
+	want := `#  STATUS   TIME  STEP
+1  passed   1.5s  shell: npm ci
+2  failed   0s    backend / claude: add tests
+                    exit status 1
+3  skipped  0s    shell: npm test
+3 steps: 1 passed, 1 failed, 1 skipped
+`
+	if buf.String() != want {
+		t.Errorf("summary:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+	}{
+		{"set", "require [\"project\", tools]\nproject = \"shop\"\ntools = [\"vite\"]", ""},
+		{"single bare name", "require project\nproject = \"shop\"", ""},
+		{"missing", "require [project, db]\nproject = \"shop\"", "missing required variables: db"},
+		{"empty string", "require project\nproject = \"\"", "missing required variables: project"},
+		{"several missing", "require [\n  a,\n  b\n]", "missing required variables: a, b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The shell step must not run when a check fails
+			interp, _, err := runScript(t, tt.src+"\nshell \"true\"")
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if ran := len(interp.Steps()) > 0; ran != (tt.wantErr == "") {
+				t.Errorf("steps ran = %v", ran)
+			}
+		})
+	}
+
+	if got := statements(t, "require [\"a\", b]\nrequire = 1"); strings.Join(got, "|") != "require [a, b]|require = 1" {
+		t.Errorf("statements = %q", got)
+	}
+}
+
+func TestFullContext(t *testing.T) {
+	src := "project = \"shop\"\nports = [80, 443]\nGITHUB_TOKEN = \"ghp_123\"\ndb_password = \"hunter2\"\nask \"go\""
+	prompt := func(full bool) string {
+		interp, _, err := runScript(t, src, func(i *Interpreter) {
+			i.SetDumpPrompts(true)
+			i.SetFullContext(full)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return interp.DumpedPrompts()[0].Prompt
+	}
+
+	if p := prompt(false); strings.Contains(p, "(JSON)") {
+		t.Errorf("prompt has the JSON document without --full-context:\n%s", p)
+	}
+	p := prompt(true)
+	start, end := strings.Index(p, "```json\n"), strings.LastIndex(p, "\n```")
+	if start < 0 || end < start {
+		t.Fatalf("no JSON document in prompt:\n%s", p)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(p[start+len("```json\n"):end]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"project":      "shop",
+		"ports":        []interface{}{float64(80), float64(443)},
+		"GITHUB_TOKEN": "***",
+		"db_password":  "***",
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("document = %v, want %v", doc, want)
+	}
+	for _, secret := range []string{"ghp_123", "hunter2"} {
+		if strings.Contains(p, secret) {
+			t.Errorf("prompt leaks %q:\n%s", secret, p)
+		}
+	}
+}
+
+func TestPromptLeavesOutControlVariables(t *testing.T) {
+	src := `project = "shop"
+region = "eu"
+model = "haiku"
+workdir = "` + t.TempDir() + `"
+summary = "done"
+shell "true"
+ask "build it"`
+	interp, _, err := runScript(t, src, func(i *Interpreter) {
+		i.SetDumpPrompts(true)
+		i.SetFullContext(true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := interp.DumpedPrompts()[0].Prompt
+	for _, want := range []string{"Project Name: shop", "region: eu", `"region": "eu"`} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt does not contain %q:\n%s", want, prompt)
+		}
+	}
+	for _, name := range []string{"model", "workdir", "summary", "last_exit"} {
+		if strings.Contains(prompt, name+": ") || strings.Contains(prompt, `"`+name+`"`) {
+			t.Errorf("prompt lists %s:\n%s", name, prompt)
+		}
+	}
+}
+
+func TestResolveProgram(t *testing.T) {
+	src := `project = "shop"
+tools = ["vite", "jwt"]
+prompt scaffold = "Create ${project}"
+ask scaffold
+if project == "shop" {
+  shell "mkdir ${project}"
+}
+for t in tools {
+  ask "add ${t} to ${project}"
+}
+shell.run "echo ${tools[0]}"
+`
+	interp, _ := newTestInterpreter()
+	got, err := interp.ResolveProgram(parse(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`ask "Create shop"`,
+		`shell "mkdir 'shop'"`,
+		`ask "add ${t} to shop"`,
+		`shell.run "echo 'vite'"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("resolved program does not contain %s:\n%s", want, got)
+		}
+	}
+	if len(interp.Steps()) != 0 {
+		t.Errorf("ResolveProgram ran %d steps", len(interp.Steps()))
+	}
+}
+
+func TestConditionalHooks(t *testing.T) {
+	src := `before when ci {
+  shell "echo ci setup"
+}
+before when env == "prod" {
+  shell "echo prod setup"
+}
+after when ci == False {
+  shell "echo local cleanup"
+}
+for t in [1, 2] {
+  before each when t > 1 {
+    shell "echo second"
+  }
+  shell "echo body"
+}
+`
+	tests := []struct {
+		name      string
+		vars      string
+		wantSteps []string
+	}{
+		{"ci", "ci = True\nenv = \"dev\"\n", []string{"echo ci setup", "echo body", "echo second", "echo body"}},
+		{"prod", "ci = False\nenv = \"prod\"\n", []string{"echo prod setup", "echo body", "echo second", "echo body", "echo local cleanup"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.vars+src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stepDetails(interp); strings.Join(got, "|") != strings.Join(tt.wantSteps, "|") {
+				t.Errorf("steps = %q, want %q", got, tt.wantSteps)
+			}
+		})
+	}
+}
+
+func TestPromptFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "prompts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"prompts/scaffold.txt":    "  Create the ${project} layout\n",
+		"prompts/big refactor.md": "Refactor everything",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := "project = \"shop\"\nask @prompts/scaffold.txt\nask @\"prompts/big refactor.md\" timeout=\"20m\"\nask @" + filepath.Join(dir, "prompts", "scaffold.txt")
+	got := dumpPrompts(t, src, func(i *Interpreter) { i.SetBaseDir(dir) })
+	want := []string{"Create the shop layout", "Refactor everything", "Create the shop layout"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("instructions = %q, want %q", got, want)
+	}
+
+	_, _, err := runScript(t, "ask @missing.txt", func(i *Interpreter) { i.SetBaseDir(dir) })
+	if err == nil || !strings.Contains(err.Error(), "reading prompt file missing.txt") {
+		t.Errorf("missing file: error = %v", err)
+	}
+	if errs := parseErrors("ask @ \"x\""); len(errs) == 0 {
+		t.Error("ask @ without a path parsed")
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	claude := stubClaude(t, "printf 'abcdefghij'")
+	tests := []struct {
+		name string
+		max  int
+		src  string
+		want string
+	}{
+		{"ask", 4, `result = ask "go"`, "abcd\n[... output truncated: 6 bytes over the 4 byte limit]"},
+		{"shell", 4, `result = shell "printf 0123456789"`, "0123\n[... output truncated: 6 bytes over the 4 byte limit]"},
+		{"under the cap", 10, `result = shell "printf 0123456789"`, "0123456789"},
+		{"no cap", 0, `result = ask "go"`, "abcdefghij"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, out, err := runScript(t, tt.src, func(i *Interpreter) {
+				i.SetClaudeCLI(claude)
+				i.SetMaxOutputBytes(tt.max)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := interp.variables["result"]; got != tt.want {
+				t.Errorf("result = %q, want %q", got, tt.want)
+			}
+			if truncated := strings.Contains(out, "Captured output truncated"); truncated != strings.Contains(tt.want, "truncated") {
+				t.Errorf("truncation warning logged = %v:\n%s", truncated, out)
+			}
+		})
+	}
+
+	// The step record of combined output is capped too
+	interp, _, err := runScript(t, `shell.run "printf 0123456789"`, func(i *Interpreter) {
+		i.SetCombineOutput(true)
+		i.SetMaxOutputBytes(4)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := interp.Steps()[0].Output; got != "0123" {
+		t.Errorf("step output = %q, want %q", got, "0123")
+	}
+}
+
+func TestSummaryMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"interpolated once", "project = \"shop\"\nsummary = \"Run npm start in ${project}\"", "Run npm start in shop\n"},
+		{"escaped text kept", "summary = \"Use \\${HOME} in scripts\"", "Use ${HOME} in scripts\n"},
+		{"value not rescanned", "name = \"${secret}\"\nsecret = \"x\"\nsummary = \"Hi ${name}\"", "Hi ${secret}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, out, err := runScript(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(out, "Build Complete ═══\n"+tt.want) {
+				t.Errorf("output does not end with %q:\n%s", tt.want, out)
+			}
+		})
+	}
+}
+
+func TestPostConditions(t *testing.T) {
+	dir := t.TempDir()
+	made := filepath.Join(dir, "main.go")
+	// Claude is stood in for by a CLI that creates main.go
+	claude := stubClaude(t, "touch "+made)
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+	}{
+		{"file created", `ask "create main.go" then assert fs.exists "` + made + `"`, ""},
+		{"file missing", `ask "create it" then assert fs.exists "` + filepath.Join(dir, "other.go") + `"`, "post-condition failed: fs.exists"},
+		{"condition holds", "version = \"1.1\"\nask \"bump\" then assert version != \"1.0\"", ""},
+		{"condition fails", "version = \"1.0\"\nask \"bump\" then assert version != \"1.0\"", `post-condition failed: version != "1.0"`},
+		{"interpolated path", "dir = \"" + dir + "\"\nask \"create\" then assert fs.exists \"${dir}/main.go\"", ""},
+		{"not a predicate", `ask "create" then assert fs.mkdir "x"`, "fs.mkdir cannot be used in an assertion"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := runScript(t, tt.src, func(i *Interpreter) { i.SetClaudeCLI(claude) })
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if errs := parseErrors(`ask "x" then fs.exists "y"`); len(errs) == 0 || !strings.Contains(errs[0], "expected 'assert' after 'then'") {
+		t.Errorf("then without assert: errors = %q", errs)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []string // event:type:status of every event but log
+		wantErr bool
+	}{
+		{"passing steps", "shell \"true\"\nask \"build it\"\n",
+			[]string{"run_start::running", "step_start:shell:running", "step_end:shell:passed", "step_start:ask:running", "step_end:ask:passed", "run_end::passed"}, false},
+		{"failing step", "shell \"false\"\nshell \"true\"\n",
+			[]string{"run_start::running", "step_start:shell:running", "step_end:shell:failed", "run_end::failed"}, true},
+		{"no steps", "x = 1\n",
+			[]string{"run_start::running", "run_end::passed"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events bytes.Buffer
+			_, _, err := runScript(t, tt.src, func(i *Interpreter) {
+				i.SetClaudeCLI("true")
+				i.SetEventStream(&events)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			logs := map[int]int{}
+			for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+				var event StreamEvent
+				decoder := json.NewDecoder(strings.NewReader(line))
+				decoder.DisallowUnknownFields()
+				if err := decoder.Decode(&event); err != nil {
+					t.Fatalf("%s: %v", line, err)
+				}
+				for _, field := range []string{"schema_version", "event", "ts", "step_index", "type", "status", "detail"} {
+					if !strings.Contains(line, `"`+field+`":`) {
+						t.Errorf("%s: missing %s", line, field)
+					}
+				}
+				if event.SchemaVersion != EventSchemaVersion || event.TS.IsZero() {
+					t.Errorf("%s: schema_version or ts not set", line)
+				}
+				if event.Event == "log" {
+					if event.Status != "info" || event.Detail == "" {
+						t.Errorf("log event = %+v", event)
+					}
+					logs[event.StepIndex]++
+					continue
+				}
+				got = append(got, event.Event+":"+event.Type+":"+event.Status)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+			if len(tt.want) > 2 && logs[1] == 0 {
+				t.Errorf("no log events for step 1: %v", logs)
+			}
+		})
+	}
+}
+
+func TestSucceeds(t *testing.T) {
+	approve := func(answer string) func(*Interpreter) {
+		return func(i *Interpreter) {
+			i.SetInteractiveApprove(true)
+			i.SetApproveInput(strings.NewReader(answer), true)
+		}
+	}
+	tests := []struct {
+		name       string
+		src        string
+		opts       []func(*Interpreter)
+		want       interface{}
+		wantStatus string
+		wantErr    string
+	}{
+		{name: "exit 0", src: `result = shell "true" succeeds`, want: true, wantStatus: "passed"},
+		{name: "non-zero exit", src: `result = shell "exit 3" succeeds`, want: false, wantStatus: "passed"},
+		{name: "in a condition", src: "result = \"no\"\nif shell \"false\" succeeds {\n  result = \"yes\"\n}", want: "no", wantStatus: "passed"},
+		{name: "dry run", src: `result = shell "true" succeeds`, opts: []func(*Interpreter){dryRun}, want: false, wantStatus: "skipped"},
+		{name: "declined", src: `result = shell "true" succeeds`, opts: []func(*Interpreter){approve("n\n")}, want: false, wantStatus: "skipped"},
+		{name: "approved", src: `result = shell "true" succeeds`, opts: []func(*Interpreter){approve("y\n")}, want: true, wantStatus: "passed"},
+		{name: "fake", src: `result = shell "false" succeeds`, opts: []func(*Interpreter){func(i *Interpreter) { i.SetFake(true) }}, want: true, wantStatus: "skipped"},
+		{name: "blocked by policy", src: `result = shell "true" succeeds`, opts: []func(*Interpreter){func(i *Interpreter) { i.SetAllowShell(false) }}, wantStatus: "failed", wantErr: "disabled by policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src, tt.opts...)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got := interp.variables["result"]; got != tt.want {
+				t.Errorf("result = %#v, want %#v", got, tt.want)
+			}
+			if steps := interp.Steps(); len(steps) != 1 || steps[0].Status != tt.wantStatus {
+				t.Errorf("steps = %+v, want one %s step", steps, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDryRunHooks(t *testing.T) {
+	src := `before {
+  shell "echo before"
+}
+after {
+  shell "echo after"
+}
+repeat 1 {
+  before each {
+    shell "echo before each"
+  }
+  shell "echo body"
+}
+`
+	tests := []struct {
+		name      string
+		noHooks   bool
+		wantSteps []string
+	}{
+		{"previewed by default", false, []string{"echo before", "echo before each", "echo body", "echo after"}},
+		{"skipped with --no-hooks-on-dry-run", true, []string{"echo body"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, out, err := runScript(t, src, dryRun, func(i *Interpreter) { i.SetNoHooksOnDryRun(tt.noHooks) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stepDetails(interp); strings.Join(got, "|") != strings.Join(tt.wantSteps, "|") {
+				t.Errorf("steps = %q, want %q", got, tt.wantSteps)
+			}
+			if previewed := strings.Contains(out, "Would execute: echo before"); previewed == tt.noHooks {
+				t.Errorf("hook preview shown = %v, want %v:\n%s", previewed, !tt.noHooks, out)
+			}
+		})
+	}
+
+	// Without --dry-run the flag has no effect
+	interp, _, err := runScript(t, src, func(i *Interpreter) { i.SetNoHooksOnDryRun(true) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(interp.Steps()); got != 4 {
+		t.Errorf("real run took %d steps, want 4", got)
+	}
+}
+
+func TestProfileFile(t *testing.T) {
+	base := "env = \"dev\"\nreplicas = 1\nask \"deploy to ${env} with ${replicas} replicas\"\n"
+	tests := []struct {
+		name     string
+		profiles []string
+		want     []string // dumped instructions
+		wantErr  string
+	}{
+		{"no profile", nil, []string{"deploy to dev with 1 replicas"}, ""},
+		{"overrides a base variable", []string{"env = \"prod\"\n"}, []string{"deploy to prod with 1 replicas"}, ""},
+		{"refers to the base", []string{"replicas = replicas + 2\n"}, []string{"deploy to dev with 3 replicas"}, ""},
+		{"later files win", []string{"env = \"staging\"\n", "env = \"prod\"\n"}, []string{"deploy to prod with 1 replicas"}, ""},
+		{"not an assignment", []string{"ask \"hi\"\n"}, nil, "only assignments are allowed"},
+		{"runs a step", []string{"env = shell \"echo prod\"\n"}, nil, "profile values must be plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			interp, _ := newTestInterpreter(func(i *Interpreter) { i.SetDumpPrompts(true) })
+			var err error
+			for n, profile := range tt.profiles {
+				path := filepath.Join(dir, fmt.Sprintf("%d.vars", n))
+				if err := os.WriteFile(path, []byte(profile), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err = interp.LoadProfileFile(path); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = interp.ExecuteString(base)
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			var got []string
+			for _, prompt := range interp.DumpedPrompts() {
+				got = append(got, prompt.Instruction)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("prompts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		command string
+		wantErr string
+	}{
+		{"no allowlist", nil, "rm -rf build", ""},
+		{"allowed", []string{"echo"}, "echo hi", ""},
+		{"blocked", []string{"echo"}, "rm -rf build", "rm: command is not in the --allow-cmd list"},
+		{"every pipeline segment", []string{"echo", "tr"}, "echo hi | tr a-z A-Z && echo done", ""},
+		{"blocked pipeline segment", []string{"echo"}, "echo hi | sh", "sh: command is not in the --allow-cmd list"},
+		{"env assignments skipped", []string{"echo"}, "LANG=C echo hi", ""},
+		{"quoted separators", []string{"echo"}, `echo "a; rm -rf /"`, ""},
+		{"command substitution", []string{"echo"}, "echo $(whoami)", "command substitution cannot be checked"},
+		{"relative path", []string{"echo"}, "./echo hi", "./echo: command is not in the --allow-cmd list"},
+		{"absolute path", []string{"echo"}, "/tmp/echo hi", "/tmp/echo: command is not in the --allow-cmd list"},
+		{"listed path", []string{"./scripts/build.sh"}, "scripts/../scripts/build.sh", ""},
+		{"name does not allow a suffix", []string{"echo"}, "echoes", "echoes: command is not in the --allow-cmd list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _ := newTestInterpreter(func(i *Interpreter) { i.SetAllowedCommands(tt.allow) })
+			err := interp.checkCommandAllowed(tt.command)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The allowlist applies to shell steps and shell.run alike
+	for _, src := range []string{`shell "touch x"`, `shell.run "touch x"`} {
+		_, _, err := runScript(t, src, dryRun, func(i *Interpreter) { i.SetAllowedCommands([]string{"echo"}) })
+		if !errors.Is(err, errCommandNotAllowed) {
+			t.Errorf("%s: err = %v, want errCommandNotAllowed", src, err)
+		}
+	}
+}
+
+func TestCombineOutput(t *testing.T) {
+	const command = "printf 'out1 '; printf 'err1 ' >&2; printf 'out2 '; printf 'err2' >&2"
+	tests := []struct {
+		name    string
+		src     string
+		combine bool
+		want    string // step output
+	}{
+		{"shell", `shell "` + command + `"`, true, "out1 err1 out2 err2"},
+		{"shell.run", `shell.run "` + command + `"`, true, "out1 err1 out2 err2"},
+		{"not combined", `shell "printf out"`, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, out, err := runScript(t, tt.src, func(i *Interpreter) { i.SetCombineOutput(tt.combine) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := interp.Steps()[0].Output; got != tt.want {
+				t.Errorf("step output = %q, want %q", got, tt.want)
+			}
+			if tt.combine && !strings.Contains(out, tt.want) {
+				t.Errorf("output does not show the streams in order:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  func(*Interpreter)
+		key  string
+		want interface{} // decoded JSON value
+	}{
+		{"default claude path", nil, "claude_path", "claude"},
+		{"claude path", func(i *Interpreter) { i.SetClaudeCLI("/opt/claude") }, "claude_path", "/opt/claude"},
+		{"default model", nil, "model", ""},
+		{"model", func(i *Interpreter) { i.SetModel("opus") }, "model", "opus"},
+		{"retries", func(i *Interpreter) { i.SetRetries(3) }, "retries", float64(3)},
+		{"claude timeout", func(i *Interpreter) { i.SetClaudeTimeout(90 * time.Second) }, "claude_timeout", "1m30s"},
+		{"default allow shell", nil, "allow_shell", true},
+		{"no shell", func(i *Interpreter) { i.SetAllowShell(false) }, "allow_shell", false},
+		{"unknown vars", func(i *Interpreter) { i.SetUnknownVars("blank") }, "unknown_vars", "blank"},
+		{"later setting wins", func(i *Interpreter) { i.SetModel("opus"); i.SetModel("haiku") }, "model", "haiku"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _ := newTestInterpreter()
+			if tt.opt != nil {
+				tt.opt(interp)
+			}
+			out, err := json.Marshal(interp.Config())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dump map[string]interface{}
+			if err := json.Unmarshal(out, &dump); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := dump[tt.key]; !ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %#v, want %#v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefine(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		doneOn    int // the call that replies DONE
+		wantCalls int
+		wantErr   string
+	}{
+		{"first attempt", `refine "fix it" until contains(response, "DONE") max 3`, 1, 1, ""},
+		{"eventually", `refine "fix it" until contains(response, "DONE") max 5`, 3, 3, ""},
+		{"default max", `refine "fix it" until contains(response, "DONE")`, 3, 3, ""},
+		{"out of attempts", `refine "fix it" until contains(response, "DONE") max 2`, 3, 2, "still false after 2 attempts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := filepath.Join(t.TempDir(), "calls")
+			claude := stubClaude(t, fmt.Sprintf("echo x >> %s\nn=$(wc -l < %s)\n[ $n -ge %d ] && echo DONE || echo working", calls, calls, tt.doneOn))
+			interp, _, err := runScript(t, tt.src, func(i *Interpreter) { i.SetClaudeCLI(claude) })
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			data, _ := os.ReadFile(calls)
+			if got := strings.Count(string(data), "\n"); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+			want := "DONE"
+			if tt.wantErr != "" {
+				want = "working"
+			}
+			if got := interp.variables["response"]; got != want {
+				t.Errorf("response = %q, want %q", got, want)
+			}
+		})
+	}
+
+	// A dry run previews a single attempt
+	interp, _, err := runScript(t, `refine "fix it" until contains(response, "DONE") max 3`, dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(interp.Steps()); got != 1 {
+		t.Errorf("dry run took %d steps, want 1", got)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		opts     []func(*Interpreter)
+		wantKind string // parse, exec or timeout
+		wantStep int    // index of the failed step, for exec errors
+		wantExit int
+	}{
+		{name: "parse", src: "x = 1\n}\n", wantKind: "parse", wantExit: exitParse},
+		{name: "exec", src: "shell \"true\"\nshell \"false\"\n", wantKind: "exec", wantStep: 2, wantExit: exitFailure},
+		{name: "failed ask", src: `ask "go"`, opts: []func(*Interpreter){func(i *Interpreter) { i.SetClaudeCLI("false") }}, wantKind: "exec", wantStep: 1, wantExit: exitFailure},
+		{name: "step timeout", src: `shell "sleep 5" timeout="50ms"`, wantKind: "timeout", wantStep: 1, wantExit: exitTimeout},
+		{name: "run deadline", src: `shell "sleep 5"`, opts: []func(*Interpreter){func(i *Interpreter) { i.SetDeadline(50 * time.Millisecond) }}, wantKind: "timeout", wantStep: 1, wantExit: exitTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := runScript(t, tt.src, tt.opts...)
+			if err == nil {
+				t.Fatal("run succeeded")
+			}
+			var parseErr *ParseError
+			var execErr *ExecError
+			var timeoutErr *TimeoutError
+			kinds := map[string]bool{
+				"parse":   errors.As(err, &parseErr),
+				"exec":    errors.As(err, &execErr) && !errors.As(err, &timeoutErr),
+				"timeout": errors.As(err, &timeoutErr),
+			}
+			for kind, matched := range kinds {
+				if matched != (kind == tt.wantKind) {
+					t.Errorf("errors.As(%v, %s) = %v", err, kind, matched)
+				}
+			}
+			if tt.wantStep > 0 && (execErr == nil || execErr.Step != tt.wantStep) {
+				t.Errorf("exec error = %+v, want step %d", execErr, tt.wantStep)
+			}
+			if got := exitCode(err); got != tt.wantExit {
+				t.Errorf("exitCode = %d, want %d", got, tt.wantExit)
+			}
+		})
+	}
+}
+
+func TestPromptHistory(t *testing.T) {
+	src := "n = 0\nrepeat 12 {\n  n += 1\n  ask \"step ${n}\"\n}\n"
+	tests := []struct {
+		name string
+		max  int
+		want []string // instructions kept after the run, oldest first
+	}{
+		{"off", 0, nil},
+		{"one", 1, []string{"step 12"}},
+		{"bounded", 3, []string{"step 10", "step 11", "step 12"}},
+		{"larger than the run", 20, []string{"step 1", "step 2", "step 3", "step 4", "step 5", "step 6", "step 7", "step 8", "step 9", "step 10", "step 11", "step 12"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last := filepath.Join(t.TempDir(), "prompt")
+			claude := stubClaude(t, `printf '%s\n' "$@" > `+last)
+			interp, _, err := runScript(t, src, func(i *Interpreter) {
+				i.SetClaudeCLI(claude)
+				i.SetMaxPromptHistory(tt.max)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, exchange := range interp.history {
+				got = append(got, exchange.Instruction)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("history = %q, want %q", got, tt.want)
+			}
+
+			// The last prompt lists the window before its own ask
+			data, err := os.ReadFile(last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listed := 0
+			for n := 1; strings.Contains(string(data), fmt.Sprintf("\n%d. step ", n)); n++ {
+				listed++
+			}
+			if want := min(tt.max, 11); listed != want {
+				t.Errorf("last prompt lists %d previous steps, want %d:\n%s", listed, want, data)
+			}
+		})
+	}
+}
+
+func TestUnknownVars(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		src     string
+		want    string // dumped instruction
+		wantErr string
+	}{
+		{"keep by default", "", `ask "build ${missing} now"`, "build ${missing} now", ""},
+		{"keep", "keep", `ask "build ${missing} now"`, "build ${missing} now", ""},
+		{"blank", "blank", `ask "build ${missing} now"`, "build  now", ""},
+		{"known names still interpolated", "blank", "name = \"app\"\nask \"build ${name}${missing}\"", "build app", ""},
+		{"escapes kept", "blank", `ask "use \${HOME}"`, "use ${HOME}", ""},
+		{"bad mode", "drop", "", "", "unknown --unknown-vars mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _ := newTestInterpreter(func(i *Interpreter) { i.SetDumpPrompts(true) })
+			err := interp.SetUnknownVars(tt.mode)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if err := interp.ExecuteString(tt.src); err != nil {
+				t.Fatal(err)
+			}
+			if prompts := interp.DumpedPrompts(); len(prompts) != 1 || prompts[0].Instruction != tt.want {
+				t.Errorf("prompts = %+v, want %q", prompts, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"and", "a = 1\nb = 2\nresult = a == 1 && b == 2", true},
+		{"and false", "a = 1\nb = 2\nresult = a == 1 && b == 3", false},
+		{"or", "a = 1\nresult = a == 5 || a == 1", true},
+		{"or false", "a = 1\nresult = a == 5 || a == 6", false},
+		{"and binds tighter than or", "result = 1 == 1 || 1 == 2 && 1 == 3", true},
+		{"single comparison", "a = 3\nresult = a > 2", true},
+		{"in an if", "result = \"no\"\ntest = True\ncount = 4\nif test == True && count > 3 {\n  result = \"yes\"\n}", "yes"},
+	})
+
+	// Both operators short-circuit, so the right side never runs
+	for _, src := range []string{
+		`result = 1 == 2 && shell "exit 1" succeeds`,
+		`result = 1 == 1 || shell "exit 1" succeeds`,
+	} {
+		interp, _, err := runScript(t, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if steps := interp.Steps(); len(steps) != 0 {
+			t.Errorf("%s: ran %d steps, want none", src, len(steps))
+		}
+	}
+}
+
+func TestConditionGrouping(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"grouped or", "a = 1\nb = 0\nc = 3\nresult = (a == 1 || b == 2) && c == 3", true},
+		{"grouped or false", "a = 0\nb = 0\nc = 3\nresult = (a == 1 || b == 2) && c == 3", false},
+		{"without grouping", "a = 1\nb = 0\nc = 4\nresult = a == 1 || b == 2 && c == 3", true},
+		{"with grouping", "a = 1\nb = 0\nc = 4\nresult = (a == 1 || b == 2) && c == 3", false},
+		{"nested", "result = ((1 == 1))", true},
+		{"in an if", "result = \"no\"\nif (1 == 2 || 2 == 2) && 3 == 3 {\n  result = \"yes\"\n}", "yes"},
+	})
+
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"if (x == 1 {\n}\n", "expected ')' to close '(' at line 1, column 4"},
+		{"if () {\n}\n", "empty parentheses"},
+		{"if x == 1) {\n}\n", "unexpected ')' without a matching '('"},
+	}
+	for _, tt := range tests {
+		if errs := parseErrors(tt.src); len(errs) == 0 || !strings.Contains(errs[0], tt.want) {
+			t.Errorf("parseErrors(%q) = %q, want %q", tt.src, errs, tt.want)
+		}
+	}
+}
+
+func TestStringConcatenation(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"strings", "module = \"auth\"\nresult = \"src/\" + module + \".go\"", "src/auth.go"},
+		{"string and number", `result = "a" + 1`, "a1"},
+		{"number and string", `result = 1 + "a"`, "1a"},
+		{"fraction", `result = "v" + 1.5`, "v1.5"},
+		{"boolean", `result = "ok: " + True`, "ok: true"},
+		{"numbers still add", `result = 1 + 2`, float64(3)},
+		{"left to right", `result = 1 + 2 + "x"`, "3x"},
+	})
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		max     int
+		want    interface{}
+		wantErr string
+	}{
+		{name: "counts up", src: "result = 0\nwhile result < 5 {\n  result++\n}", want: float64(5)},
+		{name: "false from the start", src: "result = 7\nwhile result < 5 {\n  result++\n}", want: float64(7)},
+		{name: "compound condition", src: "result = 0\ndone = False\nwhile result < 10 && !done {\n  result++\n  if result == 3 {\n    done = True\n  }\n}", want: float64(3)},
+		{name: "cap reached", src: "result = 0\nwhile True {\n  result++\n}", max: 4, want: float64(4), wantErr: "while: True still holds after 4 iterations"},
+		{name: "cap not reached", src: "result = 0\nwhile result < 4 {\n  result++\n}", max: 4, want: float64(4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src, func(i *Interpreter) {
+				if tt.max > 0 {
+					i.SetMaxIterations(tt.max)
+				}
+			})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got := interp.variables["result"]; got != tt.want {
+				t.Errorf("result = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A dry run previews the body once
+	interp, _, err := runScript(t, "n = 0\nwhile n < 3 {\n  shell \"echo ${n}\"\n  n++\n}", dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(interp.Steps()); got != 1 {
+		t.Errorf("dry run took %d steps, want 1", got)
+	}
+}
+
+func TestForeachLoops(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"over a variable", "tools = [\"tailwind\", \"jwt\"]\nresult = \"\"\nforeach tool in tools {\n  result = result + tool + \";\"\n}", "tailwind;jwt;"},
+		{"with an index", "result = \"\"\nforeach n, t in [\"a\", \"b\"] {\n  result = result + \"${n}${t}\"\n}", "0a1b"},
+		{"loop variable removed", "foreach tool in [\"a\"] {\n  x = 1\n}\nresult = \"${tool}\"", "${tool}"},
+	})
+
+	want := parse(t, "for t in tools {\n  ask \"integrate ${t}\"\n}\n").Statements
+	if got := parse(t, "foreach t in tools {\n  ask \"integrate ${t}\"\n}\n").Statements; !reflect.DeepEqual(got, want) {
+		t.Error("foreach parses differently from for")
+	}
+
+	// Every element gets its own interpolated step
+	interp, _, err := runScript(t, "tools = [\"vite\", \"jwt\"]\nforeach tool in tools {\n  ask \"integrate ${tool}\"\n}", dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stepDetails(interp); strings.Join(got, "|") != "integrate vite|integrate jwt" {
+		t.Errorf("steps = %q", got)
+	}
+}
+
+func TestBreakContinue(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"break in repeat", "result = 0\nrepeat 10 {\n  result++\n  if result == 3 {\n    break\n  }\n}", float64(3)},
+		{"continue in repeat", "n = 0\nresult = 0\nrepeat 5 {\n  n++\n  if n == 2 {\n    continue\n  }\n  result++\n}", float64(4)},
+		{"break in while", "result = 0\nwhile True {\n  result++\n  if result == 4 {\n    break\n  }\n}", float64(4)},
+		{"continue in for", "result = \"\"\nfor t in [\"a\", \"b\", \"c\"] {\n  if t == \"b\" {\n    continue\n  }\n  result = result + t\n}", "ac"},
+		{"break leaves the inner loop only", "result = 0\nrepeat 2 {\n  repeat 5 {\n    result++\n    break\n  }\n}", float64(2)},
+		{"break inside a group", "result = 0\nrepeat 5 {\n  group \"g\" {\n    result++\n    break\n  }\n}", float64(1)},
+	})
+
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"break\n", "break used outside a loop"},
+		{"continue\n", "continue used outside a loop"},
+		{"if True {\n  break\n}\n", "break used outside a loop"},
+	}
+	for _, tt := range tests {
+		if _, _, err := runScript(t, tt.src); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: err = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+
+	// after each still runs for an iteration that breaks
+	interp, _, err := runScript(t, "repeat 3 {\n  after each {\n    shell \"echo after\"\n  }\n  break\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stepDetails(interp); strings.Join(got, "|") != "echo after" {
+		t.Errorf("steps = %q, want one after each", got)
+	}
+}
+
+func TestDefineUse(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		wantSteps []string
+		wantErr   string
+	}{
+		{"use", "define lint {\n  shell \"echo lint\"\n}\nuse lint", []string{"echo lint"}, ""},
+		{"bare name", "define lint {\n  shell \"echo lint\"\n}\nlint\nlint", []string{"echo lint", "echo lint"}, ""},
+		{"current variables", "define greet {\n  shell \"echo ${who}\"\n}\nwho = \"a\"\ngreet\nwho = \"b\"\ngreet", []string{"echo 'a'", "echo 'b'"}, ""},
+		{"keyword as a name", "define setup {\n  shell \"echo s\"\n}\nuse setup", []string{"echo s"}, ""},
+		{"assignment to a defined name", "define lint {\n  shell \"echo lint\"\n}\nlint = 1", nil, ""},
+		{"self recursion", "define a {\n  use a\n}\nuse a", nil, `setup "a" invokes itself`},
+		{"mutual recursion", "define a {\n  use b\n}\ndefine b {\n  use a\n}\nuse a", nil, "invokes itself"},
+		{"undefined", "use missing", nil, "undefined setup: missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if got := stepDetails(interp); strings.Join(got, "|") != strings.Join(tt.wantSteps, "|") {
+				t.Errorf("steps = %q, want %q", got, tt.wantSteps)
+			}
+		})
+	}
+
+	if errs := parseErrors("define {\n}\n"); len(errs) == 0 || !strings.Contains(errs[0], "expected setup name after 'define'") {
+		t.Errorf("errors = %q", errs)
+	}
+}
+
+func TestCompoundAssignment(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    interface{}
+		wantErr string
+	}{
+		{name: "add", src: "result = 1\nresult += 5", want: float64(6)},
+		{name: "subtract", src: "result = 10\nresult -= 2", want: float64(8)},
+		{name: "multiply", src: "result = 3\nresult *= 4", want: float64(12)},
+		{name: "divide", src: "result = 9\nresult /= 2", want: 4.5},
+		{name: "expression operand", src: "n = 2\nresult = 1\nresult += n + 1", want: float64(4)},
+		{name: "in a loop", src: "result = 0\nrepeat 3 {\n  result += 2\n}", want: float64(6)},
+		{name: "string target", src: "result = \"a\"\nresult += 1", want: "a", wantErr: "not a number"},
+		{name: "string operand", src: "result = 1\nresult -= \"x\"", want: float64(1), wantErr: "not a number"},
+		{name: "undefined target", src: "missing += 1", wantErr: "missing"},
+		{name: "division by zero", src: "result = 1\nresult /= 0", want: float64(1), wantErr: "division by zero"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got := interp.variables["result"]; got != tt.want {
+				t.Errorf("result = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListIndexing(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    interface{}
+		wantErr string
+	}{
+		{name: "first", src: "tools = [\"a\", \"b\", \"c\"]\nresult = tools[0]", want: "a"},
+		{name: "last", src: "tools = [\"a\", \"b\", \"c\"]\nresult = tools[2]", want: "c"},
+		{name: "expression index", src: "tools = [\"a\", \"b\"]\nn = 0\nresult = tools[n + 1]", want: "b"},
+		{name: "nested", src: "m = [[1, 2], [3, 4]]\nresult = m[1][0]", want: float64(3)},
+		{name: "in a condition", src: "tools = [\"a\", \"b\"]\nresult = tools[1] == \"b\"", want: true},
+		{name: "in interpolation", src: "tools = [\"a\", \"b\"]\nresult = \"second: ${tools[1]}\"", want: "second: b"},
+		{name: "len", src: "result = len([\"a\", \"b\", \"c\"])", want: float64(3)},
+		{name: "len of a string", src: "result = len(\"abcd\")", want: float64(4)},
+		{name: "len of an empty list", src: "result = len([])", want: float64(0)},
+		{name: "out of range", src: "tools = [\"a\", \"b\"]\nresult = tools[2]", wantErr: "index 2 out of range for tools (length 2)"},
+		{name: "negative", src: "tools = [\"a\"]\nn = 0\nn -= 1\nresult = tools[n]", wantErr: "index -1 out of range for tools (length 1)"},
+		{name: "fractional", src: "tools = [\"a\"]\nresult = tools[0.5]", wantErr: "index"},
+		{name: "not a list", src: "s = 5\nresult = s[0]", wantErr: "cannot index"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got := interp.variables["result"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruthiness(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"true", "enabled = True\nresult = enabled ? \"on\" : \"off\"", "on"},
+		{"false", "enabled = False\nresult = enabled ? \"on\" : \"off\"", "off"},
+		{"zero", "n = 0\nresult = n ? \"on\" : \"off\"", "off"},
+		{"non-zero", "n = 2\nresult = n ? \"on\" : \"off\"", "on"},
+		{"empty string", "s = \"\"\nresult = s ? \"on\" : \"off\"", "off"},
+		{"string", "s = \"x\"\nresult = s ? \"on\" : \"off\"", "on"},
+		{"empty list", "l = []\nresult = l ? \"on\" : \"off\"", "off"},
+		{"list", "l = [1]\nresult = l ? \"on\" : \"off\"", "on"},
+		{"undefined name", "result = \"off\"\nif deploy {\n  result = \"on\"\n}", "off"},
+		{"negated undefined name", "result = \"off\"\nif !deploy {\n  result = \"on\"\n}", "on"},
+		{"undefined name in &&", "result = \"off\"\nif True && deploy {\n  result = \"on\"\n}", "off"},
+		{"name defined later", "result = \"off\"\ndeploy = True\nif deploy {\n  result = \"on\"\n}", "on"},
+		{"bare words still compare as strings", "framework = \"react\"\nresult = framework == react", true},
+	})
+}
+
+func TestNegation(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"bare value", "test = False\nresult = !test", true},
+		{"double", "test = True\nresult = !!test", true},
+		{"comparison", "a = 1\nb = 2\nresult = !(a == b)", true},
+		{"binds tighter than &&", "a = False\nb = True\nresult = !a && b", true},
+		{"in an if", "test = False\nresult = \"no\"\nif !test {\n  result = \"yes\"\n}", "yes"},
+		{"not equal still works", "result = 1 != 2", true},
+	})
+
+	for _, src := range []string{"x = 1 !\n", "if ! {\n}\n"} {
+		if errs := parseErrors(src); len(errs) == 0 {
+			t.Errorf("%q parsed without errors", src)
+		}
+	}
+}
+
+func TestMCPPositionalArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want map[string]string // file contents afterwards; "" for a missing file
+	}{
+		{"copy", `fs.copy "a.txt" "b.txt"`, map[string]string{"a.txt": "hello", "b.txt": "hello"}},
+		{"copy with a comma", `fs.copy "a.txt", "b.txt"`, map[string]string{"a.txt": "hello", "b.txt": "hello"}},
+		{"move", `fs.move "a.txt" "sub/c.txt"`, map[string]string{"a.txt": "", "sub/c.txt": "hello"}},
+		{"interpolated", "from = \"a.txt\"\nto = \"d.txt\"\nfs.copy \"${from}\" \"${to}\"", map[string]string{"d.txt": "hello"}},
+		{"single argument", `fs.mkdir "sub"`, map[string]string{"a.txt": "hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := runScript(t, tt.src, func(i *Interpreter) { i.SetWorkDir(dir) }); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				data, err := os.ReadFile(filepath.Join(dir, name))
+				if want == "" && err == nil || want != "" && string(data) != want {
+					t.Errorf("%s = %q (%v), want %q", name, data, err, want)
+				}
+			}
+		})
+	}
+
+	if got := statements(t, "fs.copy \"a\", \"b\"\n"); got[0] != `fs.copy "a" "b"` {
+		t.Errorf("statement = %q", got[0])
+	}
+}
+
+func TestMCPNamedArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    string // contents of app.go
+		wantErr string
+	}{
+		{"strings", `fs.write path="app.go" content="package main"`, "package main", ""},
+		{"variable value", "src = \"package app\"\nfs.write path=\"app.go\" content=src", "package app", ""},
+		{"interpolated value", "pkg = \"app\"\nfs.write path=\"app.go\" content=\"package ${pkg}\"", "package app", ""},
+		{"any order", `fs.write content="x" path="app.go"`, "x", ""},
+		{"append", "fs.write path=\"app.go\" content=\"a\"\nfs.append path=\"app.go\" content=\"b\"", "ab", ""},
+		{"missing required", `fs.write content="x"`, "", "fs.write requires 'path'"},
+		{"unknown name", `fs.write path="app.go" content="x" mode="644"`, "", "fs.write does not take mode="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, _, err := runScript(t, tt.src, func(i *Interpreter) { i.SetWorkDir(dir) })
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			data, _ := os.ReadFile(filepath.Join(dir, "app.go"))
+			if string(data) != tt.want {
+				t.Errorf("app.go = %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepeatCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    interface{}
+		wantErr string
+	}{
+		{name: "literal", src: "result = 0\nrepeat 3 {\n  result++\n}", want: float64(3)},
+		{name: "variable", src: "iterations = 4\nresult = 0\nrepeat iterations {\n  result++\n}", want: float64(4)},
+		{name: "expression", src: "n = 2\nresult = 0\nrepeat n + 3 {\n  result++\n}", want: float64(5)},
+		{name: "len", src: "tools = [1, 2]\nresult = 0\nrepeat len(tools) {\n  result++\n}", want: float64(2)},
+		{name: "zero", src: "result = 0\nrepeat 0 {\n  result++\n}", want: float64(0)},
+		{name: "evaluated once", src: "n = 2\nresult = 0\nrepeat n {\n  n++\n  result++\n}", want: float64(2)},
+		{name: "negative", src: "n = 0\nn -= 1\nresult = 0\nrepeat n {\n  result++\n}", want: float64(0)},
+		{name: "not a number", src: "n = \"three\"\nresult = 0\nrepeat n {\n  result++\n}", want: float64(0), wantErr: "repeat: count n is not a number (three)"},
+		{name: "numeric string", src: "n = \"2\"\nresult = 0\nrepeat n {\n  result++\n}", want: float64(2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got := interp.variables["result"]; got != tt.want {
+				t.Errorf("result = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A negative count skips the loop with a warning
+	_, out, err := runScript(t, "n = 0\nn -= 2\nrepeat n {\n  x = 1\n}", func(i *Interpreter) { i.SetVerbose(true) })
+	if err != nil || !strings.Contains(out, "repeat count n is negative (-2)") {
+		t.Errorf("err = %v, output:\n%s", err, out)
+	}
+}
+
+func TestAskOutputTrimmedAndEchoed(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		verbose bool
+		want    string
+	}{
+		{"trailing newlines", `printf 'the reply\n\n'`, false, "the reply"},
+		{"trailing spaces", `printf 'the reply  \t'`, false, "the reply"},
+		{"leading space kept", `printf '  the reply\n'`, false, "  the reply"},
+		{"inner lines kept", `printf 'the\nreply\n'`, false, "the\nreply"},
+		{"echoed when verbose", `printf 'the reply\n'`, true, "the reply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claude := stubClaude(t, tt.output)
+			interp, out, err := runScript(t, `answer = ask "summarize the plan"`, func(i *Interpreter) {
+				i.SetClaudeCLI(claude)
+				i.SetVerbose(tt.verbose)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := interp.variables["answer"]; got != tt.want {
+				t.Errorf("answer = %q, want %q", got, tt.want)
+			}
+			if echoed := strings.Contains(out, tt.want+"\n"); echoed != tt.verbose {
+				t.Errorf("reply echoed = %v, want %v:\n%s", echoed, tt.verbose, out)
+			}
+		})
+	}
+}
+
+func TestShellCapture(t *testing.T) {
+	const both = "printf 'out1 '; printf 'err ' >&2; printf 'out2\\n\\n'"
+	tests := []struct {
+		name       string
+		src        string
+		combine    bool
+		want       string
+		wantRecord []string // parts of the step output; stdout and stderr may interleave
+	}{
+		{"stdout", `branch = shell "printf 'main\n'"`, false, "main", nil},
+		{"trimmed", `branch = shell "printf 'main  \n\n'"`, false, "main", nil},
+		{"stderr not captured", `branch = shell "` + both + `"`, false, "out1 out2", nil},
+		{"stderr not captured when combined", `branch = shell "` + both + `"`, true, "out1 out2", []string{"out1 ", "err ", "out2"}},
+		{"in a comparison", "result = shell \"printf yes\" == \"yes\"\nbranch = \"${result}\"", false, "true", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src, func(i *Interpreter) { i.SetCombineOutput(tt.combine) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := interp.variables["branch"]; got != tt.want {
+				t.Errorf("branch = %q, want %q", got, tt.want)
+			}
+			got := interp.Steps()[0].Output
+			if tt.wantRecord == nil && got != "" {
+				t.Errorf("step output = %q, want none", got)
+			}
+			for _, part := range tt.wantRecord {
+				if !strings.Contains(got, part) {
+					t.Errorf("step output = %q, want it to contain %q", got, part)
+				}
+			}
+		})
+	}
+
+	// Without an assignment the output is streamed
+	_, out, err := runScript(t, `shell "printf streamed"`)
+	if err != nil || !strings.Contains(out, "streamed") {
+		t.Errorf("err = %v, output:\n%s", err, out)
+	}
+
+	// A bare shell command is not a condition; succeeds is
+	for _, src := range []string{
+		"if shell \"test -f go.mod\" {\n}\n",
+		"if !shell \"test -f go.mod\" {\n}\n",
+		"if True && shell \"test -f go.mod\" {\n}\n",
+		"x = shell \"test -f go.mod\" ? 1 : 2\n",
+		"while shell \"test -f go.mod\" {\n}\n",
+	} {
+		if errs := parseErrors(src); len(errs) != 1 || !strings.Contains(errs[0], `use shell "test -f go.mod" succeeds`) {
+			t.Errorf("parseErrors(%q) = %q", src, errs)
+		}
+	}
+	for _, src := range []string{
+		"if shell \"test -f go.mod\" succeeds {\n}\n",
+		"if shell \"cat v\" == \"1\" {\n}\n",
+		"x = shell \"pwd\"\n",
+	} {
+		if errs := parseErrors(src); len(errs) != 0 {
+			t.Errorf("parseErrors(%q) = %q", src, errs)
+		}
+	}
+}
+
+func TestLastExit(t *testing.T) {
+	continueOnError := func(i *Interpreter) { i.SetContinueOnError(true) }
+	decline := func(i *Interpreter) {
+		i.SetInteractiveApprove(true)
+		i.SetApproveInput(strings.NewReader("n\n"), true)
+	}
+	tests := []struct {
+		name    string
+		src     string
+		opts    []func(*Interpreter)
+		want    float64
+		wantErr string
+	}{
+		{"success", `shell "true"`, nil, 0, ""},
+		{"failure continues", `shell "exit 3"`, []func(*Interpreter){continueOnError}, 3, ""},
+		{"failure stops the run", "shell \"exit 3\"\nshell \"true\"", nil, 3, "exit status 3"},
+		{"latest command wins", "shell \"exit 3\"\nshell \"true\"", []func(*Interpreter){continueOnError}, 0, ""},
+		{"shell.run", `shell.run "exit 4"`, []func(*Interpreter){continueOnError}, 4, ""},
+		{"declined", `shell "true"`, []func(*Interpreter){decline}, -1, ""},
+		{"declined shell.run", `shell.run "true"`, []func(*Interpreter){decline}, -1, ""},
+		{"dry run", `shell "exit 3"`, []func(*Interpreter){dryRun}, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _, err := runScript(t, tt.src, tt.opts...)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got := interp.variables["last_exit"]; got != tt.want {
+				t.Errorf("last_exit = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// $? is last_exit, so the help example branches on a failure
+	interp, _, err := runScript(t, "shell \"exit 1\"\nif $? != 0 {\n  fixed = True\n}\n", continueOnError)
+	if err != nil || interp.variables["fixed"] != true {
+		t.Errorf("err = %v, fixed = %v", err, interp.variables["fixed"])
+	}
+}
+
+func TestSequentialAssignment(t *testing.T) {
+	runValueTests(t, []valueTest{
+		{"reassigned", "count = 1\ncount = count + 1\nresult = count", float64(2)},
+		{"read before reassignment", "x = 1\nresult = x\nx = 5", float64(1)},
+		{"in a loop", "result = 0\nrepeat 3 {\n  result = result + 2\n}", float64(6)},
+		{"in an untaken branch", "result = 1\nif result == 2 {\n  result = 3\n}", float64(1)},
+		{"in a taken branch", "result = 1\nif result == 1 {\n  result = 3\n}", float64(3)},
+	})
+
+	got := dumpPrompts(t, "step = \"one\"\nask \"do ${step}\"\nstep = \"two\"\nask \"do ${step}\"\n")
+	if want := []string{"do one", "do two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("prompts = %q, want %q", got, want)
+	}
+}
+
+// promptOf runs src with --dump-prompts and returns the prompt of its last ask.
+func promptOf(t *testing.T, src string, opts ...func(*Interpreter)) string {
+	t.Helper()
+	opts = append(opts, func(i *Interpreter) { i.SetDumpPrompts(true) })
+	interp, _, err := runScript(t, src, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts := interp.DumpedPrompts()
+	if len(prompts) == 0 {
+		t.Fatal("no prompt was dumped")
+	}
+	return prompts[len(prompts)-1].Prompt
+}
+
+func TestPromptContext(t *testing.T) {
+	prompt := promptOf(t, `zeta = "last"
+style_guide = "docs/style.md"
+project = "shop"
+api_spec = ["openapi.yaml", "auth.yaml"]
+db = "postgres"
+task = "checkout"
+deploy_token = "abc123"
+model = "haiku"
+ask "go"
+`)
+	want := `Project Name: shop
+Database: postgres
+api_spec: openapi.yaml, auth.yaml
+deploy_token: ***
+style_guide: docs/style.md
+zeta: last
+
+Main Task: checkout
+`
+	if !strings.Contains(prompt, want) {
+		t.Errorf("prompt:\n%s\nwant it to contain:\n%s", prompt, want)
+	}
+	for _, hidden := range []string{"abc123", "haiku", "task:"} {
+		if strings.Contains(prompt, hidden) {
+			t.Errorf("prompt contains %q:\n%s", hidden, prompt)
+		}
+	}
+}
+
+func TestPromptTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		vars    map[string]interface{}
+		want    string
+		wantErr string
+	}{
+		{"formatted", "{{project}}: {{instruction}} with {{tools}}", map[string]interface{}{"project": "shop", "tools": []interface{}{"vite", "jwt"}}, "shop: add login with vite, jwt", ""},
+		{"raw value", "{{range .tools}}[{{.}}]{{end}}", map[string]interface{}{"tools": []interface{}{"vite", "jwt"}}, "[vite][jwt]", ""},
+		{"name that is not an identifier", `{{index . "api-spec"}}`, map[string]interface{}{"api-spec": "openapi.yaml"}, "openapi.yaml", ""},
+		{"builtins are not overridden", `{{len .tools}} {{print "x"}} {{and 1 2}} {{.len}}`, map[string]interface{}{"tools": []interface{}{"a", "b"}, "len": "long", "print": "p", "and": "&"}, "2 x 2 long", ""},
+		{"instruction wins", "{{instruction}} {{.instruction}}", map[string]interface{}{"instruction": "mine"}, "add login add login", ""},
+		{"unknown name", "{{nope}}", nil, "", `function "nope" not defined`},
+		{"missing key", "{{.nope}}", nil, "", `map has no entry for key "nope"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := map[string]interface{}{"prompt_template": tt.tmpl}
+			for name, val := range tt.vars {
+				vars[name] = val
+			}
+			got, err := NewInterpreter().buildPrompt("add login", vars)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Without a template the built-in layout is used
+	if prompt := promptOf(t, "project = \"shop\"\nask \"go\""); !strings.HasPrefix(prompt, "You are building a project") {
+		t.Errorf("prompt:\n%s", prompt)
+	}
+	if prompt := promptOf(t, "prompt_template = \"{{project}} / {{instruction}}\"\nproject = \"shop\"\nask \"go\""); prompt != "shop / go" {
+		t.Errorf("prompt = %q", prompt)
+	}
+
+	// The history window and the --full-context document are in the data
+	interp := NewInterpreter()
+	interp.SetFullContext(true)
+	interp.history = []promptExchange{{Instruction: "scaffold", Response: "created src/\n"}, {Instruction: "add tests"}}
+	vars := map[string]interface{}{
+		"prompt_template": "{{history}}{{range .history}}[{{.instruction}}]{{end}}\n{{full_context}}",
+		"project":         "shop",
+		"api_key":         "sk-123",
+	}
+	got, err := interp.buildPrompt("go", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1. scaffold\n   Result: created src/\n2. add tests\n[scaffold][add tests]\n{\n  \"api_key\": \"***\",\n  \"project\": \"shop\"\n}"
+	if got != want {
+		t.Errorf("prompt = %q, want %q", got, want)
+	}
+	interp.SetFullContext(false)
+	if got, err := interp.buildPrompt("go", map[string]interface{}{"prompt_template": "<{{full_context}}>"}); err != nil || got != "<>" {
+		t.Errorf("prompt = %q, %v; want <>", got, err)
+	}
+}
+
+func TestClaudeFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		cli       string // stub body; empty for a CLI that does not exist
+		continues bool
+		wantErr   string
+	}{
+		{"stderr reported", "echo 'invalid API key' >&2\nexit 2", false, "Claude Code CLI failed: exit status 2: invalid API key"},
+		{"no stderr", "exit 1", false, "Claude Code CLI not available or failed: exit status 1"},
+		{"missing CLI", "", false, "Claude Code CLI not available or failed"},
+		{"continue on error", "exit 1", true, ""},
+		{"success", "echo done", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := filepath.Join(t.TempDir(), "no-such-claude")
+			if tt.cli != "" {
+				cli = stubClaude(t, tt.cli)
+			}
+			interp, _, err := runScript(t, "ask \"build it\"\nafter_ask = True", func(i *Interpreter) {
+				i.SetClaudeCLI(cli)
+				i.SetContinueOnError(tt.continues)
+			})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if ran := interp.variables["after_ask"] == true; ran != (tt.wantErr == "") {
+				t.Errorf("statement after the ask ran = %v", ran)
+			}
+		})
+	}
+}
+
+func TestWorkDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    string // --workdir, relative to the test directory
+		src     string
+		want    string // directory holding made.txt, relative to the test directory
+		wantErr string
+	}{
+		{"flag", "out", `shell "touch made.txt"`, "out", ""},
+		{"variable", "", "workdir = \"out/shop\"\nshell \"touch made.txt\"", "out/shop", ""},
+		{"flag overrides the variable", "flagged", "workdir = \"out\"\nshell \"touch made.txt\"", "flagged", ""},
+		{"fs paths", "out", `fs.write path="made.txt" content="x"`, "out", ""},
+		{"shell.run", "out", `shell.run "touch made.txt"`, "out", ""},
+		{"absolute paths are kept", "out", `fs.write path="${root}/made.txt" content="x"`, "", ""},
+		{"not a directory", "file", `shell "touch made.txt"`, "", "workdir file is not a directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			chdir(t, root)
+			if err := os.WriteFile("file", nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			src := "root = \"" + filepath.ToSlash(root) + "\"\n" + tt.src
+			_, _, err := runScript(t, src, func(i *Interpreter) { i.SetWorkDir(tt.flag) })
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			if _, err := os.Stat(filepath.Join(root, tt.want, "made.txt")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	// Dry runs do not create the directory
+	chdir(t, t.TempDir())
+	if _, _, err := runScript(t, `shell "touch made.txt"`, dryRun, func(i *Interpreter) { i.SetWorkDir("out") }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("out"); err == nil {
+		t.Error("dry run created the workdir")
+	}
+}
+
+func TestShellTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh and background processes")
+	}
+	tests := []struct {
+		name      string
+		global    time.Duration
+		src       string
+		wantLimit time.Duration // 0 for success
+	}{
+		{"global limit", 100 * time.Millisecond, `shell "sleep 5"`, 100 * time.Millisecond},
+		{"shell.run", 100 * time.Millisecond, `shell.run "sleep 5"`, 100 * time.Millisecond},
+		{"captured", 100 * time.Millisecond, `x = shell "sleep 5"`, 100 * time.Millisecond},
+		{"step overrides a shorter limit", 50 * time.Millisecond, `shell "sleep 0.3" timeout="1m"`, 0},
+		{"step overrides a longer limit", time.Minute, `shell "sleep 5" timeout="100ms"`, 100 * time.Millisecond},
+		{"no limit", 0, `shell "sleep 0.2"`, 0},
+		{"process group killed", 100 * time.Millisecond, `x = shell "sleep 5 & sleep 5; wait"`, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			_, _, err := runScript(t, tt.src, func(i *Interpreter) { i.SetShellTimeout(tt.global) })
+			elapsed := time.Since(start)
+			if tt.wantLimit == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var timeoutErr *TimeoutError
+			if !errors.As(err, &timeoutErr) || timeoutErr.Limit != tt.wantLimit {
+				t.Fatalf("error = %v, want a timeout after %s", err, tt.wantLimit)
+			}
+			if want := "timed out after " + tt.wantLimit.String(); !strings.Contains(err.Error(), want) {
+				t.Errorf("error = %q, want it to contain %q", err, want)
+			}
+			if elapsed > 3*time.Second {
+				t.Errorf("step ran for %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestClaudeTimeout(t *testing.T) {
+	slowClaude := stubClaude(t, "sleep 5")
+	tests := []struct {
+		name      string
+		limit     time.Duration
+		src       string
+		continues bool
+		wantLimit time.Duration // 0 for success
+	}{
+		{"global limit", 100 * time.Millisecond, `ask "build it"`, false, 100 * time.Millisecond},
+		{"captured", 100 * time.Millisecond, `x = ask "build it"`, false, 100 * time.Millisecond},
+		{"step overrides it", time.Minute, `ask "build it" timeout="100ms"`, false, 100 * time.Millisecond},
+		{"continue on error", 100 * time.Millisecond, `ask "build it"`, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			_, out, err := runScript(t, tt.src, func(i *Interpreter) {
+				i.SetClaudeCLI(slowClaude)
+				i.SetClaudeTimeout(tt.limit)
+				i.SetContinueOnError(tt.continues)
+			})
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("step ran for %s", elapsed)
+			}
+			if tt.wantLimit == 0 {
+				if err != nil || !strings.Contains(out, "Claude Code CLI timed out after") {
+					t.Errorf("err = %v, output:\n%s", err, out)
+				}
+				return
+			}
+			var timeoutErr *TimeoutError
+			if !errors.As(err, &timeoutErr) || timeoutErr.Limit != tt.wantLimit || timeoutErr.Step != "Claude Code CLI" {
+				t.Fatalf("error = %v, want a Claude timeout after %s", err, tt.wantLimit)
+			}
+		})
+	}
+
+	if interp := NewInterpreter(); interp.claudeTimeout != 10*time.Minute {
+		t.Errorf("default Claude timeout = %s, want 10m", interp.claudeTimeout)
+	}
+}
+
+func TestShellRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	fastRetries(t)
+	// fails on the first n-1 runs, counting them in the file tries
+	flaky := func(n int) string {
+		return fmt.Sprintf(`echo x >> tries; [ $(wc -l < tries) -ge %d ]`, n)
+	}
+	tests := []struct {
+		name      string
+		src       string
+		retries   int
+		wantTries int
+		wantErr   string
+	}{
+		{"succeeds on a retry", `shell "` + flaky(3) + `"`, 2, 3, ""},
+		{"out of retries", `shell "` + flaky(4) + `"`, 2, 3, "exit status 1"},
+		{"retries= overrides", `shell "` + flaky(3) + `" retries=5`, 0, 3, ""},
+		{"no retries", `shell "` + flaky(2) + `"`, 0, 1, "exit status 1"},
+		{"succeeds is not retried", "if shell \"" + flaky(2) + "\" succeeds {\n}", 3, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdir(t, t.TempDir())
+			_, out, err := runScript(t, tt.src, func(i *Interpreter) { i.SetRetries(tt.retries) })
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			data, _ := os.ReadFile("tries")
+			if got := strings.Count(string(data), "\n"); got != tt.wantTries {
+				t.Errorf("ran %d times, want %d", got, tt.wantTries)
+			}
+			if tt.wantTries > 1 && !strings.Contains(out, "(attempt 2 of") {
+				t.Errorf("retries were not logged:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("VIBE_TEST_DIR", "/srv/app")
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"plain/path", "plain/path", ""},
+		{"$VIBE_TEST_DIR/config", "/srv/app/config", ""},
+		{"$VIBE_TEST_DIR$VIBE_TEST_DIR", "/srv/app/srv/app", ""},
+		{"costs $$5", "costs $5", ""},
+		{"trailing $", "trailing $", ""},
+		{"not a name $1", "not a name $1", ""},
+		{"${VIBE_TEST_DIR}", "${VIBE_TEST_DIR}", ""},
+		{"$VIBE_TEST_UNSET/x", "", "environment variable VIBE_TEST_UNSET is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := expandEnvVars(tt.in)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expandEnvVars(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	// Expansion of fs paths is opt-in
+	dir := t.TempDir()
+	t.Setenv("VIBE_TEST_DIR", "env")
+	src := `fs.mkdir "$VIBE_TEST_DIR"`
+	if _, _, err := runScript(t, src, func(i *Interpreter) { i.SetWorkDir(dir) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "$VIBE_TEST_DIR")); err != nil {
+		t.Errorf("without --expand-env the path was not taken literally: %v", err)
+	}
+	expand := func(i *Interpreter) {
+		i.SetWorkDir(dir)
+		i.SetExpandEnv(true)
+	}
+	if _, _, err := runScript(t, src, expand); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "env")); err != nil {
+		t.Errorf("with --expand-env the path was not expanded: %v", err)
+	}
+	if _, _, err := runScript(t, `fs.mkdir "$VIBE_TEST_UNSET/x"`, expand); err == nil || !strings.Contains(err.Error(), "VIBE_TEST_UNSET is not set") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	var events bytes.Buffer
+	interp, out, err := runScript(t, `deploy_token = "s3cr3t-value"
+shell "echo using s3cr3t-value"
+shell.run "echo run with s3cr3t-value"
+shell "echo s3cr3t-value; exit 3"
+`, func(i *Interpreter) {
+		i.SetEventStream(&events)
+		i.SetCombineOutput(true)
+		i.SetContinueOnError(true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var junit bytes.Buffer
+	if err := writeJUnitReport(&junit, "secrets", interp.Steps()); err != nil {
+		t.Fatal(err)
+	}
+	var records strings.Builder
+	for _, step := range interp.Steps() {
+		fmt.Fprintf(&records, "%s\n%s\n%s\n", step.Detail, step.Err, step.Output)
+	}
+	for name, text := range map[string]string{"output": out, "events": events.String(), "junit": junit.String(), "step records": records.String()} {
+		if strings.Contains(text, "s3cr3t") {
+			t.Errorf("%s contain the secret:\n%s", name, text)
+		}
+	}
+	if !strings.Contains(out, "using ***") || !strings.Contains(records.String(), "run with ***") {
+		t.Errorf("output:\n%s\nrecords:\n%s", out, records.String())
+	}
+
+	// and in --dry-run-fs diffs
+	dir := t.TempDir()
+	_, out, err = runScript(t, "api_key = \"sk-SECRET123\"\nfs.write path=\"cfg\" content=\"token=${api_key}\"", func(i *Interpreter) {
+		i.SetWorkDir(dir)
+		i.SetDryRunFS(true)
+	})
+	if err != nil || strings.Contains(out, "SECRET") || !strings.Contains(out, "+token=***") {
+		t.Errorf("err = %v, diff output:\n%s", err, out)
+	}
+
+	// A secret split across writes is still masked
+	var shown bytes.Buffer
+	w := &redactingWriter{r: strings.NewReplacer("s3cr3t-value", "***"), w: &shown}
+	for _, part := range []string{"token s3cr", "3t-val", "ue ok\nnext s3cr3t", "-value"} {
+		w.Write([]byte(part))
+	}
+	w.Flush()
+	if got := shown.String(); got != "token *** ok\nnext ***" {
+		t.Errorf("streamed %q", got)
+	}
+
+	// The replacer is rebuilt only when the secrets change
+	first := interp.secretReplacer()
+	if interp.secretReplacer() != first {
+		t.Error("replacer rebuilt for the same secrets")
+	}
+	interp.variables["api_key"] = "another-secret"
+	if interp.secretReplacer() == first || interp.redactSecrets("another-secret") != "***" {
+		t.Error("replacer not rebuilt for a new secret")
+	}
+}
+
+func TestDryRunPreview(t *testing.T) {
+	long := strings.Repeat("refactor the checkout flow ", 10)
+	tests := []struct {
+		name     string
+		src      string
+		truncate int
+		want     []string
+		notWant  []string
+	}{
+		{"full prompt", "project = \"shop\"\nask \"" + long + "\"", 0,
+			[]string{"  Prompt:\n", "    Project Name: shop\n", "    Current Step: " + long, "    Please implement this step."}, nil},
+		{"truncated prompt", "ask \"" + long + "\"", 20,
+			[]string{"  Prompt: You are building ...\n"}, []string{"Current Step"}},
+		{"full shell command", `shell "echo ` + long + `"`, 20,
+			[]string{"Would execute: echo " + long}, nil},
+		{"full MCP argument", `fs.mkdir "` + long + `"`, 0,
+			[]string{"Would call MCP: fs.mkdir(" + long + ")"}, nil},
+		{"truncated MCP arguments", `fs.write path="` + long + `" content="x"`, 20,
+			[]string{"Would call MCP: fs.write(content=x, path=refactor the chec...)"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, out, err := runScript(t, tt.src, dryRun, func(i *Interpreter) { i.SetDryRunTruncate(tt.truncate) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output does not contain %q:\n%s", want, out)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(out, notWant) {
+					t.Errorf("output contains %q:\n%s", notWant, out)
+				}
+			}
+		})
+	}
+}
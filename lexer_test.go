@@ -0,0 +1,178 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lex returns the tokens of src up to, not including, the end of file.
+func lex(src string) []Token {
+	l := NewLexer(src)
+	var tokens []Token
+	for tok := l.NextToken(); tok.Type != TOKEN_EOF; tok = l.NextToken() {
+		tokens = append(tokens, tok)
+	}
+	return tokens
+}
+
+// tokenTypes returns the types of the tokens of src.
+func tokenTypes(src string) []TokenType {
+	var types []TokenType
+	for _, tok := range lex(src) {
+		types = append(types, tok.Type)
+	}
+	return types
+}
+
+func TestLexerKeywords(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []TokenType
+	}{
+		{"if else repeat ask", []TokenType{TOKEN_IF, TOKEN_ELSE, TOKEN_REPEAT, TOKEN_ASK}},
+		{"before after shell", []TokenType{TOKEN_BEFORE, TOKEN_AFTER, TOKEN_SHELL}},
+		{"True False true false", []TokenType{TOKEN_BOOLEAN, TOKEN_BOOLEAN, TOKEN_BOOLEAN, TOKEN_BOOLEAN}},
+		{"TRUE truthy", []TokenType{TOKEN_IDENTIFIER, TOKEN_IDENTIFIER}},
+		// Contextual keywords are identifiers until the parser says otherwise
+		{"prompt for in run", []TokenType{TOKEN_IDENTIFIER, TOKEN_IDENTIFIER, TOKEN_IDENTIFIER, TOKEN_IDENTIFIER}},
+		{"setup define use require refine", []TokenType{TOKEN_IDENTIFIER, TOKEN_IDENTIFIER, TOKEN_IDENTIFIER, TOKEN_IDENTIFIER, TOKEN_IDENTIFIER}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			if got := tokenTypes(tt.src); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenTypes(%q) = %v, want %v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"newline", `"a\nb"`, "a\nb"},
+		{"tab", `"a\tb"`, "a\tb"},
+		{"carriage return", `"a\rb"`, "a\rb"},
+		{"quote", `"say \"hi\""`, `say "hi"`},
+		{"backslash", `"C:\\dir"`, `C:\dir`},
+		{"backslash before a quote", `"a\\"`, `a\`},
+		{"unknown escape kept", `"a\qb"`, `a\qb`},
+		{"interpolation escape kept for the interpreter", `"\${HOME}"`, `\${HOME}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := lex(tt.src)
+			if len(tokens) != 1 || tokens[0].Type != TOKEN_STRING {
+				t.Fatalf("lex(%s) = %v, want one string", tt.src, tokens)
+			}
+			if tokens[0].Literal != tt.want {
+				t.Errorf("value = %q, want %q", tokens[0].Literal, tt.want)
+			}
+		})
+	}
+}
+
+func TestTripleQuotedStrings(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"one line", `"""say "hi" and 'bye'"""`, `say "hi" and 'bye'`},
+		{"dedented", "\"\"\"\n    first\n      indented\n    last\n    \"\"\"", "first\n  indented\nlast"},
+		{"blank lines ignored for indentation", "\"\"\"\n    a\n\n    b\n\"\"\"", "a\n\nb"},
+		{"escapes taken literally", `"""a\nb"""`, `a\nb`},
+		{"crlf", "\"\"\"\r\n  a\r\n  b\r\n  \"\"\"", "a\nb"},
+		{"empty", `""""""`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := lex(tt.src)
+			if len(tokens) != 1 || tokens[0].Type != TOKEN_STRING {
+				t.Fatalf("lex(%q) = %v, want one string", tt.src, tokens)
+			}
+			if tokens[0].Literal != tt.want {
+				t.Errorf("value = %q, want %q", tokens[0].Literal, tt.want)
+			}
+		})
+	}
+
+	// Lines after a triple-quoted string keep their numbers
+	if tokens := lex("\"\"\"\na\nb\n\"\"\"\nx"); tokens[len(tokens)-1].Line != 5 {
+		t.Errorf("x is on line %d, want 5", tokens[len(tokens)-1].Line)
+	}
+}
+
+// numberTest is a number literal and the value it denotes, or the error it
+// is reported with.
+type numberTest struct {
+	src     string
+	want    float64
+	wantErr string
+}
+
+// runNumberTests assigns each literal to result and checks its value or
+// syntax error.
+func runNumberTests(t *testing.T, tests []numberTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			src := "result = " + tt.src + "\n"
+			if tt.wantErr != "" {
+				if errs := parseErrors(src); len(errs) == 0 || !strings.Contains(errs[0], tt.wantErr) {
+					t.Errorf("errors = %q, want %q", errs, tt.wantErr)
+				}
+				return
+			}
+			if got := resultOf(t, src); got != tt.want {
+				t.Errorf("result = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumberBases(t *testing.T) {
+	runNumberTests(t, []numberTest{
+		{src: "0xFF", want: 255},
+		{src: "0Xff", want: 255},
+		{src: "0o755", want: 493},
+		{src: "0b1010", want: 10},
+		{src: "0", want: 0},
+		{src: "0xG", wantErr: `invalid hexadecimal literal "0xG"`},
+		{src: "0o8", wantErr: `invalid octal literal "0o8"`},
+		{src: "0b102", wantErr: `invalid binary literal "0b102"`},
+		{src: "0x", wantErr: `invalid hexadecimal literal "0x"`},
+	})
+}
+
+func TestScientificNotation(t *testing.T) {
+	runNumberTests(t, []numberTest{
+		{src: "1e6", want: 1e6},
+		{src: "1.5e3", want: 1500},
+		{src: "2.5e-3", want: 0.0025},
+		{src: "3E+2", want: 300},
+		{src: "5e", wantErr: `missing exponent digits in number "5e"`},
+		{src: "5e+", wantErr: `missing exponent digits in number "5e+"`},
+	})
+}
+
+func TestDigitSeparators(t *testing.T) {
+	runNumberTests(t, []numberTest{
+		{src: "1_000", want: 1000},
+		{src: "1_000_000", want: 1e6},
+		{src: "1_0.2_5", want: 10.25},
+		{src: "0xFF_FF", want: 0xFFFF},
+		{src: "5_", wantErr: `misplaced digit separator in "5_"`},
+		{src: "5__0", wantErr: `misplaced digit separator in "5__0"`},
+		{src: "1_.5", wantErr: `misplaced digit separator in "1_.5"`},
+		{src: "0x_FF", wantErr: `misplaced digit separator in "0x_FF"`},
+	})
+
+	// A leading underscore makes a name, not a number
+	if got := tokenTypes("_5"); !reflect.DeepEqual(got, []TokenType{TOKEN_IDENTIFIER}) {
+		t.Errorf("tokenTypes(_5) = %v, want an identifier", got)
+	}
+}
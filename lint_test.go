@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// lintTest is a script and the warnings one lint rule should report for it.
+type lintTest struct {
+	name string
+	src  string
+	want []string
+}
+
+// runLintTests runs check over each script and compares its warnings.
+func runLintTests(t *testing.T, check lintCheck, tests []lintTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := NewParser(NewLexer(tt.src))
+			program := parser.Parse()
+			if errs := parser.Errors(); len(errs) > 0 {
+				t.Fatalf("parse: %s", strings.Join(errs, "; "))
+			}
+			var got []string
+			for _, w := range check(program, parser.Positions()) {
+				got = append(got, w.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("warnings = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintUnusedVariables(t *testing.T) {
+	runLintTests(t, lintUnusedVariables, []lintTest{
+		{"used in a prompt", "project = \"shop\"\nask \"build ${project}\"\n", nil},
+		{"used in a condition", "n = 1\nif n == 1 {\n  ask \"go\"\n}\n", nil},
+		{"unused", "name = \"shop\"\nask \"build it\"\n",
+			[]string{"line 1, column 1: variable name is assigned but never used [unused-variable]"}},
+		{"read by the prompt builder", "project = \"shop\"\nask \"build it\"\n", nil},
+		{"reported once", "x = 1\nx = 2\n",
+			[]string{"line 1, column 1: variable x is assigned but never used [unused-variable]"}},
+		{"nested in a block", "repeat 2 {\n  y = 1\n}\n",
+			[]string{"line 2, column 3: variable y is assigned but never used [unused-variable]"}},
+		{"destructuring", "out, _ = ask \"go\"\n",
+			[]string{"line 1, column 1: variable out is assigned but never used [unused-variable]"}},
+		{"control variable", "model = \"opus\"\n", nil},
+	})
+}
+
+func TestLintUndefinedReferences(t *testing.T) {
+	runLintTests(t, lintUndefinedReferences, []lintTest{
+		{"defined", "project = \"shop\"\nask \"build ${project}\"\n", nil},
+		{"defined later in a loop", "for t in [\"a\"] {\n  shell \"echo ${t}\"\n}\n", nil},
+		{"required", "require project\nask \"build ${project}\"\n", nil},
+		{"undefined interpolation", "ask \"build ${name}\"\n",
+			[]string{"line 1, column 1: name is not defined [undefined-reference]"}},
+		{"undefined operand", "x = 1\nif y == 1 {\n  ask \"${x}\"\n}\n",
+			[]string{"line 2, column 1: y is not defined [undefined-reference]"}},
+		{"builtin variable", "shell \"true\"\nask \"exit was ${last_exit}\"\n", nil},
+	})
+}
+
+func TestLintConstantConditions(t *testing.T) {
+	runLintTests(t, lintConstantConditions, []lintTest{
+		{"variable", "x = 1\nif x == 1 {\n  ask \"go\"\n}\n", nil},
+		{"always true", "if 1 == 1 {\n  ask \"go\"\n}\n",
+			[]string{"line 1, column 1: if condition 1 == 1 is always true [constant-condition]"}},
+		{"always false", "if \"a\" == \"b\" {\n  ask \"go\"\n}\n",
+			[]string{`line 1, column 1: if condition "a" == "b" is always false [constant-condition]`}},
+		{"interpolated literal", "x = 1\nif \"${x}\" == \"1\" {\n  ask \"go\"\n}\n", nil},
+		{"while True with a break", "while True {\n  break\n}\n", nil},
+		{"while True without a break", "while True {\n  ask \"go\"\n}\n",
+			[]string{"line 1, column 1: while condition True is always true [constant-condition]"}},
+	})
+}
+
+func TestLintEmptyBlocks(t *testing.T) {
+	runLintTests(t, lintEmptyBlocks, []lintTest{
+		{"non-empty", "repeat 2 {\n  ask \"go\"\n}\n", nil},
+		{"empty if", "x = 1\nif x == 1 {\n}\n",
+			[]string{"line 2, column 1: empty if block [empty-block]"}},
+		{"empty loop", "for t in [1] {\n}\n",
+			[]string{"line 1, column 1: empty for block [empty-block]"}},
+		{"empty hook", "before {\n}\n",
+			[]string{"line 1, column 1: empty before block [empty-block]"}},
+		{"nested", "repeat 2 {\n  repeat 3 {\n  }\n}\n",
+			[]string{"line 2, column 3: empty repeat block [empty-block]"}},
+	})
+}
+
+func TestLintUnknownMCP(t *testing.T) {
+	runLintTests(t, lintUnknownMCP, []lintTest{
+		{"known", "fs.mkdir \"src\"\n", nil},
+		{"unknown service", "db.query \"x\"\n",
+			[]string{"line 1, column 1: unknown MCP service: db [unknown-mcp]"}},
+		{"unknown method", "fs.remove \"src\"\n",
+			[]string{"line 1, column 1: unknown MCP method: fs.remove [unknown-mcp]"}},
+		{"in a post-condition", "ask \"go\" then assert fs.there \"x\"\n",
+			[]string{"line 1, column 1: unknown MCP method: fs.there [unknown-mcp]"}},
+	})
+}
+
+func TestRunLint(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		wantErr error
+	}{
+		{"clean", "project = \"shop\"\nask \"build ${project}\"\n", "✓ No problems found", nil},
+		{"warnings sorted by line", "ask \"${a}\"\nb = 1\n",
+			"shop.vibe: line 1, column 1: a is not defined [undefined-reference]\nshop.vibe: line 2, column 1: variable b is assigned but never used [unused-variable]\n⚠ 2 warning(s)", errLintWarnings},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdir(t, t.TempDir())
+			if err := os.WriteFile("shop.vibe", []byte(tt.src), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			err := runLint([]string{"shop.vibe"}, &out)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("output:\n%s\nwant it to contain:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
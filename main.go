@@ -5,34 +5,76 @@
 // DSL Grammar Rules:
 // ------------------
 // program        → statement*
-// statement      → assignment | ask_stmt | if_stmt | repeat_stmt | before_block | after_block | mcp_call
-// assignment     → IDENTIFIER "=" value
-// value          → STRING | NUMBER | BOOLEAN | list | IDENTIFIER
-// list           → "[" (value ("," value)*)? "]"
-// ask_stmt       → "ask" STRING
-// if_stmt        → "if" condition "{" statement* "}" ("else" "{" statement* "}")?
-// repeat_stmt    → "repeat" NUMBER "{" statement* "}"
-// before_block   → "before" "{" hook_stmt* "}"
-// after_block    → "after" "{" hook_stmt* "}"
-// hook_stmt      → "shell" STRING | mcp_call
-// mcp_call       → IDENTIFIER "." IDENTIFIER (STRING)?
-// condition      → value ("==" | "!=" | "<" | ">" | "<=" | ">=") value
-// BOOLEAN        → "True" | "False"
-// STRING         → '"' [^"]* '"' | unquoted_string
-// NUMBER         → [0-9]+ ("." [0-9]+)?
+// statement      → assignment | compound_assign | ask_stmt | refine_stmt | if_stmt | repeat_stmt | while_stmt | for_stmt | "break" | "continue" | require_stmt | before_block | after_block | mcp_call | prompt_def | group_block | setup_block | run_stmt
+// assignment     → IDENTIFIER ("," IDENTIFIER)* "=" value
+// compound_assign → IDENTIFIER ("+=" | "-=" | "*=" | "/=") value   (numbers only)
+// value          → or_expr ("?" value ":" value)?
+// or_expr        → and_expr ("||" and_expr)*
+// and_expr       → not_expr ("&&" not_expr)*
+// not_expr       → "!" not_expr | comparison
+// comparison     → sum (compare_op sum)?
+// sum            → primary ("+" primary)*
+// primary        → STRING | NUMBER | BOOLEAN | list | (call | IDENTIFIER) ("[" value "]")* | ask_stmt | shell_stmt | succeeds | "(" value ")"
+// succeeds       → shell_stmt "succeeds"
+// list           → "[" (value ("," value)* | comprehension)? "]"
+// comprehension  → value "for" IDENTIFIER "in" value ("if" condition)?
+// call           → IDENTIFIER "(" (value ("," value)*)? ")"
+// ask_stmt       → "ask" (STRING | IDENTIFIER | "@" path) modifier* ("then" "assert" (mcp_call | condition))?
+// refine_stmt    → "refine" (STRING | IDENTIFIER | "@" path) modifier* "until" value ("max" NUMBER)?
+// shell_stmt     → "shell" STRING modifier*
+// modifier       → IDENTIFIER "=" value            (e.g. timeout="5m")
+// prompt_def     → "prompt" IDENTIFIER "=" STRING
+// if_stmt        → "if" condition "{" statement* "}" (("elif" | "else" "if") condition "{" statement* "}")* ("else" "{" statement* "}")?
+// repeat_stmt    → "repeat" sum? ("while" condition)? "{" statement* "}"
+// while_stmt     → "while" condition "{" statement* "}"
+// each_block     → ("before" | "after") "each" ("when" condition)? "{" statement* "}"   (only in repeat/while/for bodies)
+// for_stmt       → ("for" | "foreach") IDENTIFIER ("," IDENTIFIER)? "in" value "{" statement* "}"
+// group_block    → "group" STRING "{" statement* "}"
+// setup_block    → ("setup" | "define") name "{" statement* "}"   name → STRING | IDENTIFIER
+// run_stmt       → ("run" | "use") name | name                 (a bare name once the setup is defined)
+// require_stmt   → "require" ("[" name ("," name)* "]" | name)   name → STRING | IDENTIFIER
+// before_block   → "before" ("when" condition)? "{" hook_stmt* "}"
+// after_block    → "after" ("when" condition)? "{" hook_stmt* "}"
+// hook_stmt      → shell_stmt | mcp_call
+// mcp_call       → IDENTIFIER "." IDENTIFIER (arg (","? arg)*)? (IDENTIFIER "=" value)*   arg → STRING | NUMBER
+// condition      → or_expr                        (a bare value tests its truthiness)
+// compare_op     → "==" | "!=" | "<" | ">" | "<=" | ">="
+// BOOLEAN        → "True" | "False" | "true" | "false"
+// STRING         → '"' ([^"\\] | escape)* '"' | '"""' .* '"""' | unquoted_string
+// escape         → "\n" | "\t" | "\r" | "\"" | "\\"   (other escapes are kept as written)
+// NUMBER         → [0-9]+ ("." [0-9]+)? ([eE] [+-]? [0-9]+)? | "0x" [0-9a-fA-F]+ | "0o" [0-7]+ | "0b" [01]+   (digits may be separated by "_")
 // IDENTIFIER     → [a-zA-Z_][a-zA-Z0-9_-]*
+//
+// Only if, else, repeat, ask, before, after, shell and the booleans are
+// reserved. The other keywords (prompt, while, for, foreach, in, group, setup,
+// define, run, use, require, refine, break, continue, elif) are keywords only
+// where the grammar expects them, so "prompt = ..." or "run++" still work.
 
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"go/token"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+	"time"
 	"unicode"
 )
 
@@ -44,34 +86,60 @@ type TokenType int
 
 const (
 	TOKEN_EOF TokenType = iota
+	TOKEN_ILLEGAL
 	TOKEN_IDENTIFIER
 	TOKEN_STRING
 	TOKEN_NUMBER
 	TOKEN_BOOLEAN
-	TOKEN_ASSIGN       // =
-	TOKEN_LBRACE       // {
-	TOKEN_RBRACE       // }
-	TOKEN_LBRACKET     // [
-	TOKEN_RBRACKET     // ]
-	TOKEN_COMMA        // ,
-	TOKEN_DOT          // .
-	TOKEN_EQ           // ==
-	TOKEN_NEQ          // !=
-	TOKEN_LT           // <
-	TOKEN_GT           // >
-	TOKEN_LTE          // <=
-	TOKEN_GTE          // >=
-	TOKEN_PLUS         // +
-	TOKEN_MINUS        // -
-	TOKEN_PLUSPLUS     // ++
-	TOKEN_MINUSMINUS   // --
+	TOKEN_ASSIGN     // =
+	TOKEN_LBRACE     // {
+	TOKEN_RBRACE     // }
+	TOKEN_LBRACKET   // [
+	TOKEN_RBRACKET   // ]
+	TOKEN_LPAREN     // (
+	TOKEN_RPAREN     // )
+	TOKEN_COMMA      // ,
+	TOKEN_DOT        // .
+	TOKEN_EQ         // ==
+	TOKEN_NEQ        // !=
+	TOKEN_LT         // <
+	TOKEN_GT         // >
+	TOKEN_LTE        // <=
+	TOKEN_GTE        // >=
+	TOKEN_PLUS       // +
+	TOKEN_MINUS      // -
+	TOKEN_PLUSPLUS   // ++
+	TOKEN_MINUSMINUS // --
+	TOKEN_PLUSEQ     // +=
+	TOKEN_MINUSEQ    // -=
+	TOKEN_STAREQ     // *=
+	TOKEN_SLASHEQ    // /=
+	TOKEN_BANG       // !
+	TOKEN_AND        // &&
+	TOKEN_OR         // ||
+	TOKEN_QUESTION   // ?
+	TOKEN_COLON      // :
+	TOKEN_FILEREF    // @path or @"path"
 	TOKEN_IF
 	TOKEN_ELSE
 	TOKEN_REPEAT
+	TOKEN_WHILE
+	TOKEN_FOR
+	TOKEN_FOREACH
 	TOKEN_ASK
 	TOKEN_BEFORE
 	TOKEN_AFTER
 	TOKEN_SHELL
+	TOKEN_PROMPT
+	TOKEN_GROUP
+	TOKEN_SETUP
+	TOKEN_RUN
+	TOKEN_REQUIRE
+	TOKEN_REFINE
+	TOKEN_BREAK
+	TOKEN_CONTINUE
+	TOKEN_DEFINE
+	TOKEN_USE
 	TOKEN_NEWLINE
 )
 
@@ -93,6 +161,7 @@ type Lexer struct {
 	ch      byte
 	line    int
 	column  int
+	errors  ParseErrorList // malformed tokens, collected by the parser
 }
 
 func NewLexer(input string) *Lexer {
@@ -102,6 +171,12 @@ func NewLexer(input string) *Lexer {
 }
 
 func (l *Lexer) readChar() {
+	// A newline belongs to the line it ends, so the count moves on only
+	// once it has been read past
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
 	if l.readPos >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -110,10 +185,17 @@ func (l *Lexer) readChar() {
 	l.pos = l.readPos
 	l.readPos++
 	l.column++
-	if l.ch == '\n' {
-		l.line++
-		l.column = 0
-	}
+}
+
+func (l *Lexer) addError(tok Token, format string, args ...interface{}) {
+	l.errors = append(l.errors, &ParseError{Line: tok.Line, Column: tok.Column, Msg: fmt.Sprintf(format, args...)})
+}
+
+// drainErrors returns the errors found since the last call.
+func (l *Lexer) drainErrors() ParseErrorList {
+	errs := l.errors
+	l.errors = nil
+	return errs
 }
 
 func (l *Lexer) peekChar() byte {
@@ -123,24 +205,78 @@ func (l *Lexer) peekChar() byte {
 	return l.input[l.readPos]
 }
 
+// skipWhitespace skips blanks within a line. Indentation carries no
+// meaning: blocks are delimited by braces only, so tabs, spaces and any
+// mix of them are equivalent. A backslash at the end of a line continues
+// the statement on the next line.
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\r' {
+	for {
+		switch {
+		case l.ch == ' ' || l.ch == '\t' || l.ch == '\r':
+			l.readChar()
+		case l.atContinuation():
+			l.skipContinuation()
+		default:
+			return
+		}
+	}
+}
+
+// atContinuation reports whether the lexer is at a backslash that ends
+// the line.
+func (l *Lexer) atContinuation() bool {
+	if l.ch != '\\' {
+		return false
+	}
+	rest := l.input[l.readPos:]
+	return strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n")
+}
+
+// skipContinuation consumes a backslash, the line break after it and the
+// indentation of the continued line.
+func (l *Lexer) skipContinuation() {
+	l.readChar() // consume \\
+	if l.ch == '\r' {
+		l.readChar()
+	}
+	l.readChar() // consume newline
+	for l.ch == ' ' || l.ch == '\t' {
 		l.readChar()
 	}
 }
 
-func (l *Lexer) skipComment() {
-	if l.ch == '#' {
+// skipComment skips a # comment up to the end of the line or a /* ... */
+// block comment, which may span lines. It reports whether it skipped one.
+func (l *Lexer) skipComment() bool {
+	switch {
+	case l.ch == '#':
 		for l.ch != '\n' && l.ch != 0 {
 			l.readChar()
 		}
+		return true
+	case l.ch == '/' && l.peekChar() == '*':
+		start := Token{Line: l.line, Column: l.column}
+		l.readChar()
+		l.readChar() // consume /*
+		for l.ch != 0 && !(l.ch == '*' && l.peekChar() == '/') {
+			l.readChar()
+		}
+		if l.ch == 0 {
+			l.addError(start, "unterminated block comment")
+			return false
+		}
+		l.readChar()
+		l.readChar() // consume */
+		return true
 	}
+	return false
 }
 
 func (l *Lexer) NextToken() Token {
 	l.skipWhitespace()
-	l.skipComment()
-	l.skipWhitespace()
+	for l.skipComment() {
+		l.skipWhitespace()
+	}
 
 	tok := Token{Line: l.line, Column: l.column}
 
@@ -165,6 +301,10 @@ func (l *Lexer) NextToken() Token {
 			tok.Type = TOKEN_NEQ
 			tok.Literal = "!="
 			l.readChar()
+		} else {
+			tok.Type = TOKEN_BANG
+			tok.Literal = "!"
+			l.readChar()
 		}
 	case '<':
 		if l.peekChar() == '=' {
@@ -191,6 +331,10 @@ func (l *Lexer) NextToken() Token {
 			l.readChar()
 			tok.Type = TOKEN_PLUSPLUS
 			tok.Literal = "++"
+		} else if l.peekChar() == '=' {
+			l.readChar()
+			tok.Type = TOKEN_PLUSEQ
+			tok.Literal = "+="
 		} else {
 			tok.Type = TOKEN_PLUS
 			tok.Literal = "+"
@@ -201,11 +345,47 @@ func (l *Lexer) NextToken() Token {
 			l.readChar()
 			tok.Type = TOKEN_MINUSMINUS
 			tok.Literal = "--"
+		} else if l.peekChar() == '=' {
+			l.readChar()
+			tok.Type = TOKEN_MINUSEQ
+			tok.Literal = "-="
 		} else {
 			tok.Type = TOKEN_MINUS
 			tok.Literal = "-"
 		}
 		l.readChar()
+	case '*':
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok.Type = TOKEN_STAREQ
+			tok.Literal = "*="
+		} else {
+			tok.Type = TOKEN_ILLEGAL
+			tok.Literal = "*"
+		}
+		l.readChar()
+	case '/':
+		// "/*" was already taken as a comment
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok.Type = TOKEN_SLASHEQ
+			tok.Literal = "/="
+		} else {
+			tok.Type = TOKEN_ILLEGAL
+			tok.Literal = "/"
+		}
+		l.readChar()
+	case '$':
+		// $? is shorthand for last_exit, as in a shell
+		if l.peekChar() == '?' {
+			l.readChar()
+			tok.Type = TOKEN_IDENTIFIER
+			tok.Literal = "last_exit"
+		} else {
+			tok.Type = TOKEN_ILLEGAL
+			tok.Literal = "$"
+		}
+		l.readChar()
 	case '{':
 		tok.Type = TOKEN_LBRACE
 		tok.Literal = "{"
@@ -222,6 +402,45 @@ func (l *Lexer) NextToken() Token {
 		tok.Type = TOKEN_RBRACKET
 		tok.Literal = "]"
 		l.readChar()
+	case '(':
+		tok.Type = TOKEN_LPAREN
+		tok.Literal = "("
+		l.readChar()
+	case ')':
+		tok.Type = TOKEN_RPAREN
+		tok.Literal = ")"
+		l.readChar()
+	case '@':
+		tok.Type = TOKEN_FILEREF
+		tok.Literal = l.readFileRef()
+	case '&':
+		if l.peekChar() == '&' {
+			l.readChar()
+			tok.Type = TOKEN_AND
+			tok.Literal = "&&"
+		} else {
+			tok.Type = TOKEN_ILLEGAL
+			tok.Literal = "&"
+		}
+		l.readChar()
+	case '|':
+		if l.peekChar() == '|' {
+			l.readChar()
+			tok.Type = TOKEN_OR
+			tok.Literal = "||"
+		} else {
+			tok.Type = TOKEN_ILLEGAL
+			tok.Literal = "|"
+		}
+		l.readChar()
+	case '?':
+		tok.Type = TOKEN_QUESTION
+		tok.Literal = "?"
+		l.readChar()
+	case ':':
+		tok.Type = TOKEN_COLON
+		tok.Literal = ":"
+		l.readChar()
 	case ',':
 		tok.Type = TOKEN_COMMA
 		tok.Literal = ","
@@ -232,7 +451,11 @@ func (l *Lexer) NextToken() Token {
 		l.readChar()
 	case '"':
 		tok.Type = TOKEN_STRING
-		tok.Literal = l.readString()
+		if strings.HasPrefix(l.input[l.pos:], `"""`) {
+			tok.Literal = l.readTripleString()
+		} else {
+			tok.Literal = l.readString()
+		}
 	case 0:
 		tok.Type = TOKEN_EOF
 		tok.Literal = ""
@@ -243,22 +466,145 @@ func (l *Lexer) NextToken() Token {
 			return tok
 		} else if isDigit(l.ch) {
 			tok.Type = TOKEN_NUMBER
-			tok.Literal = l.readNumber()
+			tok.Literal = l.readNumber(tok)
 			return tok
 		}
+		// Unknown characters become ILLEGAL tokens so the parser can
+		// report them instead of treating them as the end of input.
+		tok.Type = TOKEN_ILLEGAL
+		tok.Literal = string(l.ch)
+		l.readChar()
 	}
 	return tok
 }
 
+// stringEscapes maps the character after a backslash in a string literal
+// to the character it stands for. Other escapes are kept as written, so
+// \${ still reaches interpolation and Windows paths survive.
+var stringEscapes = map[byte]byte{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'"':  '"',
+	'\\': '\\',
+}
+
+// quoteLiteral returns s as a string literal that readString decodes back
+// to s.
+func quoteLiteral(s string) string {
+	return `"` + literalEscaper.Replace(s) + `"`
+}
+
+var literalEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t", "\r", "\\r")
+
+// readString reads a quoted string. A backslash at the end of a line
+// joins the next line (without its indentation) with a single space.
+// Escapes listed in stringEscapes are decoded.
 func (l *Lexer) readString() string {
+	start := Token{Line: l.line, Column: l.column}
 	l.readChar() // consume opening "
-	start := l.pos
-	for l.ch != '"' && l.ch != 0 {
+	var str strings.Builder
+	for l.ch != '"' {
+		// Only triple-quoted strings span lines; the newline is left for
+		// the parser so the next line still parses
+		if l.ch == 0 || l.ch == '\n' {
+			l.addError(start, "unterminated string")
+			return str.String()
+		}
+		if l.atContinuation() {
+			l.skipContinuation()
+			if !strings.HasSuffix(str.String(), " ") {
+				str.WriteByte(' ')
+			}
+			continue
+		}
+		if l.ch == '\\' {
+			if decoded, ok := stringEscapes[l.peekChar()]; ok {
+				str.WriteByte(decoded)
+				l.readChar()
+				l.readChar()
+				continue
+			}
+		}
+		str.WriteByte(l.ch)
 		l.readChar()
 	}
-	str := l.input[start:l.pos]
 	l.readChar() // consume closing "
-	return str
+	return str.String()
+}
+
+// readTripleString reads a """...""" string. Everything up to the closing
+// quotes is taken literally, newlines and quotes included, and the result
+// is dedented.
+func (l *Lexer) readTripleString() string {
+	open := Token{Line: l.line, Column: l.column}
+	for n := 0; n < 3; n++ {
+		l.readChar() // consume opening """
+	}
+	start := l.pos
+	for l.ch != 0 && !strings.HasPrefix(l.input[l.pos:], `"""`) {
+		l.readChar()
+	}
+	text := l.input[start:l.pos]
+	if l.ch == 0 {
+		l.addError(open, "unterminated string")
+	} else {
+		for n := 0; n < 3; n++ {
+			l.readChar() // consume closing """
+		}
+	}
+	return dedent(text)
+}
+
+// dedent tidies the text of a triple-quoted string: a line break right
+// after the opening quotes and a blank last line before the closing quotes
+// are dropped, and the indentation shared by all non-blank lines is
+// removed, so the string can be indented along with the script.
+func dedent(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimPrefix(text, "\n")
+	lines := strings.Split(text, "\n")
+	if len(lines) > 1 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	prefix := ""
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			prefix, first = indent, false
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for n, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[n] = ""
+		} else {
+			lines[n] = line[len(prefix):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readFileRef reads the path of an @path reference: either a quoted
+// string or everything up to the next blank.
+func (l *Lexer) readFileRef() string {
+	l.readChar() // consume @
+	if l.ch == '"' {
+		return l.readString()
+	}
+	start := l.pos
+	for l.ch != 0 && l.ch != ' ' && l.ch != '\t' && l.ch != '\r' && l.ch != '\n' {
+		l.readChar()
+	}
+	return l.input[start:l.pos]
 }
 
 func (l *Lexer) readIdentifier() string {
@@ -269,18 +615,77 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[start:l.pos]
 }
 
-func (l *Lexer) readNumber() string {
+// numberBases maps the prefix letter of a 0x, 0o or 0b literal to the name
+// and digits of its base.
+var numberBases = map[rune]struct {
+	name   string
+	digits string
+}{
+	'x': {"hexadecimal", "0123456789abcdefABCDEF"},
+	'o': {"octal", "01234567"},
+	'b': {"binary", "01"},
+}
+
+// readNumber reads a number literal. Underscores may separate digits, as
+// in 1_000_000; misplaced ones are reported.
+func (l *Lexer) readNumber(tok Token) string {
 	start := l.pos
-	for isDigit(l.ch) {
+	if base, ok := numberBases[unicode.ToLower(rune(l.peekChar()))]; ok && l.ch == '0' {
 		l.readChar()
+		l.readChar() // consume 0x, 0o or 0b
+		// Read the whole word so a bad digit is reported, not split off
+		for isLetter(l.ch) || isDigit(l.ch) {
+			l.readChar()
+		}
+		lit := l.input[start:l.pos]
+		digits := strings.ReplaceAll(lit[2:], "_", "")
+		if digits == "" || strings.Trim(digits, base.digits) != "" {
+			l.addError(tok, "invalid %s literal %q", base.name, lit)
+		} else if !validSeparators(lit[2:], base.digits) {
+			l.addError(tok, "misplaced digit separator in %q", lit)
+		}
+		return lit
+	}
+	digits := func() {
+		for isDigit(l.ch) || l.ch == '_' {
+			l.readChar()
+		}
 	}
+	digits()
 	if l.ch == '.' && isDigit(l.peekChar()) {
 		l.readChar()
-		for isDigit(l.ch) {
+		digits()
+	}
+	if l.ch == 'e' || l.ch == 'E' {
+		l.readChar()
+		if l.ch == '+' || l.ch == '-' {
 			l.readChar()
 		}
+		if !isDigit(l.ch) {
+			l.addError(tok, "missing exponent digits in number %q", l.input[start:l.pos])
+			return l.input[start:l.pos]
+		}
+		digits()
 	}
-	return l.input[start:l.pos]
+	lit := l.input[start:l.pos]
+	if !validSeparators(lit, "0123456789") {
+		l.addError(tok, "misplaced digit separator in %q", lit)
+	}
+	return lit
+}
+
+// validSeparators reports whether every underscore in lit sits between
+// two characters of digits.
+func validSeparators(lit, digits string) bool {
+	for k := 0; k < len(lit); k++ {
+		if lit[k] != '_' {
+			continue
+		}
+		if k == 0 || k == len(lit)-1 || !strings.ContainsRune(digits, rune(lit[k-1])) || !strings.ContainsRune(digits, rune(lit[k+1])) {
+			return false
+		}
+	}
+	return true
 }
 
 func isLetter(ch byte) bool {
@@ -302,6 +707,8 @@ func lookupKeyword(ident string) TokenType {
 		"shell":  TOKEN_SHELL,
 		"True":   TOKEN_BOOLEAN,
 		"False":  TOKEN_BOOLEAN,
+		"true":   TOKEN_BOOLEAN,
+		"false":  TOKEN_BOOLEAN,
 	}
 	if tok, ok := keywords[ident]; ok {
 		return tok
@@ -339,12 +746,23 @@ func (a *Assignment) String() string {
 	return fmt.Sprintf("%s = %s", a.Name, a.Value.String())
 }
 
+// DestructuringAssignment assigns the elements of a list value, such as
+// the captured output of an ask, to several variables at once.
+type DestructuringAssignment struct {
+	Names []string
+	Value Node
+}
+
+func (d *DestructuringAssignment) String() string {
+	return fmt.Sprintf("%s = %s", strings.Join(d.Names, ", "), d.Value.String())
+}
+
 type StringLiteral struct {
 	Value string
 }
 
 func (s *StringLiteral) String() string {
-	return fmt.Sprintf("\"%s\"", s.Value)
+	return quoteLiteral(s.Value)
 }
 
 type NumberLiteral struct {
@@ -386,12 +804,116 @@ func (l *ListLiteral) String() string {
 	return fmt.Sprintf("[%s]", strings.Join(elements, ", "))
 }
 
+type ListComprehension struct {
+	Expr     Node
+	Var      string
+	Iterable Node
+	Filter   *Condition
+}
+
+func (l *ListComprehension) String() string {
+	out := fmt.Sprintf("[%s for %s in %s", l.Expr.String(), l.Var, l.Iterable.String())
+	if l.Filter != nil {
+		out += " if " + l.Filter.String()
+	}
+	return out + "]"
+}
+
+type CallExpression struct {
+	Function string
+	Args     []Node
+}
+
+func (c *CallExpression) String() string {
+	var args []string
+	for _, a := range c.Args {
+		args = append(args, a.String())
+	}
+	return fmt.Sprintf("%s(%s)", c.Function, strings.Join(args, ", "))
+}
+
+type BinaryExpression struct {
+	Left     Node
+	Operator string
+	Right    Node
+}
+
+func (b *BinaryExpression) String() string {
+	return fmt.Sprintf("%s %s %s", b.Left.String(), b.Operator, b.Right.String())
+}
+
+// IndexExpression selects one element of a list, as in tools[0].
+type IndexExpression struct {
+	Target Node
+	Index  Node
+}
+
+func (e *IndexExpression) String() string {
+	return fmt.Sprintf("%s[%s]", e.Target.String(), e.Index.String())
+}
+
+// TernaryExpression selects Then or Else depending on Condition, as in
+// mode = env == "prod" ? "strict" : "loose".
+type TernaryExpression struct {
+	Condition *Condition
+	Then      Node
+	Else      Node
+}
+
+func (t *TernaryExpression) String() string {
+	return fmt.Sprintf("%s ? %s : %s", t.Condition.String(), t.Then.String(), t.Else.String())
+}
+
+// SucceedsExpression runs a shell command and yields whether it exited
+// with status 0, as in built = shell "make" succeeds.
+type SucceedsExpression struct {
+	Command *ShellCommand
+}
+
+func (s *SucceedsExpression) String() string {
+	return s.Command.String() + " succeeds"
+}
+
 type AskStatement struct {
 	Instruction string
+	PromptRef   string // name of a prompt from the library, used instead of Instruction
+	PromptFile  string // file whose contents are the instruction (ask @path)
+	Timeout     Node   // optional per-step timeout modifier
+	Tools       Node   // optional list of tools Claude may use for this step
+	Model       Node   // optional model for this step, overriding every default
+	Kind        Node   // optional step kind, mapped to a model by --model-for
+	Retries     Node   // optional number of retries, overriding --retries
+	Assert      Node   // optional post-condition checked after Claude finishes
 }
 
 func (a *AskStatement) String() string {
-	return fmt.Sprintf("ask \"%s\"", a.Instruction)
+	mods := formatModifier("timeout", a.Timeout) + formatModifier("tools", a.Tools) + formatModifier("model", a.Model) + formatModifier("kind", a.Kind) + formatModifier("retries", a.Retries)
+	if a.Assert != nil {
+		mods += " then assert " + a.Assert.String()
+	}
+	if a.PromptRef != "" {
+		return fmt.Sprintf("ask %s%s", a.PromptRef, mods)
+	}
+	if a.PromptFile != "" {
+		return fmt.Sprintf("ask @%s%s", a.PromptFile, mods)
+	}
+	return fmt.Sprintf("ask %s%s", quoteLiteral(a.Instruction), mods)
+}
+
+func formatModifier(key string, value Node) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf(" %s=%s", key, value.String())
+}
+
+type PromptDefinition struct {
+	Name string
+	Text string
+}
+
+func (p *PromptDefinition) String() string {
+	return fmt.Sprintf("prompt %s = %s", p.Name, quoteLiteral(p.Text))
 }
 
 type IfStatement struct {
@@ -404,6 +926,9 @@ func (i *IfStatement) String() string {
 	return fmt.Sprintf("if %s { ... }", i.Condition.String())
 }
 
+// Condition compares Left and Right, or joins two conditions with && or
+// ||. Without an Operator it tests the truthiness of Left alone; with "!"
+// it negates the condition in Left.
 type Condition struct {
 	Left     Node
 	Operator string
@@ -411,53 +936,227 @@ type Condition struct {
 }
 
 func (c *Condition) String() string {
-	return fmt.Sprintf("%s %s %s", c.Left.String(), c.Operator, c.Right.String())
+	switch c.Operator {
+	case "":
+		return c.Left.String()
+	case "!":
+		return "!" + c.operand(c.Left)
+	}
+	return fmt.Sprintf("%s %s %s", c.operand(c.Left), c.Operator, c.operand(c.Right))
+}
+
+// operand formats one side of c, in parentheses when it is a condition that
+// would otherwise read as binding differently.
+func (c *Condition) operand(n Node) string {
+	inner, ok := n.(*Condition)
+	if !ok || inner.Operator == "" {
+		return n.String()
+	}
+	outer, nested := precedenceOf(c.Operator), precedenceOf(inner.Operator)
+	if nested < outer || (nested == outer && outer == comparisonPrecedence) {
+		return "(" + inner.String() + ")"
+	}
+	return inner.String()
+}
+
+// comparisonPrecedence is the precedence of the compare operators, which
+// bind more tightly than && and ||.
+const comparisonPrecedence = 3
+
+func precedenceOf(op string) int {
+	switch op {
+	case "||":
+		return 1
+	case "&&":
+		return 2
+	case "!":
+		return comparisonPrecedence + 1
+	}
+	return comparisonPrecedence
 }
 
 type RepeatStatement struct {
-	Count int
+	Count Node       // evaluated once when the loop starts
+	While *Condition // optional guard checked before every iteration
 	Body  []Node
 }
 
 func (r *RepeatStatement) String() string {
-	return fmt.Sprintf("repeat %d { ... }", r.Count)
+	if r.While != nil {
+		return fmt.Sprintf("repeat %s while %s { ... }", r.Count.String(), r.While.String())
+	}
+	return fmt.Sprintf("repeat %s { ... }", r.Count.String())
+}
+
+// WhileStatement runs Body for as long as Condition holds, which is checked
+// before every iteration.
+type WhileStatement struct {
+	Condition *Condition
+	Body      []Node
+}
+
+func (w *WhileStatement) String() string {
+	return fmt.Sprintf("while %s { ... }", w.Condition.String())
+}
+
+// ForStatement runs Body once per element of Iterable. With two loop
+// variables, Index is bound to the zero-based position and Var to the
+// element; with one, only Var is bound.
+type ForStatement struct {
+	Index    string // optional
+	Var      string
+	Iterable Node
+	Body     []Node
+}
+
+func (f *ForStatement) String() string {
+	vars := f.Var
+	if f.Index != "" {
+		vars = f.Index + ", " + f.Var
+	}
+	return fmt.Sprintf("for %s in %s { ... }", vars, f.Iterable.String())
+}
+
+type GroupBlock struct {
+	Name string
+	Body []Node
+}
+
+func (g *GroupBlock) String() string {
+	return fmt.Sprintf("group %s { ... }", quoteLiteral(g.Name))
+}
+
+// SetupBlock is a named build phase that only runs when invoked with run.
+type SetupBlock struct {
+	Name string
+	Body []Node
+}
+
+func (s *SetupBlock) String() string {
+	return fmt.Sprintf("setup %s { ... }", quoteLiteral(s.Name))
+}
+
+type RunStatement struct {
+	Name string
+}
+
+func (r *RunStatement) String() string {
+	return fmt.Sprintf("run %s", quoteLiteral(r.Name))
+}
+
+// RequireStatement lists variables that must be set (and not empty) after
+// the first pass; the run is aborted before any step otherwise.
+type RequireStatement struct {
+	Names []string
+}
+
+func (r *RequireStatement) String() string {
+	return fmt.Sprintf("require [%s]", strings.Join(r.Names, ", "))
+}
+
+// RefineStatement asks Claude repeatedly until Until holds or Max attempts
+// have been made. Each response is stored in the response variable, so the
+// instruction and the condition can refer to it.
+type RefineStatement struct {
+	Ask   *AskStatement
+	Until *Condition
+	Max   int
+}
+
+func (r *RefineStatement) String() string {
+	return fmt.Sprintf("refine%s until %s max %d", strings.TrimPrefix(r.Ask.String(), "ask"), r.Until.String(), r.Max)
 }
 
+// BeforeBlock holds the pre-hooks. With Each set it is a "before each"
+// block inside a repeat or for body and runs before every iteration. When
+// is an optional condition, checked when the hooks run.
 type BeforeBlock struct {
+	Each       bool
+	When       *Condition
 	Statements []Node
 }
 
 func (b *BeforeBlock) String() string {
-	return "before { ... }"
+	return "before" + hookModifiers(b.Each, b.When) + " { ... }"
 }
 
+// AfterBlock holds the post-hooks. With Each set it is an "after each"
+// block inside a repeat or for body and runs after every iteration. When
+// is an optional condition, checked when the hooks run.
 type AfterBlock struct {
+	Each       bool
+	When       *Condition
 	Statements []Node
 }
 
 func (a *AfterBlock) String() string {
-	return "after { ... }"
+	return "after" + hookModifiers(a.Each, a.When) + " { ... }"
+}
+
+func hookModifiers(each bool, when *Condition) string {
+	var mods string
+	if each {
+		mods += " each"
+	}
+	if when != nil {
+		mods += " when " + when.String()
+	}
+	return mods
+}
+
+// guardHooks returns the statements of a hook block, wrapped in an if
+// statement when the block has a when condition.
+func guardHooks(when *Condition, statements []Node) []Node {
+	if when == nil {
+		return statements
+	}
+	return []Node{&IfStatement{Condition: when, Consequence: statements}}
 }
 
 type ShellCommand struct {
 	Command string
+	Timeout Node // optional per-step timeout modifier
+	Retries Node // optional number of retries, overriding --retries
 }
 
 func (s *ShellCommand) String() string {
-	return fmt.Sprintf("shell \"%s\"", s.Command)
+	return fmt.Sprintf("shell %s%s%s", quoteLiteral(s.Command), formatModifier("timeout", s.Timeout), formatModifier("retries", s.Retries))
 }
 
 type MCPCall struct {
 	Service string
 	Method  string
-	Arg     string
+	Args    []string        // positional arguments, as in fs.copy "src" "dst"
+	Named   map[string]Node // named arguments, as in fs.write path="a.go"
+}
+
+// Arg returns the first argument, which is all most methods take.
+func (m *MCPCall) Arg() string {
+	if len(m.Args) == 0 {
+		return ""
+	}
+	return m.Args[0]
 }
 
 func (m *MCPCall) String() string {
-	if m.Arg != "" {
-		return fmt.Sprintf("%s.%s \"%s\"", m.Service, m.Method, m.Arg)
+	out := m.Service + "." + m.Method
+	for _, arg := range m.Args {
+		out += " " + quoteLiteral(arg)
+	}
+	for _, key := range sortedKeys(m.Named) {
+		out += " " + key + "=" + m.Named[key].String()
 	}
-	return fmt.Sprintf("%s.%s", m.Service, m.Method)
+	return out
+}
+
+// sortedKeys returns the keys of m in order, for stable output.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 type IncrementDecrement struct {
@@ -469,36 +1168,205 @@ func (i *IncrementDecrement) String() string {
 	return fmt.Sprintf("%s%s", i.Name, i.Operator)
 }
 
+// CompoundAssignment applies an arithmetic operator to a numeric variable
+// in place, as in "count += 5".
+type CompoundAssignment struct {
+	Name     string
+	Operator string // +=, -=, *= or /=
+	Value    Node
+}
+
+func (c *CompoundAssignment) String() string {
+	return fmt.Sprintf("%s %s %s", c.Name, c.Operator, c.Value.String())
+}
+
+// BreakStatement leaves the innermost repeat, while or for loop.
+type BreakStatement struct{}
+
+func (b *BreakStatement) String() string {
+	return "break"
+}
+
+// ContinueStatement skips to the next iteration of the innermost loop.
+type ContinueStatement struct{}
+
+func (c *ContinueStatement) String() string {
+	return "continue"
+}
+
 // ============================================================================
-// PARSER
+// ERRORS
 // ============================================================================
 
-type Parser struct {
-	lexer     *Lexer
-	curToken  Token
-	peekToken Token
-	errors    []string
+// ParseError is a syntax error at a position in the source.
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
 }
 
-func NewParser(l *Lexer) *Parser {
-	p := &Parser{lexer: l}
-	p.nextToken()
-	p.nextToken()
-	return p
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
 }
 
-func (p *Parser) nextToken() {
-	p.curToken = p.peekToken
-	p.peekToken = p.lexer.NextToken()
+// ParseErrorList holds every syntax error found in a source. errors.As
+// finds the individual *ParseError values through it.
+type ParseErrorList []*ParseError
+
+func (l ParseErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for idx, e := range l {
+		msgs[idx] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
 }
 
-func (p *Parser) skipNewlines() {
-	for p.curToken.Type == TOKEN_NEWLINE {
-		p.nextToken()
+func (l ParseErrorList) Unwrap() []error {
+	errs := make([]error, len(l))
+	for idx, e := range l {
+		errs[idx] = e
 	}
+	return errs
 }
 
-func (p *Parser) Parse() *Program {
+// ExecError is the failure of one ask, shell or MCP step. Its message is
+// the message of the underlying cause.
+type ExecError struct {
+	Step int    // index of the step, as in StepRecord
+	Kind string // ask, shell or mcp
+	Err  error
+}
+
+func (e *ExecError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError reports that a step, or the whole run when Step is empty,
+// ran out of time. It matches context.DeadlineExceeded with errors.Is.
+type TimeoutError struct {
+	Step  string // what timed out, such as "shell command"
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Step == "" {
+		return fmt.Sprintf("deadline of %s exceeded", e.Limit)
+	}
+	return fmt.Sprintf("%s timed out after %s", e.Step, e.Limit)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Exit statuses of the CLI.
+const (
+	exitFailure = 1   // a step or hook failed
+	exitParse   = 2   // the script has syntax errors
+	exitTimeout = 124 // a step or the run timed out, as with timeout(1)
+)
+
+// exitCode maps an error to the CLI exit status.
+func exitCode(err error) int {
+	var parseErr *ParseError
+	var timeoutErr *TimeoutError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &parseErr):
+		return exitParse
+	case errors.As(err, &timeoutErr):
+		return exitTimeout
+	}
+	return exitFailure
+}
+
+// ============================================================================
+// PARSER
+// ============================================================================
+
+type Parser struct {
+	lexer     *Lexer
+	curToken  Token
+	peekToken Token
+	errors    ParseErrorList
+	loopDepth int             // number of enclosing repeat/while/for bodies
+	positions map[Node]Token  // first token of every statement
+	setups    map[string]bool // setups defined so far, callable by bare name
+}
+
+func NewParser(l *Lexer) *Parser {
+	p := &Parser{lexer: l, positions: make(map[Node]Token), setups: make(map[string]bool)}
+	p.nextToken()
+	p.nextToken()
+	return p
+}
+
+func (p *Parser) nextToken() {
+	p.curToken = p.peekToken
+	p.peekToken = p.lexer.NextToken()
+	p.errors = append(p.errors, p.lexer.drainErrors()...)
+}
+
+// numberValue converts a number token, which may be a decimal, 0x, 0o or
+// 0b literal with _ digit separators. Malformed literals were already reported by the lexer.
+func (p *Parser) numberValue(tok Token) float64 {
+	lit := strings.ReplaceAll(tok.Literal, "_", "")
+	if len(lit) > 2 && lit[0] == '0' {
+		if _, ok := numberBases[unicode.ToLower(rune(lit[1]))]; ok {
+			n, err := strconv.ParseInt(strings.ToLower(lit[:2])+lit[2:], 0, 64)
+			if errors.Is(err, strconv.ErrRange) {
+				p.addError(tok, "number %s is out of range", lit)
+			}
+			return float64(n)
+		}
+	}
+	f, _ := strconv.ParseFloat(lit, 64)
+	return f
+}
+
+// Errors returns the syntax errors collected while parsing.
+func (p *Parser) Errors() []string {
+	msgs := make([]string, len(p.errors))
+	for idx, e := range p.errors {
+		msgs[idx] = e.Error()
+	}
+	return msgs
+}
+
+// ParseErrors returns the syntax errors collected while parsing, with
+// their positions.
+func (p *Parser) ParseErrors() ParseErrorList {
+	return p.errors
+}
+
+func (p *Parser) addError(tok Token, format string, args ...interface{}) {
+	p.errors = append(p.errors, &ParseError{Line: tok.Line, Column: tok.Column, Msg: fmt.Sprintf(format, args...)})
+}
+
+// describeToken names a token for an error message. Newlines and the end of
+// the file have no useful literal, so they are spelled out.
+func describeToken(tok Token) string {
+	switch tok.Type {
+	case TOKEN_NEWLINE:
+		return "end of line"
+	case TOKEN_EOF:
+		return "end of file"
+	}
+	return fmt.Sprintf("%q", tok.Literal)
+}
+
+func (p *Parser) skipNewlines() {
+	for p.curToken.Type == TOKEN_NEWLINE {
+		p.nextToken()
+	}
+}
+
+func (p *Parser) Parse() *Program {
 	program := &Program{}
 
 	for p.curToken.Type != TOKEN_EOF {
@@ -516,7 +1384,63 @@ func (p *Parser) Parse() *Program {
 	return program
 }
 
+// Positions returns the first token of every parsed statement, for tools
+// such as the linter that report problems by position.
+func (p *Parser) Positions() map[Node]Token {
+	return p.positions
+}
+
 func (p *Parser) parseStatement() Node {
+	tok := p.curToken
+	stmt := p.parseStatementNode()
+	if stmt != nil {
+		p.positions[stmt] = tok
+	}
+	return stmt
+}
+
+// statementKeywords are the words that start a statement only when they are
+// not assigned to. The lexer reads them as identifiers, so scripts that used
+// them as variable names before they became keywords keep working.
+var statementKeywords = map[string]TokenType{
+	"while":    TOKEN_WHILE,
+	"for":      TOKEN_FOR,
+	"foreach":  TOKEN_FOREACH,
+	"prompt":   TOKEN_PROMPT,
+	"group":    TOKEN_GROUP,
+	"setup":    TOKEN_SETUP,
+	"define":   TOKEN_DEFINE,
+	"run":      TOKEN_RUN,
+	"use":      TOKEN_USE,
+	"require":  TOKEN_REQUIRE,
+	"refine":   TOKEN_REFINE,
+	"break":    TOKEN_BREAK,
+	"continue": TOKEN_CONTINUE,
+}
+
+// atWord reports whether the current token is the bare word word, for
+// keywords that only mean something at one place in a statement, such as
+// the "while" of a repeat loop.
+func (p *Parser) atWord(word string) bool {
+	return p.curToken.Type == TOKEN_IDENTIFIER && p.curToken.Literal == word
+}
+
+// assignsTo reports whether tok, following a name, makes the statement an
+// assignment to that name.
+func assignsTo(tok Token) bool {
+	_, compound := compoundOperators[tok.Type]
+	switch tok.Type {
+	case TOKEN_ASSIGN, TOKEN_COMMA, TOKEN_PLUSPLUS, TOKEN_MINUSMINUS:
+		return true
+	}
+	return compound
+}
+
+func (p *Parser) parseStatementNode() Node {
+	if keyword, ok := statementKeywords[p.curToken.Literal]; ok && p.curToken.Type == TOKEN_IDENTIFIER && !assignsTo(p.peekToken) {
+		p.curToken.Type = keyword
+	}
+
 	switch p.curToken.Type {
 	case TOKEN_ASK:
 		return p.parseAskStatement()
@@ -524,23 +1448,62 @@ func (p *Parser) parseStatement() Node {
 		return p.parseIfStatement()
 	case TOKEN_REPEAT:
 		return p.parseRepeatStatement()
+	case TOKEN_WHILE:
+		return p.parseWhileStatement()
+	case TOKEN_FOR, TOKEN_FOREACH:
+		return p.parseForStatement()
 	case TOKEN_BEFORE:
 		return p.parseBeforeBlock()
 	case TOKEN_AFTER:
 		return p.parseAfterBlock()
 	case TOKEN_SHELL:
+		if p.peekToken.Type == TOKEN_DOT {
+			return p.parseMCPCall() // shell.run "..."
+		}
 		return p.parseShellCommand()
+	case TOKEN_PROMPT:
+		return p.parsePromptDefinition()
+	case TOKEN_GROUP:
+		return p.parseGroupBlock()
+	case TOKEN_SETUP, TOKEN_DEFINE:
+		return p.parseSetupBlock()
+	case TOKEN_REQUIRE:
+		return p.parseRequireStatement()
+	case TOKEN_REFINE:
+		return p.parseRefineStatement()
+	case TOKEN_RUN, TOKEN_USE:
+		return p.parseRunStatement()
+	case TOKEN_BREAK:
+		p.nextToken()
+		return &BreakStatement{}
+	case TOKEN_CONTINUE:
+		p.nextToken()
+		return &ContinueStatement{}
 	case TOKEN_IDENTIFIER:
 		// Could be assignment, MCP call, or increment/decrement
 		if p.peekToken.Type == TOKEN_ASSIGN {
 			return p.parseAssignment()
+		} else if p.peekToken.Type == TOKEN_COMMA {
+			return p.parseDestructuringAssignment()
 		} else if p.peekToken.Type == TOKEN_DOT {
 			return p.parseMCPCall()
 		} else if p.peekToken.Type == TOKEN_PLUSPLUS || p.peekToken.Type == TOKEN_MINUSMINUS {
 			return p.parseIncrementDecrement()
+		} else if _, ok := compoundOperators[p.peekToken.Type]; ok {
+			return p.parseCompoundAssignment()
+		} else if p.setups[p.curToken.Literal] && endsStatement(p.peekToken) {
+			// A defined setup alone on a line runs it, as with "use name"
+			stmt := &RunStatement{Name: p.curToken.Literal}
+			p.nextToken()
+			return stmt
 		}
 		return p.parseAssignment()
+	case TOKEN_ILLEGAL:
+		p.addError(p.curToken, "unexpected character %q", p.curToken.Literal)
+		p.nextToken()
+		return nil
 	default:
+		p.addError(p.curToken, "unexpected token %q", p.curToken.Literal)
 		p.nextToken()
 		return nil
 	}
@@ -558,33 +1521,213 @@ func (p *Parser) parseAssignment() *Assignment {
 	return &Assignment{Name: name, Value: value}
 }
 
+func (p *Parser) parseDestructuringAssignment() Node {
+	stmt := &DestructuringAssignment{}
+	for {
+		if p.curToken.Type != TOKEN_IDENTIFIER {
+			p.addError(p.curToken, "expected variable name in assignment, got %q", p.curToken.Literal)
+			return nil
+		}
+		stmt.Names = append(stmt.Names, p.curToken.Literal)
+		p.nextToken()
+
+		if p.curToken.Type != TOKEN_COMMA {
+			break
+		}
+		p.nextToken() // consume ,
+	}
+
+	if p.curToken.Type != TOKEN_ASSIGN {
+		p.addError(p.curToken, "expected '=' after %s", strings.Join(stmt.Names, ", "))
+		return nil
+	}
+	p.nextToken() // consume =
+
+	stmt.Value = p.parseValue()
+	return stmt
+}
+
+// parseValue parses a value with optional comparisons joined by "&&" or
+// "||", and an optional ternary. A comparison without "?" is returned as a
+// *Condition, which evaluates to a boolean and is what parseCondition expects.
 func (p *Parser) parseValue() Node {
+	start := p.curToken
+	left := p.parseOr()
+	if p.curToken.Type != TOKEN_QUESTION {
+		return left
+	}
+	p.nextToken() // consume ?
+	p.skipNewlines()
+	ternary := &TernaryExpression{Condition: p.truthCondition(start, left), Then: p.parseValue()}
+	p.skipNewlines()
+	if p.curToken.Type != TOKEN_COLON {
+		p.addError(p.curToken, "expected ':' in conditional expression")
+		ternary.Else = &StringLiteral{}
+		return ternary
+	}
+	p.nextToken() // consume :
+	p.skipNewlines()
+	ternary.Else = p.parseValue()
+	return ternary
+}
+
+// parseOr parses "a || b"; "&&" binds more tightly, so "a || b && c" is
+// "a || (b && c)".
+func (p *Parser) parseOr() Node {
+	start := p.curToken
+	left := p.parseAnd()
+	for p.curToken.Type == TOKEN_OR {
+		p.nextToken() // consume ||
+		p.skipNewlines()
+		right := p.curToken
+		left = &Condition{Left: p.truthCondition(start, left), Operator: "||", Right: p.truthCondition(right, p.parseAnd())}
+	}
+	return left
+}
+
+func (p *Parser) parseAnd() Node {
+	start := p.curToken
+	left := p.parseNot()
+	for p.curToken.Type == TOKEN_AND {
+		p.nextToken() // consume &&
+		p.skipNewlines()
+		right := p.curToken
+		left = &Condition{Left: p.truthCondition(start, left), Operator: "&&", Right: p.truthCondition(right, p.parseNot())}
+	}
+	return left
+}
+
+// parseNot parses "!" before a comparison, which it negates as a whole:
+// "!a == b" is "!(a == b)".
+func (p *Parser) parseNot() Node {
+	if p.curToken.Type != TOKEN_BANG {
+		return p.parseComparison()
+	}
+	p.nextToken() // consume !
+	start := p.curToken
+	return &Condition{Left: p.truthCondition(start, p.parseNot()), Operator: "!"}
+}
+
+func (p *Parser) parseComparison() Node {
+	left := p.parseSum()
+	if op, ok := compareOperators[p.curToken.Type]; ok {
+		p.nextToken() // consume operator
+		return &Condition{Left: left, Operator: op, Right: p.parseSum()}
+	}
+	return left
+}
+
+// truthCondition returns n, which started at tok, as a condition. A bare
+// value tests its truthiness, as in "when ci {". A bare shell command is
+// an error: its output would be tested, which is rarely what was meant.
+func (p *Parser) truthCondition(tok Token, n Node) *Condition {
+	switch n := n.(type) {
+	case *Condition:
+		return n
+	case *ShellCommand:
+		p.addError(tok, "a shell command as a condition tests its output; use shell %s succeeds to test its exit status", quoteLiteral(n.Command))
+	}
+	return &Condition{Left: n}
+}
+
+var compareOperators = map[TokenType]string{
+	TOKEN_EQ:  "==",
+	TOKEN_NEQ: "!=",
+	TOKEN_LT:  "<",
+	TOKEN_GT:  ">",
+	TOKEN_LTE: "<=",
+	TOKEN_GTE: ">=",
+}
+
+func (p *Parser) parseSum() Node {
+	left := p.parsePrimary()
+	for p.curToken.Type == TOKEN_PLUS {
+		op := p.curToken.Literal
+		p.nextToken() // consume operator
+		left = &BinaryExpression{Left: left, Operator: op, Right: p.parsePrimary()}
+	}
+	return left
+}
+
+func (p *Parser) parsePrimary() Node {
 	switch p.curToken.Type {
 	case TOKEN_STRING:
 		val := &StringLiteral{Value: p.curToken.Literal}
 		p.nextToken()
 		return val
 	case TOKEN_NUMBER:
-		num, _ := strconv.ParseFloat(p.curToken.Literal, 64)
-		val := &NumberLiteral{Value: num}
+		val := &NumberLiteral{Value: p.numberValue(p.curToken)}
 		p.nextToken()
 		return val
 	case TOKEN_BOOLEAN:
-		val := &BooleanLiteral{Value: p.curToken.Literal == "True"}
+		val := &BooleanLiteral{Value: p.curToken.Literal == "True" || p.curToken.Literal == "true"}
 		p.nextToken()
 		return val
 	case TOKEN_LBRACKET:
 		return p.parseList()
+	case TOKEN_LPAREN:
+		return p.parseGroupedValue()
+	case TOKEN_ASK:
+		return p.parseAskStatement()
+	case TOKEN_SHELL:
+		// The value is the command's output, or with succeeds whether it
+		// exited with status 0
+		cmd := p.parseShellCommand()
+		if !p.atWord("succeeds") {
+			return cmd
+		}
+		p.nextToken() // consume 'succeeds'
+		return &SucceedsExpression{Command: cmd}
 	case TOKEN_IDENTIFIER:
+		if p.peekToken.Type == TOKEN_LPAREN {
+			return p.parseIndexes(p.parseCallExpression())
+		}
 		val := &Identifier{Name: p.curToken.Literal}
 		p.nextToken()
-		return val
+		return p.parseIndexes(val)
 	default:
 		// Try to read as unquoted string until newline
 		return p.parseUnquotedString()
 	}
 }
 
+// parseIndexes parses any "[index]" following a variable or call.
+func (p *Parser) parseIndexes(target Node) Node {
+	for p.curToken.Type == TOKEN_LBRACKET {
+		p.nextToken() // consume [
+		expr := &IndexExpression{Target: target, Index: p.parseValue()}
+		if p.curToken.Type != TOKEN_RBRACKET {
+			p.addError(p.curToken, "expected ']' after index, got %s", describeToken(p.curToken))
+			return expr
+		}
+		p.nextToken() // consume ]
+		target = expr
+	}
+	return target
+}
+
+// parseGroupedValue parses "(" value ")". The parentheses only steer
+// parsing, so the inner node is returned as is.
+func (p *Parser) parseGroupedValue() Node {
+	open := p.curToken
+	p.nextToken() // consume (
+	p.skipNewlines()
+	if p.curToken.Type == TOKEN_RPAREN {
+		p.addError(open, "empty parentheses")
+		p.nextToken() // consume )
+		return &StringLiteral{}
+	}
+
+	inner := p.parseValue()
+	p.skipNewlines()
+	if p.curToken.Type != TOKEN_RPAREN {
+		p.addError(p.curToken, "expected ')' to close '(' at line %d, column %d, got %s", open.Line, open.Column, describeToken(p.curToken))
+		return inner
+	}
+	p.nextToken() // consume )
+	return inner
+}
+
 func (p *Parser) parseUnquotedString() Node {
 	// For unquoted values like: victim = web-fullstack
 	if p.curToken.Type == TOKEN_IDENTIFIER {
@@ -592,90 +1735,236 @@ func (p *Parser) parseUnquotedString() Node {
 		p.nextToken()
 		return val
 	}
+	p.addError(p.curToken, "expected a value, got %s", describeToken(p.curToken))
 	return &StringLiteral{Value: ""}
 }
 
-func (p *Parser) parseList() *ListLiteral {
+func (p *Parser) parseCallExpression() Node {
+	call := &CallExpression{Function: p.curToken.Literal}
+	p.nextToken() // consume function name
+	p.nextToken() // consume (
+
+	for p.curToken.Type != TOKEN_RPAREN && p.curToken.Type != TOKEN_EOF {
+		p.skipNewlines()
+		call.Args = append(call.Args, p.parseValue())
+
+		p.skipNewlines()
+		if p.curToken.Type != TOKEN_COMMA {
+			break
+		}
+		p.nextToken() // consume ,
+		p.skipNewlines()
+	}
+
+	if p.curToken.Type != TOKEN_RPAREN {
+		p.addError(p.curToken, "expected ')' to close call to %s", call.Function)
+		return call
+	}
+	p.nextToken() // consume )
+
+	return call
+}
+
+func (p *Parser) parseList() Node {
 	list := &ListLiteral{}
 	p.nextToken() // consume [
 
 	for p.curToken.Type != TOKEN_RBRACKET && p.curToken.Type != TOKEN_EOF {
 		p.skipNewlines()
 		elem := p.parseValue()
+		p.skipNewlines()
+		if p.atWord("for") && len(list.Elements) == 0 {
+			return p.parseListComprehension(elem)
+		}
 		list.Elements = append(list.Elements, elem)
 
-		if p.curToken.Type == TOKEN_COMMA {
-			p.nextToken()
+		if p.curToken.Type != TOKEN_COMMA {
+			break
 		}
+		p.nextToken() // consume ,
 		p.skipNewlines()
 	}
 
-	if p.curToken.Type == TOKEN_RBRACKET {
-		p.nextToken()
+	if p.curToken.Type != TOKEN_RBRACKET {
+		p.addError(p.curToken, "expected ']' to close list, got %s", describeToken(p.curToken))
+		return list
 	}
+	p.nextToken() // consume ]
 
 	return list
 }
 
+// parseListComprehension parses the remainder of "[expr for x in list if cond]"
+// once expr has been read.
+func (p *Parser) parseListComprehension(expr Node) Node {
+	p.nextToken() // consume 'for'
+	p.skipNewlines()
+
+	if p.curToken.Type != TOKEN_IDENTIFIER {
+		p.addError(p.curToken, "expected loop variable after 'for'")
+		return expr
+	}
+	comp := &ListComprehension{Expr: expr, Var: p.curToken.Literal}
+	p.nextToken()
+
+	if !p.atWord("in") {
+		p.addError(p.curToken, "expected 'in' after loop variable %s", comp.Var)
+		return comp
+	}
+	p.nextToken() // consume 'in'
+	comp.Iterable = p.parseValue()
+
+	p.skipNewlines()
+	if p.curToken.Type == TOKEN_IF {
+		p.nextToken() // consume 'if'
+		comp.Filter = p.parseCondition()
+	}
+
+	p.skipNewlines()
+	if p.curToken.Type != TOKEN_RBRACKET {
+		p.addError(p.curToken, "expected ']' to close list comprehension")
+		return comp
+	}
+	p.nextToken() // consume ]
+	return comp
+}
+
 func (p *Parser) parseAskStatement() *AskStatement {
+	keyword := p.curToken.Literal
 	p.nextToken() // consume 'ask'
 
-	if p.curToken.Type != TOKEN_STRING {
-		return &AskStatement{Instruction: ""}
+	stmt := &AskStatement{}
+	switch p.curToken.Type {
+	case TOKEN_IDENTIFIER:
+		stmt.PromptRef = p.curToken.Literal
+	case TOKEN_FILEREF:
+		if p.curToken.Literal == "" {
+			p.addError(p.curToken, "expected a file path after '@'")
+		}
+		stmt.PromptFile = p.curToken.Literal
+	case TOKEN_STRING:
+		stmt.Instruction = p.curToken.Literal
+	default:
+		p.addError(p.curToken, "expected an instruction after '%s', got %s", keyword, describeToken(p.curToken))
+		return stmt
 	}
-
-	stmt := &AskStatement{Instruction: p.curToken.Literal}
 	p.nextToken()
+
+	mods := p.parseModifiers("timeout", "tools", "model", "kind", "retries")
+	stmt.Timeout = mods["timeout"]
+	stmt.Tools = mods["tools"]
+	stmt.Model = mods["model"]
+	stmt.Kind = mods["kind"]
+	stmt.Retries = mods["retries"]
+
+	// Optional post-condition, as in: then assert fs.exists "main.go"
+	if p.atWord("then") {
+		p.nextToken() // consume 'then'
+		if !p.atWord("assert") {
+			p.addError(p.curToken, "expected 'assert' after 'then'")
+			return stmt
+		}
+		p.nextToken() // consume 'assert'
+		if p.curToken.Type == TOKEN_IDENTIFIER && p.peekToken.Type == TOKEN_DOT {
+			stmt.Assert = p.parseMCPCall()
+		} else {
+			stmt.Assert = p.parseCondition()
+		}
+	}
 	return stmt
 }
 
-func (p *Parser) parseIfStatement() *IfStatement {
-	p.nextToken() // consume 'if'
+// parseModifiers parses trailing key=value modifiers on a step, such as
+// timeout="5m". Only the keys listed in allowed are accepted.
+func (p *Parser) parseModifiers(allowed ...string) map[string]Node {
+	mods := make(map[string]Node)
+	for p.curToken.Type == TOKEN_IDENTIFIER && p.peekToken.Type == TOKEN_ASSIGN {
+		tok := p.curToken
+		p.nextToken() // consume key
+		p.nextToken() // consume =
+		value := p.parseValue()
+
+		known := false
+		for _, key := range allowed {
+			if key == tok.Literal {
+				known = true
+				break
+			}
+		}
+		if !known {
+			p.addError(tok, "unknown modifier %q", tok.Literal)
+			continue
+		}
+		mods[tok.Literal] = value
+	}
+	return mods
+}
+
+func (p *Parser) parsePromptDefinition() Node {
+	p.nextToken() // consume 'prompt'
 
-	condition := p.parseCondition()
+	if p.curToken.Type != TOKEN_IDENTIFIER {
+		p.addError(p.curToken, "expected prompt name after 'prompt'")
+		return nil
+	}
+	name := p.curToken.Literal
+	p.nextToken()
 
-	p.skipNewlines()
-	if p.curToken.Type != TOKEN_LBRACE {
+	if p.curToken.Type != TOKEN_ASSIGN {
+		p.addError(p.curToken, "expected '=' after prompt name %s", name)
 		return nil
 	}
-	p.nextToken() // consume {
+	p.nextToken() // consume =
 
-	var consequence []Node
-	for p.curToken.Type != TOKEN_RBRACE && p.curToken.Type != TOKEN_EOF {
-		p.skipNewlines()
-		if p.curToken.Type == TOKEN_RBRACE {
-			break
-		}
-		stmt := p.parseStatement()
-		if stmt != nil {
-			consequence = append(consequence, stmt)
-		}
+	if p.curToken.Type != TOKEN_STRING {
+		p.addError(p.curToken, "expected string for prompt %s", name)
+		return nil
 	}
+	def := &PromptDefinition{Name: name, Text: p.curToken.Literal}
+	p.nextToken()
+	return def
+}
 
-	if p.curToken.Type == TOKEN_RBRACE {
-		p.nextToken()
+func (p *Parser) parseIfStatement() Node {
+	keyword := p.curToken.Literal
+	p.nextToken() // consume 'if' or 'elif'
+
+	condition := p.parseCondition()
+
+	p.skipNewlines()
+	if p.curToken.Type != TOKEN_LBRACE {
+		p.addError(p.curToken, "expected '{' after %s condition, got %s", keyword, describeToken(p.curToken))
+		return nil
+	}
+	consequence, ok := p.parseBlock()
+	if !ok {
+		return nil
 	}
 
 	var alternative []Node
 	p.skipNewlines()
-	if p.curToken.Type == TOKEN_ELSE {
+	elseIf := p.curToken.Type == TOKEN_ELSE && p.peekToken.Type == TOKEN_IF
+	if elseIf {
+		p.nextToken() // consume 'else'; "else if" is the same as "elif"
+	}
+	if (p.atWord("elif") && !assignsTo(p.peekToken)) || elseIf {
+		// An elif chain is stored as a nested if in the alternative branch
+		tok := p.curToken
+		elif := p.parseIfStatement()
+		if elif == nil {
+			return nil
+		}
+		p.positions[elif] = tok
+		alternative = []Node{elif}
+	} else if p.curToken.Type == TOKEN_ELSE {
 		p.nextToken() // consume 'else'
 		p.skipNewlines()
-		if p.curToken.Type == TOKEN_LBRACE {
-			p.nextToken() // consume {
-			for p.curToken.Type != TOKEN_RBRACE && p.curToken.Type != TOKEN_EOF {
-				p.skipNewlines()
-				if p.curToken.Type == TOKEN_RBRACE {
-					break
-				}
-				stmt := p.parseStatement()
-				if stmt != nil {
-					alternative = append(alternative, stmt)
-				}
-			}
-			if p.curToken.Type == TOKEN_RBRACE {
-				p.nextToken()
-			}
+		if p.curToken.Type != TOKEN_LBRACE {
+			p.addError(p.curToken, "expected '{' after else, got %s", describeToken(p.curToken))
+			return nil
+		}
+		if alternative, ok = p.parseBlock(); !ok {
+			return nil
 		}
 	}
 
@@ -687,79 +1976,125 @@ func (p *Parser) parseIfStatement() *IfStatement {
 }
 
 func (p *Parser) parseCondition() *Condition {
+	start := p.curToken
 	left := p.parseValue()
+	if p.curToken.Type == TOKEN_RPAREN {
+		p.addError(p.curToken, "unexpected ')' without a matching '('")
+		p.nextToken() // consume )
+	}
+	// A bare value, as in "when ci {", tests its truthiness
+	return p.truthCondition(start, left)
+}
+
+func (p *Parser) parseRepeatStatement() Node {
+	p.nextToken() // consume 'repeat'
 
-	var operator string
+	var count Node = &NumberLiteral{Value: 1}
 	switch p.curToken.Type {
-	case TOKEN_EQ:
-		operator = "=="
-	case TOKEN_NEQ:
-		operator = "!="
-	case TOKEN_LT:
-		operator = "<"
-	case TOKEN_GT:
-		operator = ">"
-	case TOKEN_LTE:
-		operator = "<="
-	case TOKEN_GTE:
-		operator = ">="
+	case TOKEN_LBRACE, TOKEN_NEWLINE, TOKEN_EOF:
 	default:
-		operator = "=="
+		if !p.atWord("while") {
+			count = p.parseSum()
+		}
+	}
+
+	var guard *Condition
+	if p.atWord("while") {
+		p.nextToken() // consume 'while'
+		guard = p.parseCondition()
+	}
+
+	p.skipNewlines()
+	if p.curToken.Type != TOKEN_LBRACE {
+		p.addError(p.curToken, "expected '{' after repeat, got %s", describeToken(p.curToken))
+		return nil
 	}
-	p.nextToken()
 
-	right := p.parseValue()
+	p.loopDepth++
+	body, ok := p.parseBlock()
+	p.loopDepth--
+	if !ok {
+		return nil
+	}
 
-	return &Condition{Left: left, Operator: operator, Right: right}
+	return &RepeatStatement{Count: count, While: guard, Body: body}
 }
 
-func (p *Parser) parseRepeatStatement() *RepeatStatement {
-	p.nextToken() // consume 'repeat'
+func (p *Parser) parseWhileStatement() Node {
+	p.nextToken() // consume 'while'
 
-	count := 1
-	if p.curToken.Type == TOKEN_NUMBER {
-		count, _ = strconv.Atoi(p.curToken.Literal)
-		p.nextToken()
-	}
+	condition := p.parseCondition()
 
 	p.skipNewlines()
 	if p.curToken.Type != TOKEN_LBRACE {
+		p.addError(p.curToken, "expected '{' after while condition, got %s", describeToken(p.curToken))
 		return nil
 	}
-	p.nextToken() // consume {
 
-	var body []Node
-	for p.curToken.Type != TOKEN_RBRACE && p.curToken.Type != TOKEN_EOF {
-		p.skipNewlines()
-		if p.curToken.Type == TOKEN_RBRACE {
-			break
+	p.loopDepth++
+	body, ok := p.parseBlock()
+	p.loopDepth--
+	if !ok {
+		return nil
+	}
+	return &WhileStatement{Condition: condition, Body: body}
+}
+
+// parseForStatement parses "for" and its alias "foreach".
+func (p *Parser) parseForStatement() Node {
+	keyword := p.curToken.Literal
+	p.nextToken() // consume 'for'
+
+	var names []string
+	for {
+		if p.curToken.Type != TOKEN_IDENTIFIER {
+			p.addError(p.curToken, "expected loop variable after '%s'", keyword)
+			return nil
 		}
-		stmt := p.parseStatement()
-		if stmt != nil {
-			body = append(body, stmt)
+		names = append(names, p.curToken.Literal)
+		p.nextToken()
+		if p.curToken.Type != TOKEN_COMMA || len(names) == 2 {
+			break
 		}
+		p.nextToken() // consume ,
 	}
 
-	if p.curToken.Type == TOKEN_RBRACE {
-		p.nextToken()
+	stmt := &ForStatement{Var: names[len(names)-1]}
+	if len(names) == 2 {
+		stmt.Index = names[0]
 	}
 
-	return &RepeatStatement{Count: count, Body: body}
-}
+	if !p.atWord("in") {
+		p.addError(p.curToken, "expected 'in' after loop variables")
+		return nil
+	}
+	p.nextToken() // consume 'in'
+	stmt.Iterable = p.parseValue()
 
-func (p *Parser) parseBeforeBlock() *BeforeBlock {
-	p.nextToken() // consume 'before'
 	p.skipNewlines()
+	p.loopDepth++
+	body, ok := p.parseBlock()
+	p.loopDepth--
+	if !ok {
+		return nil
+	}
+	stmt.Body = body
+	return stmt
+}
 
+// parseBlock parses a brace-delimited list of statements, starting at the
+// opening brace.
+func (p *Parser) parseBlock() ([]Node, bool) {
 	if p.curToken.Type != TOKEN_LBRACE {
-		return &BeforeBlock{}
+		p.addError(p.curToken, "expected '{', got %s", describeToken(p.curToken))
+		return nil, false
 	}
 	p.nextToken() // consume {
 
 	var statements []Node
 	for p.curToken.Type != TOKEN_RBRACE && p.curToken.Type != TOKEN_EOF {
 		p.skipNewlines()
-		if p.curToken.Type == TOKEN_RBRACE {
+		if p.curToken.Type == TOKEN_RBRACE || p.curToken.Type == TOKEN_EOF {
 			break
 		}
 		stmt := p.parseStatement()
@@ -768,50 +2103,230 @@ func (p *Parser) parseBeforeBlock() *BeforeBlock {
 		}
 	}
 
-	if p.curToken.Type == TOKEN_RBRACE {
-		p.nextToken()
+	if p.curToken.Type != TOKEN_RBRACE {
+		p.addError(p.curToken, "expected '}' before end of file")
+		return statements, false
 	}
+	p.nextToken() // consume }
 
-	return &BeforeBlock{Statements: statements}
+	return statements, true
 }
 
-func (p *Parser) parseAfterBlock() *AfterBlock {
-	p.nextToken() // consume 'after'
+func (p *Parser) parseGroupBlock() Node {
+	p.nextToken() // consume 'group'
+
+	if p.curToken.Type != TOKEN_STRING {
+		p.addError(p.curToken, "expected group name string after 'group'")
+		return nil
+	}
+	name := p.curToken.Literal
+	p.nextToken()
 	p.skipNewlines()
 
-	if p.curToken.Type != TOKEN_LBRACE {
-		return &AfterBlock{}
+	body, ok := p.parseBlock()
+	if !ok {
+		return nil
 	}
-	p.nextToken() // consume {
+	return &GroupBlock{Name: name, Body: body}
+}
 
-	var statements []Node
-	for p.curToken.Type != TOKEN_RBRACE && p.curToken.Type != TOKEN_EOF {
+// parseSetupBlock parses "setup" and its alias "define".
+func (p *Parser) parseSetupBlock() Node {
+	keyword := p.curToken.Literal
+	p.nextToken() // consume 'setup' or 'define'
+
+	name, ok := p.parseSetupName(keyword)
+	if !ok {
+		return nil
+	}
+	// Registered before the body so that a use of itself is reported as
+	// recursion rather than parsed as something else
+	p.setups[name] = true
+	p.skipNewlines()
+
+	body, ok := p.parseBlock()
+	if !ok {
+		return nil
+	}
+	return &SetupBlock{Name: name, Body: body}
+}
+
+// parseRunStatement parses "run" and its alias "use".
+func (p *Parser) parseRunStatement() Node {
+	keyword := p.curToken.Literal
+	p.nextToken() // consume 'run' or 'use'
+
+	name, ok := p.parseSetupName(keyword)
+	if !ok {
+		return nil
+	}
+	return &RunStatement{Name: name}
+}
+
+// parseSetupName parses the name after setup, define, run or use: a string
+// or a bare word, which may be a keyword as in "define setup".
+func (p *Parser) parseSetupName(keyword string) (string, bool) {
+	tok := p.curToken
+	if tok.Type != TOKEN_STRING && (tok.Literal == "" || lookupKeyword(tok.Literal) != tok.Type) {
+		p.addError(tok, "expected setup name after '%s', got %s", keyword, describeToken(tok))
+		return "", false
+	}
+	p.nextToken()
+	return tok.Literal, true
+}
+
+// endsStatement reports whether tok ends the statement before it.
+func endsStatement(tok Token) bool {
+	return tok.Type == TOKEN_NEWLINE || tok.Type == TOKEN_EOF || tok.Type == TOKEN_RBRACE
+}
+
+// parseRequireStatement parses "require [name, ...]" or "require name".
+// Names may be quoted or bare.
+func (p *Parser) parseRequireStatement() Node {
+	p.nextToken() // consume 'require'
+
+	stmt := &RequireStatement{}
+	bracketed := p.curToken.Type == TOKEN_LBRACKET
+	if bracketed {
+		p.nextToken() // consume [
+	}
+	for {
 		p.skipNewlines()
-		if p.curToken.Type == TOKEN_RBRACE {
+		if bracketed && p.curToken.Type == TOKEN_RBRACKET {
 			break
 		}
-		stmt := p.parseStatement()
-		if stmt != nil {
-			statements = append(statements, stmt)
+		if p.curToken.Type != TOKEN_STRING && p.curToken.Type != TOKEN_IDENTIFIER {
+			p.addError(p.curToken, "expected variable name in require, got %q", p.curToken.Literal)
+			return nil
 		}
+		stmt.Names = append(stmt.Names, p.curToken.Literal)
+		p.nextToken()
+		if !bracketed {
+			return stmt
+		}
+		p.skipNewlines()
+		if p.curToken.Type != TOKEN_COMMA {
+			break
+		}
+		p.nextToken() // consume ,
+	}
+
+	if p.curToken.Type != TOKEN_RBRACKET {
+		p.addError(p.curToken, "expected ']' to close require list")
+		return nil
+	}
+	p.nextToken() // consume ]
+	return stmt
+}
+
+// defaultRefineMax is the number of attempts a refine makes without max.
+const defaultRefineMax = 3
+
+func (p *Parser) parseRefineStatement() Node {
+	tok := p.curToken
+	ask := p.parseAskStatement() // consumes 'refine' like 'ask'
+	if ask.Instruction == "" && ask.PromptRef == "" && ask.PromptFile == "" {
+		return nil
 	}
 
-	if p.curToken.Type == TOKEN_RBRACE {
+	if !p.atWord("until") {
+		p.addError(p.curToken, "expected 'until' after refine instruction")
+		return nil
+	}
+	p.nextToken() // consume 'until'
+
+	// Parsed as a value so that a trailing "max" is not taken as the
+	// right-hand side of the condition
+	stmt := &RefineStatement{Ask: ask, Max: defaultRefineMax}
+	start := p.curToken
+	stmt.Until = p.truthCondition(start, p.parseValue())
+
+	if p.atWord("max") {
+		p.nextToken() // consume 'max'
+		if p.curToken.Type != TOKEN_NUMBER {
+			p.addError(p.curToken, "expected number of attempts after 'max'")
+			return nil
+		}
+		stmt.Max = int(p.numberValue(p.curToken))
 		p.nextToken()
+		if stmt.Max < 1 {
+			p.addError(tok, "refine needs at least one attempt")
+			return nil
+		}
+	}
+	return stmt
+}
+
+func (p *Parser) parseBeforeBlock() Node {
+	p.nextToken() // consume 'before'
+	each := p.parseEach("before")
+	when := p.parseWhen()
+	p.skipNewlines()
+
+	if p.curToken.Type != TOKEN_LBRACE {
+		p.addError(p.curToken, "expected '{' after before, got %s", describeToken(p.curToken))
+		return nil
+	}
+	statements, ok := p.parseBlock()
+	if !ok || (each && p.loopDepth == 0) {
+		return nil
+	}
+	return &BeforeBlock{Each: each, When: when, Statements: statements}
+}
+
+// parseWhen parses the optional "when <condition>" of a hook block.
+func (p *Parser) parseWhen() *Condition {
+	if !p.atWord("when") {
+		return nil
+	}
+	p.nextToken() // consume 'when'
+	return p.parseCondition()
+}
+
+// parseEach consumes the "each" of a "before each" or "after each" block
+// and reports whether it was present. Outside a loop body it is an error.
+func (p *Parser) parseEach(hook string) bool {
+	if !p.atWord("each") {
+		return false
 	}
+	if p.loopDepth == 0 {
+		p.addError(p.curToken, "'%s each' is only allowed inside a repeat, while or for body", hook)
+	}
+	p.nextToken() // consume 'each'
+	return true
+}
 
-	return &AfterBlock{Statements: statements}
+func (p *Parser) parseAfterBlock() Node {
+	p.nextToken() // consume 'after'
+	each := p.parseEach("after")
+	when := p.parseWhen()
+	p.skipNewlines()
+
+	if p.curToken.Type != TOKEN_LBRACE {
+		p.addError(p.curToken, "expected '{' after after, got %s", describeToken(p.curToken))
+		return nil
+	}
+	statements, ok := p.parseBlock()
+	if !ok || (each && p.loopDepth == 0) {
+		return nil
+	}
+	return &AfterBlock{Each: each, When: when, Statements: statements}
 }
 
 func (p *Parser) parseShellCommand() *ShellCommand {
 	p.nextToken() // consume 'shell'
 
 	if p.curToken.Type != TOKEN_STRING {
+		p.addError(p.curToken, "expected a command string after 'shell', got %s", describeToken(p.curToken))
 		return &ShellCommand{Command: ""}
 	}
 
 	cmd := &ShellCommand{Command: p.curToken.Literal}
 	p.nextToken()
+
+	mods := p.parseModifiers("timeout", "retries")
+	cmd.Timeout = mods["timeout"]
+	cmd.Retries = mods["retries"]
 	return cmd
 }
 
@@ -820,16 +2335,62 @@ func (p *Parser) parseMCPCall() *MCPCall {
 	p.nextToken() // consume service name
 	p.nextToken() // consume .
 
+	// Method names may be keywords, as in shell.run
+	if lookupKeyword(p.curToken.Literal) != p.curToken.Type {
+		p.addError(p.curToken, "expected a method name after '%s.', got %s", service, describeToken(p.curToken))
+		return &MCPCall{Service: service}
+	}
 	method := p.curToken.Literal
 	p.nextToken() // consume method name
 
-	var arg string
-	if p.curToken.Type == TOKEN_STRING {
-		arg = p.curToken.Literal
+	// Arguments are separated by spaces or commas; numbers are passed as text
+	call := &MCPCall{Service: service, Method: method}
+	for p.curToken.Type == TOKEN_STRING || p.curToken.Type == TOKEN_NUMBER {
+		if p.curToken.Type == TOKEN_NUMBER {
+			call.Args = append(call.Args, toString(p.numberValue(p.curToken)))
+		} else {
+			call.Args = append(call.Args, p.curToken.Literal)
+		}
 		p.nextToken()
+		if p.curToken.Type == TOKEN_COMMA {
+			p.nextToken() // consume ,
+			if p.curToken.Type != TOKEN_STRING && p.curToken.Type != TOKEN_NUMBER {
+				p.addError(p.curToken, "expected an argument after ',', got %s", describeToken(p.curToken))
+			}
+		}
+	}
+
+	// Named arguments follow, as in: fs.write path="a.go" content=src
+	for p.curToken.Type == TOKEN_IDENTIFIER && p.peekToken.Type == TOKEN_ASSIGN {
+		tok := p.curToken
+		p.nextToken() // consume key
+		p.nextToken() // consume =
+		if call.Named == nil {
+			call.Named = make(map[string]Node)
+		}
+		if _, dup := call.Named[tok.Literal]; dup {
+			p.addError(tok, "duplicate argument %s", tok.Literal)
+		}
+		call.Named[tok.Literal] = p.parseValue()
 	}
+	return call
+}
+
+var compoundOperators = map[TokenType]string{
+	TOKEN_PLUSEQ:  "+=",
+	TOKEN_MINUSEQ: "-=",
+	TOKEN_STAREQ:  "*=",
+	TOKEN_SLASHEQ: "/=",
+}
+
+func (p *Parser) parseCompoundAssignment() Node {
+	name := p.curToken.Literal
+	p.nextToken() // consume identifier
+
+	op := compoundOperators[p.curToken.Type]
+	p.nextToken() // consume operator
 
-	return &MCPCall{Service: service, Method: method, Arg: arg}
+	return &CompoundAssignment{Name: name, Operator: op, Value: p.parseValue()}
 }
 
 func (p *Parser) parseIncrementDecrement() *IncrementDecrement {
@@ -848,25 +2409,108 @@ func (p *Parser) parseIncrementDecrement() *IncrementDecrement {
 
 type Interpreter struct {
 	variables       map[string]interface{}
+	prompts         map[string]string
+	setups          map[string][]Node
+	runningSetups   map[string]bool
+	overlaid        map[string]interface{} // values set by --profile-file, which the script's top level cannot change
 	beforeHooks     []Node
 	afterHooks      []Node
 	claudeCLI       string
 	dryRun          bool
+	dryRunFS        bool
+	previewLimit    int    // characters of a prompt or argument shown in dry-run; 0 for all
+	maxOutputBytes  int    // cap on captured output; 0 for no limit
+	maxIterations   int    // iterations a while loop may run before failing
+	baseDir         string // directory of the script, for relative file references
+	workDir         string // directory steps run in (--workdir); overrides the workdir variable
+	overlays        []Node // assignments from --profile-file, applied after the first pass
+	asciiSymbols    bool
+	fullContext     bool
+	expandEnv       bool             // expand $NAME environment variables in fs.* paths
+	blankUnknown    bool             // interpolate unknown ${name} as "" instead of keeping it
+	maxHistory      int              // prior asks kept for session continuity; 0 disables it
+	history         []promptExchange // the last maxHistory asks, oldest first
+	retryBudget     int              // Claude retries left for the whole run; -1 for none
+	approve         bool
+	approveInput    *bufio.Reader
+	approveTTY      bool // approveInput is a terminal that can answer prompts
+	approveDefault  bool // answer used when approveInput is not a terminal
 	verbose         bool
 	skipPermissions bool
 	model           string
+	modelFor        map[string]string // step kind -> model
+	allowedTools    []string
+	claudeMode      string // "flags" (default) or "json"
+	onlyHooks       bool
+	beforeFailFast  bool
+	afterFailFast   bool
+	continueOnError bool // a failing shell step sets last_exit instead of stopping the run
+	skipHooks       bool
+	noHooksOnDryRun bool
+	profile         bool
+	profileTimes    map[string]time.Duration
+	groups          []string // names of the groups currently executing
+	deadline        time.Duration
+	shellTimeout    time.Duration // default limit for shell commands and shell.run; 0 for none
+	claudeTimeout   time.Duration // default limit for a Claude call; 0 for none
+	retries         int           // times a failing ask or shell step is retried
+	allowShell      bool
+	allowedCmds     []string // binaries shell commands may run; empty allows any
+	fake            bool
+	rng             *rand.Rand
+	dumpPrompts     bool
+	dumpedPrompts   []DumpedPrompt
+	steps           []StepRecord
+	envSecrets      []string          // values of sensitive environment variables, masked in the log
+	redactKey       string            // the secrets redactor was built for
+	redactor        *strings.Replacer // masks the current secrets; nil when there are none
+	events          io.Writer         // NDJSON event stream, nil when disabled
+	combineOutput   bool
+	stepOutput      *cappedBuffer // combined output of the running step
+	stepSkipped     bool          // the running step was declined and did not run
+	exitIsResult    bool          // a non-zero exit is the value of a succeeds check, not a failure
+	stepIndex       int           // index of the running step, 0 between steps
+	ctx             context.Context
 	outputWriter    io.Writer
 }
 
+// profileCategories lists the categories tracked by --profile, in the order
+// they are reported.
+var profileCategories = []string{"parse", "claude", "shell", "mcp"}
+
+// defaultMaxOutputBytes caps captured output at 1 MiB.
+const defaultMaxOutputBytes = 1 << 20
+
+// defaultClaudeTimeout is generous, since a single step may legitimately
+// take Claude several minutes.
+const defaultClaudeTimeout = 10 * time.Minute
+
+// defaultMaxIterations stops a while loop whose condition never turns false.
+const defaultMaxIterations = 10000
+
 func NewInterpreter() *Interpreter {
 	return &Interpreter{
 		variables:       make(map[string]interface{}),
-		skipPermissions: true,  // Default to fast mode
-		model:           "",    // Use default model
-		claudeCLI:    "claude",
-		dryRun:       false,
-		verbose:      true,
-		outputWriter: os.Stdout,
+		prompts:         make(map[string]string),
+		setups:          make(map[string][]Node),
+		runningSetups:   make(map[string]bool),
+		profileTimes:    make(map[string]time.Duration),
+		skipPermissions: true, // Default to fast mode
+		model:           "",   // Use default model
+		claudeCLI:       "claude",
+		claudeMode:      "flags",
+		retryBudget:     -1,
+		claudeTimeout:   defaultClaudeTimeout,
+		envSecrets:      sensitiveEnvValues(),
+		maxOutputBytes:  defaultMaxOutputBytes,
+		maxIterations:   defaultMaxIterations,
+		dryRun:          false,
+		verbose:         true,
+		ctx:             context.Background(),
+		allowShell:      true,
+		beforeFailFast:  true,
+		rng:             rand.New(rand.NewSource(time.Now().UnixNano())),
+		outputWriter:    os.Stdout,
 	}
 }
 
@@ -874,428 +2518,5158 @@ func (i *Interpreter) SetDryRun(dryRun bool) {
 	i.dryRun = dryRun
 }
 
-func (i *Interpreter) SetVerbose(verbose bool) {
-	i.verbose = verbose
+// SetDryRunTruncate shortens prompts and MCP arguments printed in dry-run
+// to n characters. By default they are printed in full.
+func (i *Interpreter) SetDryRunTruncate(n int) {
+	i.previewLimit = n
 }
 
-func (i *Interpreter) SetClaudeCLI(path string) {
-	i.claudeCLI = path
+// preview returns s as printed in dry-run, shortened when SetDryRunTruncate
+// set a limit.
+func (i *Interpreter) preview(s string) string {
+	if i.previewLimit > 0 {
+		return truncateString(s, i.previewLimit)
+	}
+	return s
 }
 
-func (i *Interpreter) SetSkipPermissions(skip bool) {
-	i.skipPermissions = skip
+// SetDryRunFS makes fs.write and fs.append print a unified diff against
+// the current file contents instead of writing. It also applies in dry-run.
+func (i *Interpreter) SetDryRunFS(dryRunFS bool) {
+	i.dryRunFS = dryRunFS
 }
 
-func (i *Interpreter) SetModel(model string) {
-	i.model = model
+// ImportEnv loads every environment variable starting with prefix as a
+// script variable named by the rest of the key in lower case, so with
+// prefix "VIBE_" VIBE_PROJECT becomes project. Numbers and booleans are
+// converted; everything else stays a string. Assignments in the script
+// are applied afterwards and take precedence. It returns the number of
+// variables imported.
+func (i *Interpreter) ImportEnv(prefix string) int {
+	count := 0
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, prefix)
+		if !ok || name == "" {
+			continue
+		}
+		i.variables[strings.ToLower(name)] = inferEnvValue(value)
+		count++
+	}
+	return count
 }
 
-func (i *Interpreter) log(format string, args ...interface{}) {
-	if i.verbose {
-		fmt.Fprintf(i.outputWriter, format+"\n", args...)
+// inferEnvValue converts an environment value to a bool or number when it
+// reads as one.
+func inferEnvValue(value string) interface{} {
+	switch value {
+	case "true", "True":
+		return true
+	case "false", "False":
+		return false
 	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+	return value
 }
 
-func (i *Interpreter) Execute(program *Program) error {
-	// First pass: collect variables and hooks
-	for _, stmt := range program.Statements {
-		switch s := stmt.(type) {
-		case *Assignment:
-			i.variables[s.Name] = i.evalValue(s.Value)
-		case *BeforeBlock:
-			i.beforeHooks = append(i.beforeHooks, s.Statements...)
-		case *AfterBlock:
-			i.afterHooks = append(i.afterHooks, s.Statements...)
+// SetWorkDir runs shell commands, shell.run and Claude in dir and resolves
+// relative fs.* paths against it, instead of the current directory. It
+// takes precedence over a workdir assignment in the script.
+func (i *Interpreter) SetWorkDir(dir string) {
+	i.workDir = dir
+}
+
+// workDirName returns the directory steps run in: --workdir, else the
+// script's workdir variable, else "" for the current directory.
+func (i *Interpreter) workDirName() string {
+	if i.workDir != "" {
+		return i.workDir
+	}
+	if dir, ok := i.variables["workdir"]; ok {
+		return toString(dir)
+	}
+	return ""
+}
+
+// ensureWorkDir returns the working directory for a step, creating it when
+// it does not exist yet. Dry and fake runs do not create it.
+func (i *Interpreter) ensureWorkDir() (string, error) {
+	dir := i.workDirName()
+	if dir == "" || i.dryRun || i.fake {
+		return dir, nil
+	}
+	info, err := os.Stat(dir)
+	switch {
+	case err == nil && !info.IsDir():
+		return "", fmt.Errorf("workdir %s is not a directory", dir)
+	case errors.Is(err, os.ErrNotExist):
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("creating workdir: %w", err)
 		}
+		i.log("  ✓ Created working directory: %s", dir)
+	case err != nil:
+		return "", fmt.Errorf("workdir: %w", err)
 	}
+	return dir, nil
+}
 
-	i.log("╔════════════════════════════════════════════════════════════╗")
-	i.log("║              VIBE DSL Interpreter v1.0                     ║")
-	i.log("╚════════════════════════════════════════════════════════════╝")
-	i.log("")
-	i.log("Project: %v", i.variables["project"])
-	i.log("Target:  %v", i.variables["victim"])
-	i.log("")
+// inWorkDir resolves a relative path against the working directory.
+func inWorkDir(dir, path string) string {
+	if dir == "" || path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
 
-	// Run before hooks
-	if len(i.beforeHooks) > 0 {
-		i.log("═══ Running Pre-Hooks ═══")
-		for _, hook := range i.beforeHooks {
-			if err := i.executeHook(hook); err != nil {
-				return fmt.Errorf("before hook failed: %w", err)
-			}
+// fsPath turns an fs.* path argument into the path to use: environment
+// variables are expanded (with --expand-env) and a relative result is
+// taken from the working directory.
+func (i *Interpreter) fsPath(dir, path string) (string, error) {
+	if i.expandEnv {
+		var err error
+		if path, err = expandEnvVars(path); err != nil {
+			return "", err
 		}
-		i.log("")
 	}
+	return inWorkDir(dir, path), nil
+}
 
-	// Second pass: execute statements
-	i.log("═══ Executing Build Steps ═══")
-	for _, stmt := range program.Statements {
-		if err := i.executeStatement(stmt); err != nil {
-			return err
+// expandEnvVars replaces $NAME with the value of the environment variable
+// NAME and $$ with a single $. An unset NAME is an error rather than an
+// empty string, which would turn $HOME/.config into /.config. Only the
+// unbraced form is expanded: ${name} is DSL interpolation, which has
+// already been applied, and any ${ left is literal text.
+func expandEnvVars(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var out strings.Builder
+	for pos := 0; pos < len(s); pos++ {
+		if s[pos] != '$' || pos+1 == len(s) {
+			out.WriteByte(s[pos])
+			continue
+		}
+		if s[pos+1] == '$' {
+			out.WriteByte('$')
+			pos++
+			continue
+		}
+		end := pos + 1
+		for end < len(s) && (isLetter(s[end]) || (end > pos+1 && isDigit(s[end]))) {
+			end++
+		}
+		if end == pos+1 {
+			out.WriteByte('$')
+			continue
+		}
+		name := s[pos+1 : end]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set (write $$%s for a literal $)", name, name)
 		}
+		out.WriteString(val)
+		pos = end - 1
 	}
+	return out.String(), nil
+}
 
-	// Run after hooks
-	if len(i.afterHooks) > 0 {
-		i.log("")
-		i.log("═══ Running Post-Hooks ═══")
-		for _, hook := range i.afterHooks {
-			if err := i.executeHook(hook); err != nil {
-				return fmt.Errorf("after hook failed: %w", err)
-			}
+// SetExpandEnv controls whether $NAME in fs.* paths is replaced by the
+// environment variable NAME. It is off by default, so a script cannot
+// read the environment unless asked to. Shell commands are unaffected:
+// the shell expands $NAME in them itself.
+func (i *Interpreter) SetExpandEnv(expand bool) {
+	i.expandEnv = expand
+}
+
+// SetRetryBudget caps the Claude retries of the whole run at n, shared by
+// every step. Retries follow the --retries policy (only non-zero exits and
+// timeouts, with backoff); an ask without retries of its own may use the
+// whole budget. Once it is spent a failing call is an error. -1 means no
+// budget.
+func (i *Interpreter) SetRetryBudget(n int) {
+	i.retryBudget = n
+}
+
+// SetInteractiveApprove asks for y/n confirmation on stdin before each
+// destructive action (see destructiveActions); everything else runs
+// without asking.
+func (i *Interpreter) SetInteractiveApprove(approve bool) {
+	i.approve = approve
+}
+
+// SetApproveInput sets where approval answers are read from. When
+// terminal is false nobody can answer and the approve default is used.
+func (i *Interpreter) SetApproveInput(r io.Reader, terminal bool) {
+	i.approveInput = bufio.NewReader(r)
+	i.approveTTY = terminal
+}
+
+// SetApproveDefault sets the answer used when approvals cannot be asked
+// for interactively. The default is to refuse.
+func (i *Interpreter) SetApproveDefault(yes bool) {
+	i.approveDefault = yes
+}
+
+// destructiveActions are the steps that need confirmation under
+// --interactive-approve.
+var destructiveActions = map[string]bool{
+	"shell":     true,
+	"shell.run": true,
+	"fs.write":  true,
+	"fs.append": true,
+	"fs.mkdir":  true,
+	"fs.copy":   true,
+	"fs.move":   true,
+}
+
+// approved reports whether action may run. Only destructive actions are
+// confirmed, and only when interactive approval is enabled.
+func (i *Interpreter) approved(action, detail string) bool {
+	if !i.approve || !destructiveActions[action] {
+		return true
+	}
+	if !i.approveTTY || i.approveInput == nil {
+		answer := "refused"
+		if i.approveDefault {
+			answer = "approved"
 		}
+		i.log("  ⚠ %s needs approval but stdin is not a terminal: %s", action, answer)
+		return i.approveDefault
 	}
 
-	i.log("")
-	i.log("═══ Build Complete ═══")
-	return nil
+	fmt.Fprintf(os.Stderr, "  ? Allow %s: %s [y/N] ", action, truncateString(detail, 60))
+	line, _ := i.approveInput.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
 }
 
-func (i *Interpreter) executeStatement(stmt Node) error {
-	switch s := stmt.(type) {
-	case *Assignment:
-		// Already processed in first pass
-		return nil
-	case *AskStatement:
-		return i.executeAsk(s)
-	case *IfStatement:
-		return i.executeIf(s)
-	case *RepeatStatement:
-		return i.executeRepeat(s)
-	case *ShellCommand:
-		return i.executeShell(s)
-	case *MCPCall:
-		return i.executeMCP(s)
-	case *IncrementDecrement:
-		return i.executeIncrementDecrement(s)
-	case *BeforeBlock, *AfterBlock:
-		// Already processed
-		return nil
+// SetOutput sets where log lines and the stdout of child processes go.
+func (i *Interpreter) SetOutput(w io.Writer) {
+	i.outputWriter = w
+}
+
+// SetModelFor maps the kind= tag of ask steps to models. Steps whose kind
+// is not in the map use the default model.
+func (i *Interpreter) SetModelFor(models map[string]string) {
+	i.modelFor = models
+}
+
+// SetFullContext appends every variable to each prompt as a JSON document.
+// Values of variables whose names look like secrets (token, password,
+// api_key, ...) are masked.
+func (i *Interpreter) SetFullContext(full bool) {
+	i.fullContext = full
+}
+
+// SetSymbols selects the glyphs used in log output: "unicode", "ascii",
+// or "auto" to use ASCII when the locale does not support UTF-8.
+func (i *Interpreter) SetSymbols(set string) error {
+	ascii, err := useASCII(set)
+	if err != nil {
+		return err
 	}
+	i.asciiSymbols = ascii
 	return nil
 }
 
-func (i *Interpreter) executeHook(hook Node) error {
-	switch h := hook.(type) {
-	case *ShellCommand:
-		return i.executeShell(h)
-	case *MCPCall:
-		return i.executeMCP(h)
+// SetUnknownVars selects what ${name} interpolates to when name is not a
+// variable: "keep" (the default) leaves the reference as written, "blank"
+// replaces it with an empty string.
+func (i *Interpreter) SetUnknownVars(mode string) error {
+	switch mode {
+	case "keep", "":
+		i.blankUnknown = false
+	case "blank":
+		i.blankUnknown = true
+	default:
+		return fmt.Errorf("unknown --unknown-vars mode %q (expected keep or blank)", mode)
 	}
 	return nil
 }
 
-func (i *Interpreter) evalValue(node Node) interface{} {
-	switch n := node.(type) {
-	case *StringLiteral:
-		return n.Value
-	case *NumberLiteral:
-		return n.Value
-	case *BooleanLiteral:
-		return n.Value
-	case *Identifier:
-		if val, ok := i.variables[n.Name]; ok {
-			return val
-		}
-		return n.Name
-	case *ListLiteral:
-		var result []interface{}
-		for _, elem := range n.Elements {
-			result = append(result, i.evalValue(elem))
+// SetBaseDir sets the directory that relative file references in the
+// script, such as ask @path, are resolved against.
+func (i *Interpreter) SetBaseDir(dir string) {
+	i.baseDir = dir
+}
+
+// LoadProfileFile reads a file of assignments that override the script's
+// top-level variables, such as a prod.vars for a production run. They are
+// applied after the script's own assignments, in the order files are
+// loaded, and may refer to the script's variables. Any other statement is
+// an error.
+func (i *Interpreter) LoadProfileFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	program, errs := i.parseSource(string(content))
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %w", path, errs)
+	}
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *Assignment:
+			if hasSideEffects(s.Value) {
+				return fmt.Errorf("%s: %s runs a step; profile values must be plain", path, s.Name)
+			}
+			i.overlays = append(i.overlays, s)
+		case *DestructuringAssignment:
+			if hasSideEffects(s.Value) {
+				return fmt.Errorf("%s: %s runs a step; profile values must be plain", path, strings.Join(s.Names, ", "))
+			}
+			i.overlays = append(i.overlays, s)
+		default:
+			return fmt.Errorf("%s: only assignments are allowed in a profile file, found %s", path, stmt.String())
 		}
-		return result
 	}
 	return nil
 }
 
-func (i *Interpreter) evalCondition(cond *Condition) bool {
-	left := i.evalValue(cond.Left)
-	right := i.evalValue(cond.Right)
+// promptExchange is one completed ask remembered for session continuity.
+type promptExchange struct {
+	Instruction string
+	Response    string // captured output; empty when the output was streamed
+}
 
-	switch cond.Operator {
-	case "==":
-		return fmt.Sprintf("%v", left) == fmt.Sprintf("%v", right)
-	case "!=":
-		return fmt.Sprintf("%v", left) != fmt.Sprintf("%v", right)
-	case "<":
-		return toFloat(left) < toFloat(right)
-	case ">":
-		return toFloat(left) > toFloat(right)
-	case "<=":
-		return toFloat(left) <= toFloat(right)
-	case ">=":
-		return toFloat(left) >= toFloat(right)
+// SetMaxPromptHistory turns on session continuity: each prompt lists the
+// last n completed asks, so Claude knows what earlier steps did. Older
+// asks are dropped once n are kept. Zero (the default) disables it.
+func (i *Interpreter) SetMaxPromptHistory(n int) {
+	i.maxHistory = n
+	if len(i.history) > n {
+		i.history = i.history[len(i.history)-n:]
 	}
-	return false
 }
 
-func toFloat(v interface{}) float64 {
-	switch val := v.(type) {
-	case float64:
-		return val
-	case int:
-		return float64(val)
-	case string:
-		f, _ := strconv.ParseFloat(val, 64)
-		return f
-	case bool:
-		if val {
-			return 1
-		}
-		return 0
+// remember adds a completed ask to the continuity window, dropping the
+// oldest entries beyond maxHistory.
+func (i *Interpreter) remember(instruction, response string) {
+	if i.maxHistory <= 0 {
+		return
+	}
+	i.history = append(i.history, promptExchange{Instruction: instruction, Response: response})
+	if len(i.history) > i.maxHistory {
+		i.history = append(i.history[:0], i.history[len(i.history)-i.maxHistory:]...)
 	}
-	return 0
 }
 
-func (i *Interpreter) executeAsk(ask *AskStatement) error {
-	i.log("")
-	i.log("┌─────────────────────────────────────────────────────────────┐")
-	i.log("│ ASK: %s", truncateString(ask.Instruction, 53))
-	i.log("└─────────────────────────────────────────────────────────────┘")
+// SetMaxOutputBytes caps the Claude and shell output captured into a
+// variable; anything beyond n bytes is dropped and replaced by a marker.
+// The combined output kept in step records is capped at n bytes too. Zero
+// disables the cap.
+func (i *Interpreter) SetMaxOutputBytes(n int) {
+	i.maxOutputBytes = n
+}
 
-	// Build context from variables
-	context := i.buildContext()
-	prompt := i.buildPrompt(ask.Instruction, context)
+// SetMaxIterations sets how many times a while loop may run its body; one
+// whose condition still holds after n iterations fails the run.
+func (i *Interpreter) SetMaxIterations(n int) {
+	i.maxIterations = n
+}
 
-	if i.dryRun {
-		i.log("[DRY RUN] Would send to Claude Code CLI:")
-		i.log("  Prompt: %s", truncateString(prompt, 60))
+func (i *Interpreter) SetVerbose(verbose bool) {
+	i.verbose = verbose
+}
+
+func (i *Interpreter) SetClaudeCLI(path string) {
+	i.claudeCLI = path
+}
+
+func (i *Interpreter) SetSkipPermissions(skip bool) {
+	i.skipPermissions = skip
+}
+
+func (i *Interpreter) SetModel(model string) {
+	i.model = model
+}
+
+// SetClaudeMode selects how prompts are passed to the Claude CLI: "flags"
+// passes the prompt with -p, "json" writes it to the CLI's stdin as a
+// stream-json user message and reads the reply from its result event.
+// Options such as the model and allowed tools are flags in both modes.
+func (i *Interpreter) SetClaudeMode(mode string) error {
+	switch mode {
+	case "flags", "json":
+		i.claudeMode = mode
 		return nil
 	}
+	return fmt.Errorf("unknown Claude mode %q (want flags or json)", mode)
+}
 
-	return i.callClaudeCode(prompt)
+// SetAllowedTools sets the default tools Claude may use. Steps with their
+// own tools= modifier override it.
+func (i *Interpreter) SetAllowedTools(tools []string) {
+	i.allowedTools = tools
 }
 
-func (i *Interpreter) buildContext() map[string]interface{} {
-	context := make(map[string]interface{})
-	for k, v := range i.variables {
-		context[k] = v
-	}
-	return context
+// SetOnlyHooks restricts execution to the before/after hooks.
+func (i *Interpreter) SetOnlyHooks(only bool) {
+	i.onlyHooks = only
 }
 
-func (i *Interpreter) buildPrompt(instruction string, context map[string]interface{}) string {
-	var prompt strings.Builder
+// SetSkipHooks runs the build steps without the before/after hooks.
+func (i *Interpreter) SetSkipHooks(skip bool) {
+	i.skipHooks = skip
+}
 
-	prompt.WriteString("You are building a project with the following specifications:\n\n")
+// SetNoHooksOnDryRun skips before/after hooks (including "each" hooks)
+// entirely in dry-run, instead of previewing them like other steps.
+func (i *Interpreter) SetNoHooksOnDryRun(skip bool) {
+	i.noHooksOnDryRun = skip
+}
+
+// hooksSkipped reports whether hooks are disabled for this run.
+func (i *Interpreter) hooksSkipped() bool {
+	return i.skipHooks || (i.dryRun && i.noHooksOnDryRun)
+}
+
+// SetBeforeFailFast controls whether a failing before hook aborts the run
+// (the default) or is logged and skipped.
+func (i *Interpreter) SetBeforeFailFast(failFast bool) {
+	i.beforeFailFast = failFast
+}
 
-	if project, ok := context["project"]; ok {
-		prompt.WriteString(fmt.Sprintf("Project Name: %v\n", project))
+// SetContinueOnError lets the run go on past shell commands and shell.run
+// calls that exit with a non-zero status, so the script can branch on
+// last_exit ($?), and past failed Claude calls, which are only logged.
+// Timeouts and policy errors still stop the run.
+func (i *Interpreter) SetContinueOnError(continueOnError bool) {
+	i.continueOnError = continueOnError
+}
+
+// SetAfterFailFast controls whether a failing after hook fails the run. By
+// default after hooks are lenient: failures are logged and the remaining
+// hooks still run.
+func (i *Interpreter) SetAfterFailFast(failFast bool) {
+	i.afterFailFast = failFast
+}
+
+// SetProfile enables the per-category timing breakdown printed at the end
+// of a run.
+func (i *Interpreter) SetProfile(profile bool) {
+	i.profile = profile
+}
+
+// recordTime adds the time elapsed since start to the given profile category.
+// It is meant to be deferred at the top of an executor.
+func (i *Interpreter) recordTime(category string, start time.Time) {
+	i.profileTimes[category] += time.Since(start)
+}
+
+// Profile returns the milliseconds spent in each profile category and in
+// total, as reported in the run_end event of --json-stream.
+func (i *Interpreter) Profile() map[string]float64 {
+	profile := map[string]float64{"total": 0}
+	for _, category := range profileCategories {
+		ms := float64(i.profileTimes[category]) / float64(time.Millisecond)
+		profile[category] = ms
+		profile["total"] += ms
 	}
-	if victim, ok := context["victim"]; ok {
-		prompt.WriteString(fmt.Sprintf("Target Platform: %v\n", victim))
+	return profile
+}
+
+func (i *Interpreter) printProfile() {
+	var total time.Duration
+	for _, d := range i.profileTimes {
+		total += d
+	}
+
+	i.log("")
+	i.log("═══ Profile ═══")
+	for _, category := range profileCategories {
+		d := i.profileTimes[category]
+		share := 0.0
+		if total > 0 {
+			share = float64(d) / float64(total) * 100
+		}
+		i.log("  %-8s %12s  %5.1f%%", category, d.Round(time.Millisecond), share)
 	}
-	if frontend, ok := context["frontend"]; ok {
-		prompt.WriteString(fmt.Sprintf("Frontend: %v\n", frontend))
+	i.log("  %-8s %12s", "total", total.Round(time.Millisecond))
+}
+
+// SetContext sets the context that all spawned commands run under.
+// Cancelling it aborts the run.
+func (i *Interpreter) SetContext(ctx context.Context) {
+	i.ctx = ctx
+}
+
+// SetShellTimeout limits every shell command and shell.run call to d, unless
+// the command sets its own timeout=. On expiry the command's whole process
+// group is killed. Zero means no limit.
+func (i *Interpreter) SetShellTimeout(d time.Duration) {
+	i.shellTimeout = d
+}
+
+// SetRetries retries an ask or shell step up to n times when it exits with
+// a non-zero status or times out, waiting longer before each attempt.
+// A retries= modifier on the step overrides it.
+func (i *Interpreter) SetRetries(n int) {
+	i.retries = n
+}
+
+// SetClaudeTimeout limits every Claude call to d, unless the ask sets its
+// own timeout=. The CLI is killed on expiry. Zero means no limit.
+func (i *Interpreter) SetClaudeTimeout(d time.Duration) {
+	i.claudeTimeout = d
+}
+
+// SetDeadline bounds the wall-clock time of a whole Execute call. Once it
+// passes no further steps are started, the running command is killed and
+// the after hooks are run as cleanup.
+func (i *Interpreter) SetDeadline(d time.Duration) {
+	i.deadline = d
+}
+
+// SetFake enables pretend mode: no commands or Claude calls are run, every
+// step reports success and captured output comes from a stub generator.
+func (i *Interpreter) SetFake(fake bool) {
+	i.fake = fake
+}
+
+// SetSeed seeds the stub output generator used in fake mode, so runs with
+// the same seed capture identical values and take the same branches.
+func (i *Interpreter) SetSeed(seed int64) {
+	i.rng = rand.New(rand.NewSource(seed))
+}
+
+// stubOutput returns canned output for a step simulated in fake mode.
+func (i *Interpreter) stubOutput(kind string) string {
+	return fmt.Sprintf("%s-stub-%08x", kind, i.rng.Uint32())
+}
+
+// DumpedPrompt is one fully built prompt recorded by --dump-prompts.
+type DumpedPrompt struct {
+	Step        int    `json:"step"`
+	Instruction string `json:"instruction"`
+	Prompt      string `json:"prompt"`
+}
+
+// SetDumpPrompts makes every ask record its prompt instead of calling
+// Claude. Shell and MCP steps are previewed as in dry-run so conditions and
+// loops are still evaluated.
+func (i *Interpreter) SetDumpPrompts(dump bool) {
+	i.dumpPrompts = dump
+	if dump {
+		i.dryRun = true
 	}
-	if backend, ok := context["backend"]; ok {
-		prompt.WriteString(fmt.Sprintf("Backend: %v\n", backend))
+}
+
+// DumpedPrompts returns the prompts recorded in dump mode, in execution order.
+func (i *Interpreter) DumpedPrompts() []DumpedPrompt {
+	return i.dumpedPrompts
+}
+
+// Config is the effective interpreter configuration, as printed by
+// --dump-config.
+type Config struct {
+	ClaudePath         string            `json:"claude_path"`
+	ClaudeMode         string            `json:"claude_mode"`
+	Model              string            `json:"model"`
+	ModelFor           map[string]string `json:"model_for"`
+	AllowedTools       []string          `json:"allowed_tools"`
+	SkipPermissions    bool              `json:"skip_permissions"`
+	RetryBudget        int               `json:"retry_budget"`
+	Retries            int               `json:"retries"`
+	Deadline           string            `json:"deadline"`
+	ShellTimeout       string            `json:"shell_timeout"`
+	ClaudeTimeout      string            `json:"claude_timeout"`
+	MaxOutputBytes     int               `json:"max_output_bytes"`
+	MaxIterations      int               `json:"max_iterations"`
+	DryRun             bool              `json:"dry_run"`
+	DryRunFS           bool              `json:"dry_run_fs"`
+	DryRunTruncate     int               `json:"dry_run_truncate"`
+	Fake               bool              `json:"fake"`
+	Verbose            bool              `json:"verbose"`
+	ASCIISymbols       bool              `json:"ascii_symbols"`
+	FullContext        bool              `json:"full_context"`
+	UnknownVars        string            `json:"unknown_vars"`
+	CombineOutput      bool              `json:"combine_output"`
+	MaxPromptHistory   int               `json:"max_prompt_history"`
+	AllowShell         bool              `json:"allow_shell"`
+	AllowedCommands    []string          `json:"allowed_commands"`
+	InteractiveApprove bool              `json:"interactive_approve"`
+	ApproveDefault     bool              `json:"approve_default"`
+	OnlyHooks          bool              `json:"only_hooks"`
+	SkipHooks          bool              `json:"skip_hooks"`
+	NoHooksOnDryRun    bool              `json:"no_hooks_on_dry_run"`
+	BeforeFailFast     bool              `json:"before_fail_fast"`
+	AfterFailFast      bool              `json:"after_fail_fast"`
+	ContinueOnError    bool              `json:"continue_on_error"`
+	Profile            bool              `json:"profile"`
+	BaseDir            string            `json:"base_dir"`
+	WorkDir            string            `json:"workdir"`
+	ExpandEnv          bool              `json:"expand_env"`
+}
+
+// Config returns the configuration in effect after defaults and every
+// setter have been applied.
+func (i *Interpreter) Config() Config {
+	cfg := Config{
+		ClaudePath:         i.claudeCLI,
+		ClaudeMode:         i.claudeMode,
+		Model:              i.model,
+		ModelFor:           i.modelFor,
+		AllowedTools:       i.allowedTools,
+		SkipPermissions:    i.skipPermissions,
+		RetryBudget:        i.retryBudget,
+		Retries:            i.retries,
+		MaxOutputBytes:     i.maxOutputBytes,
+		MaxIterations:      i.maxIterations,
+		DryRun:             i.dryRun,
+		DryRunFS:           i.dryRunFS,
+		DryRunTruncate:     i.previewLimit,
+		Fake:               i.fake,
+		Verbose:            i.verbose,
+		ASCIISymbols:       i.asciiSymbols,
+		FullContext:        i.fullContext,
+		UnknownVars:        "keep",
+		CombineOutput:      i.combineOutput,
+		MaxPromptHistory:   i.maxHistory,
+		AllowShell:         i.allowShell,
+		AllowedCommands:    i.allowedCmds,
+		InteractiveApprove: i.approve,
+		ApproveDefault:     i.approveDefault,
+		OnlyHooks:          i.onlyHooks,
+		SkipHooks:          i.skipHooks,
+		NoHooksOnDryRun:    i.noHooksOnDryRun,
+		BeforeFailFast:     i.beforeFailFast,
+		AfterFailFast:      i.afterFailFast,
+		ContinueOnError:    i.continueOnError,
+		Profile:            i.profile,
+		BaseDir:            i.baseDir,
+		WorkDir:            i.workDir,
+		ExpandEnv:          i.expandEnv,
 	}
-	if db, ok := context["db"]; ok {
-		prompt.WriteString(fmt.Sprintf("Database: %v\n", db))
+	if i.blankUnknown {
+		cfg.UnknownVars = "blank"
 	}
-	if ai, ok := context["ai"]; ok {
-		prompt.WriteString(fmt.Sprintf("AI Features: %v\n", formatValue(ai)))
+	if i.deadline > 0 {
+		cfg.Deadline = i.deadline.String()
 	}
-	if tools, ok := context["tools"]; ok {
-		prompt.WriteString(fmt.Sprintf("Tools: %v\n", formatValue(tools)))
+	if i.shellTimeout > 0 {
+		cfg.ShellTimeout = i.shellTimeout.String()
 	}
-	if task, ok := context["task"]; ok {
-		prompt.WriteString(fmt.Sprintf("\nMain Task: %v\n", task))
+	if i.claudeTimeout > 0 {
+		cfg.ClaudeTimeout = i.claudeTimeout.String()
 	}
+	return cfg
+}
 
-	prompt.WriteString(fmt.Sprintf("\nCurrent Step: %s\n", instruction))
-	prompt.WriteString("\nPlease implement this step. Create all necessary files and code.")
+// StepRecord is the outcome of one ask, shell or MCP step.
+type StepRecord struct {
+	Index    int           `json:"index"`
+	Kind     string        `json:"kind"`
+	Detail   string        `json:"detail"`
+	Group    string        `json:"group,omitempty"`
+	Status   string        `json:"status"` // "passed", "failed" or "skipped" (not run: dry-run, --fake or declined)
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"error,omitempty"`
+	Output   string        `json:"output,omitempty"` // combined stdout/stderr, with --combine-output
+}
 
-	return prompt.String()
+// Steps returns the steps executed so far, in execution order.
+func (i *Interpreter) Steps() []StepRecord {
+	return i.steps
 }
 
-func formatValue(v interface{}) string {
-	switch val := v.(type) {
-	case []interface{}:
-		var items []string
-		for _, item := range val {
-			items = append(items, fmt.Sprintf("%v", item))
-		}
-		return strings.Join(items, ", ")
-	default:
-		return fmt.Sprintf("%v", v)
-	}
+// EventSchemaVersion is the version of the StreamEvent schema. It is
+// bumped whenever a field is removed or changes meaning.
+const EventSchemaVersion = 1
+
+// StreamEvent is one line of the --json-stream output. Events are:
+//
+//	run_start   the run began; status is running
+//	step_start  a step began; status is running
+//	log         a line of the run log; status is info, detail the line and
+//	            step_index the running step, or 0 between steps
+//	step_end    a step finished; status is passed, failed or skipped
+//	run_end     the run finished; status is passed or failed
+//
+// Every field but profile is always present so consumers can rely on the
+// shape.
+type StreamEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Event         string    `json:"event"`
+	TS            time.Time `json:"ts"`
+	StepIndex     int       `json:"step_index"` // 0 for run events
+	Type          string    `json:"type"`       // step kind: ask, shell or mcp
+	Status        string    `json:"status"`
+	Detail        string    `json:"detail"` // step detail, or the error of a failure
+
+	// Profile is the --profile breakdown in milliseconds per category, set
+	// on run_end only when profiling
+	Profile map[string]float64 `json:"profile,omitempty"`
 }
 
-func (i *Interpreter) callClaudeCode(prompt string) error {
-	i.log("  → Calling Claude Code CLI...")
+// SetEventStream writes a StreamEvent as one JSON line to w at the start
+// and end of the run and of every step, and for every log line. A nil
+// writer disables events.
+func (i *Interpreter) SetEventStream(w io.Writer) {
+	i.events = w
+}
 
-	// Build command arguments
-	args := []string{"--print"}
+func (i *Interpreter) emit(event StreamEvent) {
+	if i.events == nil {
+		return
+	}
+	event.SchemaVersion = EventSchemaVersion
+	event.TS = time.Now().UTC()
+	event.Detail = i.redactSecrets(event.Detail)
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	i.events.Write(append(line, '\n'))
+}
 
-	// Skip permissions for fast, non-interactive execution
-	if i.skipPermissions {
-		args = append(args, "--dangerously-skip-permissions")
+// beginStep emits the start event for a step and returns its start time,
+// to be passed to the deferred recordStep.
+func (i *Interpreter) beginStep(kind, detail string) time.Time {
+	i.stepIndex = len(i.steps) + 1
+	i.emit(StreamEvent{Event: "step_start", Status: "running", StepIndex: i.stepIndex, Type: kind, Detail: detail})
+	return time.Now()
+}
+
+// recordStep appends a StepRecord for a step that began at start. It is
+// deferred with a pointer to the step's named error result.
+func (i *Interpreter) recordStep(kind, detail string, start time.Time, err *error) {
+	step := StepRecord{
+		Index:    len(i.steps) + 1,
+		Kind:     kind,
+		Detail:   detail,
+		Group:    strings.Join(i.groups, "/"),
+		Status:   "passed",
+		Duration: time.Since(start),
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(*err, errStepSkipped):
+		step.Status = "skipped"
+	case i.exitIsResult && errors.As(*err, &exitErr):
+		// The check ran; its exit status is the result
+	case *err != nil:
+		step.Status = "failed"
+		step.Err = (*err).Error()
+	case i.dryRun, i.fake, i.stepSkipped:
+		step.Status = "skipped"
+	}
+	i.stepSkipped = false
+	i.stepIndex = 0
+	if i.stepOutput != nil {
+		step.Output = i.stepOutput.buf.String()
+		i.stepOutput = nil
+	}
+	// Records end up in summaries and JUnit reports, so secrets are masked
+	step.Detail = i.redactSecrets(step.Detail)
+	step.Err = i.redactSecrets(step.Err)
+	step.Output = i.redactSecrets(step.Output)
+	i.steps = append(i.steps, step)
+	if step.Status == "failed" {
+		*err = &ExecError{Step: step.Index, Kind: kind, Err: *err}
 	}
 
-	// Use specific model if set (e.g., "haiku" for faster responses)
-	if i.model != "" {
-		args = append(args, "--model", i.model)
+	end := StreamEvent{Event: "step_end", StepIndex: step.Index, Type: kind, Status: step.Status, Detail: detail}
+	if step.Err != "" {
+		end.Detail = step.Err
 	}
+	i.emit(end)
+}
 
-	// Add the prompt
-	args = append(args, "-p", prompt)
+// SetAllowShell controls whether the interpreter may spawn processes
+// (shell commands, shell.run and the Claude CLI). With it disabled those
+// steps fail with errExecDisabled while pure DSL evaluation and fs
+// operations keep working.
+func (i *Interpreter) SetAllowShell(allow bool) {
+	i.allowShell = allow
+}
 
-	// Call Claude Code CLI
-	cmd := exec.Command(i.claudeCLI, args...)
-	cmd.Stdout = i.outputWriter
-	cmd.Stderr = os.Stderr
+var errExecDisabled = errors.New("process execution is disabled by policy")
 
-	if err := cmd.Run(); err != nil {
-		// If claude CLI is not available, log the prompt instead
-		i.log("  ⚠ Claude Code CLI not available or failed")
-		i.log("  → Prompt would be: %s", truncateString(prompt, 100))
-		return nil // Don't fail the whole execution
+func (i *Interpreter) checkExecAllowed(what string) error {
+	if !i.allowShell {
+		return fmt.Errorf("%s: %w", what, errExecDisabled)
 	}
-
-	i.log("  ✓ Step completed")
 	return nil
 }
 
-func (i *Interpreter) executeIf(ifStmt *IfStatement) error {
-	if i.evalCondition(ifStmt.Condition) {
-		for _, stmt := range ifStmt.Consequence {
-			if err := i.executeStatement(stmt); err != nil {
-				return err
+// SetAllowedCommands restricts shell commands and shell.run to the given
+// binaries. A command must match an entry exactly, so a path such as
+// ./npm or /tmp/npm is only allowed by an entry naming that path. Every
+// command of a pipeline or list must be allowed. An empty list allows any
+// command.
+func (i *Interpreter) SetAllowedCommands(cmds []string) {
+	i.allowedCmds = cmds
+}
+
+var errCommandNotAllowed = errors.New("command is not in the --allow-cmd list")
+
+// checkCommandAllowed checks every command in a shell command line against
+// the allowlist.
+func (i *Interpreter) checkCommandAllowed(command string) error {
+	if len(i.allowedCmds) == 0 {
+		return nil
+	}
+	names, err := commandNames(command)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		allowed := false
+		for _, cmd := range i.allowedCmds {
+			if name == cmd || strings.Contains(cmd, "/") && filepath.Clean(name) == filepath.Clean(cmd) {
+				allowed = true
+				break
 			}
 		}
-	} else if ifStmt.Alternative != nil {
-		for _, stmt := range ifStmt.Alternative {
-			if err := i.executeStatement(stmt); err != nil {
-				return err
-			}
+		if !allowed {
+			return fmt.Errorf("%s: %w", name, errCommandNotAllowed)
 		}
 	}
 	return nil
 }
 
-func (i *Interpreter) executeRepeat(repeat *RepeatStatement) error {
-	for j := 0; j < repeat.Count; j++ {
-		i.log("  [Repeat %d/%d]", j+1, repeat.Count)
-		for _, stmt := range repeat.Body {
-			if err := i.executeStatement(stmt); err != nil {
-				return err
+// commandNames returns the command run by each segment of a shell command
+// line split on |, ||, &&, &, ;, newlines and parentheses, skipping leading
+// VAR=value assignments. Quotes are honoured. Command substitution is
+// rejected because the commands inside it cannot be checked.
+func commandNames(command string) ([]string, error) {
+	var names, words []string
+	var word strings.Builder
+	inWord := false
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endSegment := func() {
+		endWord()
+		for _, w := range words {
+			if w == "!" || isEnvAssignment(w) {
+				continue
 			}
+			names = append(names, w)
+			break
 		}
+		words = nil
 	}
-	return nil
+
+	var quote rune
+	runes := []rune(command)
+	for idx := 0; idx < len(runes); idx++ {
+		ch := runes[idx]
+		switch {
+		case quote == '\'':
+			if ch == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(ch)
+			}
+		case ch == '`' || (ch == '$' && idx+1 < len(runes) && runes[idx+1] == '('):
+			return nil, fmt.Errorf("command substitution cannot be checked against --allow-cmd: %s", command)
+		case quote == '"':
+			if ch == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(ch)
+			}
+		case ch == '\\' && idx+1 < len(runes):
+			idx++
+			word.WriteRune(runes[idx])
+			inWord = true
+		case ch == '\'' || ch == '"':
+			quote = ch
+			inWord = true
+		case ch == '&' && ((idx > 0 && (runes[idx-1] == '>' || runes[idx-1] == '<')) || (idx+1 < len(runes) && runes[idx+1] == '>')):
+			// Part of a redirection such as 2>&1 or &>file
+			word.WriteRune(ch)
+			inWord = true
+		case strings.ContainsRune("|&;()\n", ch):
+			endSegment()
+		case unicode.IsSpace(ch):
+			endWord()
+		default:
+			word.WriteRune(ch)
+			inWord = true
+		}
+	}
+	endSegment()
+	return names, nil
 }
 
-func (i *Interpreter) executeShell(shell *ShellCommand) error {
-	i.log("  → Shell: %s", shell.Command)
+// isEnvAssignment reports whether word is a VAR=value prefix.
+func isEnvAssignment(word string) bool {
+	eq := strings.IndexByte(word, '=')
+	if eq <= 0 {
+		return false
+	}
+	for idx, ch := range word[:eq] {
+		if ch != '_' && !unicode.IsLetter(ch) && !(idx > 0 && unicode.IsDigit(ch)) {
+			return false
+		}
+	}
+	return true
+}
 
-	if i.dryRun {
-		i.log("  [DRY RUN] Would execute: %s", shell.Command)
+// checkContext reports whether the run has been cancelled or has run out
+// of time.
+func (i *Interpreter) checkContext() error {
+	err := i.ctx.Err()
+	if err == nil {
 		return nil
 	}
+	if errors.Is(err, context.DeadlineExceeded) && i.deadline > 0 {
+		return &TimeoutError{Limit: i.deadline}
+	}
+	return err
+}
+
+func (i *Interpreter) log(format string, args ...interface{}) {
+	if i.events != nil && format != "" {
+		line := strings.TrimSpace(i.redactSecrets(fmt.Sprintf(format, args...)))
+		if line != "" {
+			i.emit(StreamEvent{Event: "log", StepIndex: i.stepIndex, Status: "info", Detail: line})
+		}
+	}
+	if i.verbose {
+		indent := ""
+		if format != "" {
+			indent = strings.Repeat("  ", len(i.groups))
+		}
+		line := i.redactSecrets(fmt.Sprintf(indent+format+"\n", args...))
+		if i.asciiSymbols {
+			line = asciiSymbols.Replace(line)
+		}
+		fmt.Fprint(i.outputWriter, line)
+	}
+}
 
-	cmd := exec.Command("sh", "-c", shell.Command)
-	cmd.Stdout = i.outputWriter
-	cmd.Stderr = os.Stderr
+// asciiSymbols maps the glyphs used in log output to ASCII for terminals
+// without UTF-8 support. Box-drawing characters map to a single ASCII
+// character each, so boxes stay aligned.
+var asciiSymbols = strings.NewReplacer(
+	"╔", "+", "╗", "+", "╚", "+", "╝", "+",
+	"┌", "+", "┐", "+", "└", "+", "┘", "+",
+	"═", "=", "─", "-", "║", "|", "│", "|",
+	"✓", "[OK]", "⚠", "[WARN]", "→", "->", "▶", ">",
+)
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("shell command failed: %w", err)
+// useASCII reports whether the --symbols set selects ASCII glyphs.
+func useASCII(set string) (bool, error) {
+	switch set {
+	case "unicode":
+		return false, nil
+	case "ascii":
+		return true, nil
+	case "auto", "":
+		return !utf8Locale(), nil
 	}
+	return false, fmt.Errorf("unknown symbol set %q (expected auto, unicode or ascii)", set)
+}
 
-	i.log("  ✓ Shell command completed")
-	return nil
+// symbolOutput returns w, or with ascii set a writer that replaces the
+// glyphs of everything written to it, for messages the CLI prints itself.
+func symbolOutput(w io.Writer, ascii bool) io.Writer {
+	if !ascii {
+		return w
+	}
+	return asciiWriter{w}
 }
 
-func (i *Interpreter) executeMCP(mcp *MCPCall) error {
-	i.log("  → MCP: %s.%s", mcp.Service, mcp.Method)
+type asciiWriter struct {
+	w io.Writer
+}
 
-	if i.dryRun {
-		i.log("  [DRY RUN] Would call MCP: %s.%s(%s)", mcp.Service, mcp.Method, mcp.Arg)
-		return nil
+func (a asciiWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(a.w, asciiSymbols.Replace(string(p))); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	// Build MCP command based on service and method
-	var cmd *exec.Cmd
-	switch mcp.Service {
-	case "shell":
-		if mcp.Method == "run" {
-			cmd = exec.Command("sh", "-c", mcp.Arg)
+// utf8Locale reports whether the locale environment allows UTF-8 output.
+// An unset locale is assumed to be fine, since most modern terminals are.
+func utf8Locale() bool {
+	for _, key := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if locale := os.Getenv(key); locale != "" {
+			locale = strings.ToLower(locale)
+			return strings.Contains(locale, "utf-8") || strings.Contains(locale, "utf8")
 		}
-	case "fs":
-		switch mcp.Method {
-		case "write":
-			// Parse arg as JSON: {"path": "...", "content": "..."}
-			var args map[string]string
-			if err := json.Unmarshal([]byte(mcp.Arg), &args); err == nil {
-				if path, ok := args["path"]; ok {
-					content := args["content"]
-					if err := os.WriteFile(path, []byte(content), 0644); err != nil {
-						return fmt.Errorf("fs.write failed: %w", err)
-					}
-					i.log("  ✓ Created file: %s", path)
-					return nil
-				}
-			}
-		case "mkdir":
-			if err := os.MkdirAll(mcp.Arg, 0755); err != nil {
-				return fmt.Errorf("fs.mkdir failed: %w", err)
-			}
-			i.log("  ✓ Created directory: %s", mcp.Arg)
-			return nil
-		case "read":
-			content, err := os.ReadFile(mcp.Arg)
-			if err != nil {
-				return fmt.Errorf("fs.read failed: %w", err)
+	}
+	return true
+}
+
+func (i *Interpreter) Execute(program *Program) error {
+	i.emit(StreamEvent{Event: "run_start", Status: "running"})
+	err := i.execute(program)
+	end := StreamEvent{Event: "run_end", Status: "passed"}
+	if err != nil {
+		end.Status, end.Detail = "failed", err.Error()
+	}
+	if i.profile {
+		end.Profile = i.Profile()
+	}
+	i.emit(end)
+	return err
+}
+
+func (i *Interpreter) execute(program *Program) error {
+	if i.onlyHooks && i.skipHooks {
+		return fmt.Errorf("only-hooks and skip-hooks are mutually exclusive")
+	}
+	if i.profile {
+		defer i.printProfile()
+	}
+
+	parent := i.ctx
+	if i.deadline > 0 {
+		ctx, cancel := context.WithTimeout(parent, i.deadline)
+		defer cancel()
+		i.ctx = ctx
+		defer func() { i.ctx = parent }()
+	}
+
+	// abort runs the after hooks as cleanup when the deadline cut the run
+	// short, then returns the original error.
+	abort := func(err error) error {
+		if i.deadline > 0 && errors.Is(i.ctx.Err(), context.DeadlineExceeded) {
+			i.ctx = parent
+			if hookErr := i.runAfterHooks(); hookErr != nil {
+				i.log("  ⚠ %v", hookErr)
 			}
-			i.log("  File content:\n%s", string(content))
-			return nil
 		}
-	case "browser":
-		// Browser operations would integrate with external tools
-		i.log("  ⚠ Browser MCP operations require external browser automation")
+		return err
+	}
+
+	// First pass: collect variables and hooks
+	initial := make(map[string]interface{}, len(i.variables))
+	for name, val := range i.variables {
+		initial[name] = val
+	}
+	required, err := i.collect(program)
+	if err != nil {
+		return err
+	}
+	if err := i.checkRequired(required); err != nil {
+		return err
+	}
+
+	i.log("╔════════════════════════════════════════════════════════════╗")
+	i.log("║              VIBE DSL Interpreter v1.0                     ║")
+	i.log("╚════════════════════════════════════════════════════════════╝")
+	i.log("")
+	i.log("Project: %v", i.variables["project"])
+	i.log("Target:  %v", i.variables["victim"])
+	i.log("")
+
+	// Run before hooks
+	if len(i.beforeHooks) > 0 && !i.hooksSkipped() {
+		i.log("═══ Running Pre-Hooks ═══")
+		for _, hook := range i.beforeHooks {
+			if err := i.executeHook(hook); err != nil {
+				if i.beforeFailFast || i.checkContext() != nil {
+					return abort(fmt.Errorf("before hook failed: %w", err))
+				}
+				i.log("  ⚠ before hook failed: %v", err)
+			}
+		}
+		i.log("")
+	}
+
+	// Second pass: execute statements
+	if !i.onlyHooks {
+		i.resetAssignments(program, initial)
+		i.log("═══ Executing Build Steps ═══")
+		for _, stmt := range program.Statements {
+			if err := i.executeStatement(stmt); err != nil {
+				return abort(err)
+			}
+			for _, name := range assignedNames(stmt) {
+				if val, ok := i.overlaid[name]; ok {
+					i.variables[name] = val
+				}
+			}
+		}
+	}
+
+	if err := i.runAfterHooks(); err != nil {
+		return err
+	}
+
+	i.log("")
+	i.log("═══ Build Complete ═══")
+	if summary, ok := i.variables["summary"]; ok {
+		// A hand-off message set by the script, e.g. how to start the app
+		i.log("%s", toString(summary))
+	}
+	return nil
+}
+
+// collect is the first pass over the top-level statements: it evaluates
+// plain assignments and records prompts, setups and hooks. It returns the
+// names listed by require statements. The values it assigns are what the
+// before hooks, require and --dump-resolved see; the build steps assign
+// them again, in order.
+func (i *Interpreter) collect(program *Program) ([]string, error) {
+	var required []string
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *RequireStatement:
+			required = append(required, s.Names...)
+		case *Assignment:
+			if hasSideEffects(s.Value) {
+				continue // evaluated in order during the second pass
+			}
+			val, err := i.evalValue(s.Value)
+			if err != nil {
+				return nil, err
+			}
+			i.variables[s.Name] = val
+		case *DestructuringAssignment:
+			if hasSideEffects(s.Value) {
+				continue
+			}
+			if err := i.executeDestructuring(s); err != nil {
+				return nil, err
+			}
+		case *PromptDefinition:
+			i.prompts[s.Name] = s.Text
+		case *SetupBlock:
+			i.setups[s.Name] = s.Body
+		case *BeforeBlock:
+			i.beforeHooks = append(i.beforeHooks, guardHooks(s.When, s.Statements)...)
+		case *AfterBlock:
+			i.afterHooks = append(i.afterHooks, guardHooks(s.When, s.Statements)...)
+		}
+	}
+	if err := checkSetupCycles(i.setups); err != nil {
+		return nil, err
+	}
+
+	i.overlaid = make(map[string]interface{})
+	for _, overlay := range i.overlays {
+		switch s := overlay.(type) {
+		case *Assignment:
+			val, err := i.evalValue(s.Value)
+			if err != nil {
+				return nil, err
+			}
+			i.variables[s.Name] = val
+		case *DestructuringAssignment:
+			if err := i.executeDestructuring(s); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range assignedNames(overlay) {
+			i.overlaid[name] = i.variables[name]
+		}
+	}
+	return required, nil
+}
+
+// resetAssignments undoes the first pass for the names assigned at the top
+// level of program, restoring the values they had before it, so that each
+// one is only set once the build steps reach its assignment. Names set by
+// a profile file keep their value.
+func (i *Interpreter) resetAssignments(program *Program, initial map[string]interface{}) {
+	for _, stmt := range program.Statements {
+		for _, name := range assignedNames(stmt) {
+			if _, ok := i.overlaid[name]; ok {
+				continue
+			}
+			if val, ok := initial[name]; ok {
+				i.variables[name] = val
+			} else {
+				delete(i.variables, name)
+			}
+		}
+	}
+}
+
+// assignedNames returns the variables stmt assigns, if it is an assignment.
+func assignedNames(stmt Node) []string {
+	switch s := stmt.(type) {
+	case *Assignment:
+		return []string{s.Name}
+	case *DestructuringAssignment:
+		return s.Names
+	}
+	return nil
+}
+
+// ResolveProgram returns the program as source text with every ${name}
+// substituted from the variables known before the first step runs, and
+// prompt references replaced by their text. Nothing is executed; names
+// bound only at run time, such as loop variables, are left as written.
+func (i *Interpreter) ResolveProgram(program *Program) (string, error) {
+	if _, err := i.collect(program); err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	i.writeResolved(&out, program.Statements, 0)
+	return out.String(), nil
+}
+
+func (i *Interpreter) writeResolved(out *strings.Builder, stmts []Node, depth int) {
+	indent := strings.Repeat("    ", depth)
+	block := func(header string, body []Node) {
+		out.WriteString(indent + strings.TrimSuffix(header, " ... }") + "\n")
+		i.writeResolved(out, body, depth+1)
+		out.WriteString(indent + "}\n")
+	}
+
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *AskStatement:
+			resolved := *s
+			if text, err := i.askInstruction(s); err == nil {
+				resolved.PromptRef, resolved.PromptFile, resolved.Instruction = "", "", text
+			}
+			out.WriteString(indent + resolved.String() + "\n")
+		case *ShellCommand:
+			resolved := *s
+			resolved.Command = i.interpolateShell(s.Command)
+			out.WriteString(indent + resolved.String() + "\n")
+		case *MCPCall:
+			out.WriteString(indent + i.interpolateMCP(s).String() + "\n")
+		case *Assignment:
+			value := s.Value
+			if str, ok := value.(*StringLiteral); ok {
+				value = &StringLiteral{Value: i.interpolate(str.Value)}
+			}
+			out.WriteString(indent + (&Assignment{Name: s.Name, Value: value}).String() + "\n")
+		case *IfStatement:
+			out.WriteString(indent + strings.TrimSuffix(s.String(), " ... }") + "\n")
+			i.writeResolved(out, s.Consequence, depth+1)
+			if s.Alternative != nil {
+				out.WriteString(indent + "} else {\n")
+				i.writeResolved(out, s.Alternative, depth+1)
+			}
+			out.WriteString(indent + "}\n")
+		case *RepeatStatement:
+			block(s.String(), s.Body)
+		case *WhileStatement:
+			block(s.String(), s.Body)
+		case *ForStatement:
+			block(s.String(), s.Body)
+		case *GroupBlock:
+			block(s.String(), s.Body)
+		case *SetupBlock:
+			block(s.String(), s.Body)
+		case *BeforeBlock:
+			block(s.String(), s.Statements)
+		case *AfterBlock:
+			block(s.String(), s.Statements)
+		default:
+			out.WriteString(indent + stmt.String() + "\n")
+		}
+	}
+}
+
+// checkRequired returns an error naming every required variable that is
+// unset or an empty string.
+func (i *Interpreter) checkRequired(names []string) error {
+	var missing []string
+	for _, name := range names {
+		if val, ok := i.variables[name]; !ok || val == nil || val == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required variables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (i *Interpreter) runAfterHooks() error {
+	if len(i.afterHooks) == 0 || i.hooksSkipped() {
+		return nil
+	}
+
+	i.log("")
+	i.log("═══ Running Post-Hooks ═══")
+	for _, hook := range i.afterHooks {
+		if err := i.executeHook(hook); err != nil {
+			if i.afterFailFast || i.checkContext() != nil {
+				return fmt.Errorf("after hook failed: %w", err)
+			}
+			i.log("  ⚠ after hook failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// ExecuteString lexes, parses and executes src. If the parser reports any
+// errors the program is not executed and the errors are returned instead.
+func (i *Interpreter) ExecuteString(src string) error {
+	program, errs := i.parseSource(src)
+	if len(errs) > 0 {
+		return fmt.Errorf("parse error: %w", errs)
+	}
+	return i.Execute(program)
+}
+
+func (i *Interpreter) parseSource(src string) (*Program, ParseErrorList) {
+	start := time.Now()
+	parser := NewParser(NewLexer(src))
+	program := parser.Parse()
+	i.recordTime("parse", start)
+	return program, parser.ParseErrors()
+}
+
+func (i *Interpreter) executeStatement(stmt Node) error {
+	if err := i.checkContext(); err != nil {
+		return err
+	}
+
+	switch s := stmt.(type) {
+	case *Assignment:
+		val, err := i.evalValue(s.Value)
+		if err != nil {
+			return err
+		}
+		i.variables[s.Name] = val
+		return nil
+	case *DestructuringAssignment:
+		return i.executeDestructuring(s)
+	case *AskStatement:
+		return i.executeAsk(s)
+	case *IfStatement:
+		return i.executeIf(s)
+	case *RepeatStatement:
+		return i.executeRepeat(s)
+	case *WhileStatement:
+		return i.executeWhile(s)
+	case *ForStatement:
+		return i.executeFor(s)
+	case *GroupBlock:
+		return i.executeGroup(s)
+	case *ShellCommand:
+		return i.tolerateExit(i.executeShell(s))
+	case *MCPCall:
+		return i.tolerateExit(i.executeMCP(s))
+	case *IncrementDecrement:
+		return i.executeIncrementDecrement(s)
+	case *CompoundAssignment:
+		return i.executeCompoundAssignment(s)
+	case *RunStatement:
+		return i.executeRun(s)
+	case *RefineStatement:
+		return i.executeRefine(s)
+	case *BreakStatement:
+		return errBreak
+	case *ContinueStatement:
+		return errContinue
+	case *BeforeBlock, *AfterBlock, *PromptDefinition, *SetupBlock, *RequireStatement:
+		// Already processed
 		return nil
 	}
+	return nil
+}
+
+func (i *Interpreter) executeHook(hook Node) error {
+	if err := i.checkContext(); err != nil {
+		return err
+	}
+
+	switch h := hook.(type) {
+	case *ShellCommand:
+		return i.executeShell(h)
+	case *MCPCall:
+		return i.executeMCP(h)
+	case *IfStatement:
+		// A hook block with a when condition
+		ok, err := i.evalCondition(h.Condition)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			i.log("  [Skipping hooks: %s is false]", h.Condition.String())
+			return nil
+		}
+		for _, stmt := range h.Consequence {
+			if err := i.executeHook(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *Interpreter) evalValue(node Node) (interface{}, error) {
+	switch n := node.(type) {
+	case *StringLiteral:
+		return i.interpolate(n.Value), nil
+	case *NumberLiteral:
+		return n.Value, nil
+	case *BooleanLiteral:
+		return n.Value, nil
+	case *Identifier:
+		if val, ok := i.variables[n.Name]; ok {
+			return val, nil
+		}
+		return n.Name, nil
+	case *ListLiteral:
+		var result []interface{}
+		for _, elem := range n.Elements {
+			val, err := i.evalValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, val)
+		}
+		return result, nil
+	case *CallExpression:
+		return i.evalCall(n)
+	case *ListComprehension:
+		return i.evalComprehension(n)
+	case *AskStatement:
+		return i.runAsk(n, true)
+	case *ShellCommand:
+		output, err := i.runShell(n, true)
+		return output, i.tolerateExit(err)
+	case *SucceedsExpression:
+		// A non-zero exit is a result, not an error; anything else (policy,
+		// cancellation, timeouts) still fails the run. A failing check is
+		// a result too, so only an explicit retries= runs it again.
+		// A command that did not run, on --dry-run or when declined, did
+		// not succeed.
+		check := *n.Command
+		if check.Retries == nil {
+			check.Retries = &NumberLiteral{Value: 0}
+		}
+		i.exitIsResult = true
+		_, err := i.shellStep(&check, false)
+		i.exitIsResult = false
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			i.log("  ⚠ %v", err)
+			return false, nil
+		}
+		if errors.Is(err, errStepSkipped) {
+			return false, nil
+		}
+		return err == nil, err
+	case *Condition:
+		return i.evalCondition(n)
+	case *TernaryExpression:
+		ok, err := i.evalCondition(n.Condition)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return i.evalValue(n.Then)
+		}
+		return i.evalValue(n.Else)
+	case *IndexExpression:
+		target, err := i.evalValue(n.Target)
+		if err != nil {
+			return nil, err
+		}
+		index, err := i.evalValue(n.Index)
+		if err != nil {
+			return nil, err
+		}
+		return indexValue(target, index, n.Target.String())
+	case *BinaryExpression:
+		left, err := i.evalValue(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := i.evalValue(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		return evalBinary(n.Operator, left, right)
+	}
+	return nil, nil
+}
+
+// hasSideEffects reports whether evaluating node runs a step, in which case
+// it is left out of the first pass and only evaluated in program order.
+func hasSideEffects(node Node) bool {
+	switch n := node.(type) {
+	case *AskStatement, *ShellCommand, *SucceedsExpression:
+		return true
+	case *ListLiteral:
+		for _, elem := range n.Elements {
+			if hasSideEffects(elem) {
+				return true
+			}
+		}
+	case *CallExpression:
+		for _, arg := range n.Args {
+			if hasSideEffects(arg) {
+				return true
+			}
+		}
+	case *BinaryExpression:
+		return hasSideEffects(n.Left) || hasSideEffects(n.Right)
+	case *IndexExpression:
+		return hasSideEffects(n.Target) || hasSideEffects(n.Index)
+	case *Condition:
+		return hasSideEffects(n.Left) || hasSideEffects(n.Right)
+	case *TernaryExpression:
+		return hasSideEffects(n.Condition) || hasSideEffects(n.Then) || hasSideEffects(n.Else)
+	case *ListComprehension:
+		return hasSideEffects(n.Expr) || hasSideEffects(n.Iterable)
+	}
+	return false
+}
+
+// executeDestructuring distributes a list value over several variables.
+// Captured text is split into a list first: a JSON array is decoded,
+// otherwise each non-empty line is one element. A count mismatch is
+// logged and missing names are set to an empty string.
+func (i *Interpreter) executeDestructuring(d *DestructuringAssignment) error {
+	val, err := i.evalValue(d.Value)
+	if err != nil {
+		return err
+	}
+
+	var items []interface{}
+	switch v := val.(type) {
+	case []interface{}:
+		items = v
+	default:
+		items = splitOutput(toString(v))
+	}
+
+	if len(items) != len(d.Names) {
+		i.log("  ⚠ %s: expected %d values, got %d", strings.Join(d.Names, ", "), len(d.Names), len(items))
+	}
+	for n, name := range d.Names {
+		if n < len(items) {
+			i.variables[name] = items[n]
+		} else {
+			i.variables[name] = ""
+		}
+	}
+	return nil
+}
+
+// splitOutput turns captured command output into a list of values.
+func splitOutput(out string) []interface{} {
+	out = strings.TrimSpace(out)
+	if strings.HasPrefix(out, "[") {
+		var items []interface{}
+		if err := json.Unmarshal([]byte(out), &items); err == nil {
+			return items
+		}
+	}
+
+	var items []interface{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items
+}
+
+// evalComprehension maps Expr over Iterable, binding Var for each element
+// and keeping only elements that satisfy Filter. The loop variable shadows
+// any existing variable of the same name and is restored afterwards.
+func (i *Interpreter) evalComprehension(comp *ListComprehension) (interface{}, error) {
+	source, err := i.evalValue(comp.Iterable)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := source.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot iterate over %s: not a list", comp.Iterable.String())
+	}
+
+	saved, hadSaved := i.variables[comp.Var]
+	defer func() {
+		if hadSaved {
+			i.variables[comp.Var] = saved
+		} else {
+			delete(i.variables, comp.Var)
+		}
+	}()
+
+	result := []interface{}{}
+	for _, item := range items {
+		i.variables[comp.Var] = item
+		if comp.Filter != nil {
+			keep, err := i.evalCondition(comp.Filter)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+		}
+		val, err := i.evalValue(comp.Expr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, val)
+	}
+	return result, nil
+}
+
+// indexValue returns element index of target, which must be a list. what
+// names the target in errors; an index out of range is an error, not a
+// panic.
+func indexValue(target, index interface{}, what string) (interface{}, error) {
+	list, ok := target.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot index %s: not a list", what)
+	}
+	pos, ok := index.(float64)
+	if !ok || pos != math.Trunc(pos) {
+		return nil, fmt.Errorf("index of %s must be a whole number, got %s", what, formatValue(index))
+	}
+	if pos < 0 || pos >= float64(len(list)) {
+		return nil, fmt.Errorf("index %d out of range for %s (length %d)", int(pos), what, len(list))
+	}
+	return list[int(pos)], nil
+}
+
+// evalBinary applies a binary operator. For "+", a list on the left
+// appends a scalar or concatenates another list; two numbers are added.
+func evalBinary(op string, left, right interface{}) (interface{}, error) {
+	switch op {
+	case "+":
+		if list, ok := left.([]interface{}); ok {
+			result := append([]interface{}{}, list...)
+			if other, ok := right.([]interface{}); ok {
+				return append(result, other...), nil
+			}
+			return append(result, right), nil
+		}
+		// With a string on either side, + concatenates
+		_, lstr := left.(string)
+		_, rstr := right.(string)
+		if lstr || rstr {
+			return toString(left) + toString(right), nil
+		}
+		l, lok := left.(float64)
+		r, rok := right.(float64)
+		if lok && rok {
+			return l + r, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported operands for %s: %s and %s", op, formatValue(left), formatValue(right))
+}
+
+func (i *Interpreter) evalCondition(cond *Condition) (bool, error) {
+	if cond.Operator == "&&" || cond.Operator == "||" {
+		// Short-circuit: the right side is only evaluated when the left
+		// side does not already decide the result
+		left, err := i.evalCondition(cond.Left.(*Condition))
+		if err != nil || left == (cond.Operator == "||") {
+			return left, err
+		}
+		return i.evalCondition(cond.Right.(*Condition))
+	}
+	switch cond.Operator {
+	case "":
+		// A name that is not a variable is false here, not the bare word it
+		// stands for elsewhere, so "if deploy" is off until deploy is set
+		if ident, ok := cond.Left.(*Identifier); ok {
+			if _, defined := i.variables[ident.Name]; !defined {
+				return false, nil
+			}
+		}
+		val, err := i.evalValue(cond.Left)
+		return truthy(val), err
+	case "!":
+		holds, err := i.evalCondition(cond.Left.(*Condition))
+		return !holds, err
+	}
+
+	left, err := i.evalValue(cond.Left)
+	if err != nil {
+		return false, err
+	}
+	right, err := i.evalValue(cond.Right)
+	if err != nil {
+		return false, err
+	}
+
+	switch cond.Operator {
+	case "==":
+		return valuesEqual(left, right), nil
+	case "!=":
+		return !valuesEqual(left, right), nil
+	case "<":
+		return toFloat(left) < toFloat(right), nil
+	case ">":
+		return toFloat(left) > toFloat(right), nil
+	case "<=":
+		return toFloat(left) <= toFloat(right), nil
+	case ">=":
+		return toFloat(left) >= toFloat(right), nil
+	}
+	return false, nil
+}
+
+// ============================================================================
+// BUILTINS
+// ============================================================================
+
+type builtinFunc func(args []interface{}) (interface{}, error)
+
+var builtins = map[string]struct {
+	arity int
+	fn    builtinFunc
+}{
+	"contains": {2, func(args []interface{}) (interface{}, error) {
+		return strings.Contains(toString(args[0]), toString(args[1])), nil
+	}},
+	"replace": {3, func(args []interface{}) (interface{}, error) {
+		return strings.ReplaceAll(toString(args[0]), toString(args[1]), toString(args[2])), nil
+	}},
+	"append": {2, func(args []interface{}) (interface{}, error) {
+		return evalBinary("+", toList(args[0]), []interface{}{args[1]})
+	}},
+	"upper": {1, func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(toString(args[0])), nil
+	}},
+	"lower": {1, func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(toString(args[0])), nil
+	}},
+	// sum of an empty list is 0; min and max of an empty list are errors
+	"sum": {1, func(args []interface{}) (interface{}, error) {
+		total := 0.0
+		for _, item := range toList(args[0]) {
+			total += toFloat(item)
+		}
+		return total, nil
+	}},
+	"min": {1, func(args []interface{}) (interface{}, error) {
+		return reduceNumbers("min", toList(args[0]), func(a, b float64) bool { return a < b })
+	}},
+	"max": {1, func(args []interface{}) (interface{}, error) {
+		return reduceNumbers("max", toList(args[0]), func(a, b float64) bool { return a > b })
+	}},
+	"json_get": {2, func(args []interface{}) (interface{}, error) {
+		return jsonGet(toString(args[0]), toString(args[1]))
+	}},
+	"len": {1, func(args []interface{}) (interface{}, error) {
+		switch val := args[0].(type) {
+		case []interface{}:
+			return float64(len(val)), nil
+		case string:
+			return float64(len([]rune(val))), nil
+		}
+		return nil, fmt.Errorf("len: %s has no length", formatValue(args[0]))
+	}},
+	"split": {2, func(args []interface{}) (interface{}, error) {
+		var result []interface{}
+		for _, part := range strings.Split(toString(args[0]), toString(args[1])) {
+			result = append(result, part)
+		}
+		return result, nil
+	}},
+}
+
+// jsonGet decodes doc and walks a dotted path such as "data.items.0.id" or
+// "data.items[0].id"; numeric segments index arrays. Objects are returned
+// re-encoded as JSON so they can be walked again, arrays as lists.
+func jsonGet(doc, path string) (interface{}, error) {
+	var val interface{}
+	if err := json.Unmarshal([]byte(doc), &val); err != nil {
+		return nil, fmt.Errorf("json_get: invalid JSON: %w", err)
+	}
+
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	walked := ""
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			continue
+		}
+		walked = strings.TrimPrefix(walked+"."+key, ".")
+		switch node := val.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, fmt.Errorf("json_get: no %s in document", walked)
+			}
+			val = next
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, fmt.Errorf("json_get: no %s in document (array of %d)", walked, len(node))
+			}
+			val = node[idx]
+		default:
+			return nil, fmt.Errorf("json_get: no %s in document (not an object or array)", walked)
+		}
+	}
+
+	return jsonValue(val), nil
+}
+
+// jsonValue converts a decoded JSON value to a script value: objects
+// become their JSON text and arrays become lists.
+func jsonValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		out, _ := json.Marshal(v)
+		return string(out)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for idx, item := range v {
+			result[idx] = jsonValue(item)
+		}
+		return result
+	}
+	return val
+}
+
+// reduceNumbers returns the element of items that wins every comparison
+// by better, coercing each element with toFloat.
+func reduceNumbers(name string, items []interface{}, better func(a, b float64) bool) (interface{}, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%s of an empty list", name)
+	}
+	best := toFloat(items[0])
+	for _, item := range items[1:] {
+		if f := toFloat(item); better(f, best) {
+			best = f
+		}
+	}
+	return best, nil
+}
+
+func (i *Interpreter) evalCall(call *CallExpression) (interface{}, error) {
+	builtin, ok := builtins[call.Function]
+	if !ok {
+		return nil, fmt.Errorf("unknown function: %s", call.Function)
+	}
+	if len(call.Args) != builtin.arity {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", call.Function, builtin.arity, len(call.Args))
+	}
+
+	var args []interface{}
+	for _, arg := range call.Args {
+		val, err := i.evalValue(arg)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, val)
+	}
+	return builtin.fn(args)
+}
+
+// truthy reports whether v holds as a bare condition: booleans are
+// themselves, numbers are true unless zero, strings and lists unless empty.
+func truthy(v interface{}) bool {
+	switch val := v.(type) {
+	case bool:
+		return val
+	case float64:
+		return val != 0
+	case int:
+		return val != 0
+	case string:
+		return val != ""
+	case []interface{}:
+		return len(val) > 0
+	case nil:
+		return false
+	}
+	return true
+}
+
+// valuesEqual compares two values, numerically when both sides are numbers
+// so that a counter holding 3 matches both 3 and "3.0".
+func valuesEqual(left, right interface{}) bool {
+	if toString(left) == toString(right) {
+		return true
+	}
+	l, ok := asNumber(left)
+	if !ok {
+		return false
+	}
+	r, ok := asNumber(right)
+	return ok && l == r
+}
+
+func asNumber(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toList returns v as a list, wrapping scalars in a single-element list.
+func toList(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+func toString(v interface{}) string {
+	return fmt.Sprintf("%v", v)
+}
+
+func toFloat(v interface{}) float64 {
+	switch val := v.(type) {
+	case float64:
+		return val
+	case int:
+		return float64(val)
+	case string:
+		f, _ := strconv.ParseFloat(val, 64)
+		return f
+	case bool:
+		if val {
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
+
+func (i *Interpreter) executeAsk(ask *AskStatement) error {
+	_, err := i.runAsk(ask, false)
+	return err
+}
+
+// askInstruction returns the interpolated instruction of an ask, taken
+// from the prompt library or a prompt file when the ask refers to one.
+// Relative prompt file paths are resolved against the script directory.
+func (i *Interpreter) askInstruction(ask *AskStatement) (string, error) {
+	instruction := ask.Instruction
+	switch {
+	case ask.PromptRef != "":
+		text, ok := i.prompts[ask.PromptRef]
+		if !ok {
+			return "", fmt.Errorf("undefined prompt: %s", ask.PromptRef)
+		}
+		instruction = text
+	case ask.PromptFile != "":
+		path := ask.PromptFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(i.baseDir, path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading prompt file %s: %w", ask.PromptFile, err)
+		}
+		instruction = strings.TrimSpace(string(content))
+	}
+	return i.interpolate(instruction), nil
+}
+
+// runAsk builds the prompt for an ask and sends it to Claude. When capture
+// is set, Claude's output is returned instead of being streamed.
+func (i *Interpreter) runAsk(ask *AskStatement, capture bool) (output string, err error) {
+	instruction, err := i.askInstruction(ask)
+	if err != nil {
+		return "", err
+	}
+	defer i.recordStep("ask", instruction, i.beginStep("ask", instruction), &err)
+
+	i.log("")
+	i.log("┌─────────────────────────────────────────────────────────────┐")
+	i.log("│ ASK: %s", truncateString(instruction, 53))
+	i.log("└─────────────────────────────────────────────────────────────┘")
+
+	// Build context from variables
+	context := i.buildContext()
+	prompt, err := i.buildPrompt(instruction, context)
+	if err != nil {
+		return "", err
+	}
+
+	if i.dumpPrompts {
+		i.dumpedPrompts = append(i.dumpedPrompts, DumpedPrompt{
+			Step:        len(i.dumpedPrompts) + 1,
+			Instruction: instruction,
+			Prompt:      prompt,
+		})
+		return "", nil
+	}
+
+	if err = i.checkExecAllowed("ask"); err != nil {
+		return "", err
+	}
+
+	call := claudeCall{prompt: prompt, tools: i.allowedTools, capture: capture}
+	if call.model, err = i.stepModel(ask); err != nil {
+		return "", err
+	}
+	if call.retries, err = i.stepRetries(ask.Retries); err != nil {
+		return "", err
+	}
+	// With only a --retry-budget, the budget alone limits the retries
+	if ask.Retries == nil && i.retries == 0 && i.retryBudget > 0 {
+		call.retries = -1
+	}
+	call.timeout = i.claudeTimeout
+	if ask.Timeout != nil {
+		if call.timeout, err = i.evalTimeout(ask.Timeout); err != nil {
+			return "", err
+		}
+	}
+	if ask.Tools != nil {
+		tools, err := i.evalValue(ask.Tools)
+		if err != nil {
+			return "", err
+		}
+		// An empty list inherits the global default
+		if list := toList(tools); len(list) > 0 {
+			call.tools = nil
+			for _, tool := range list {
+				call.tools = append(call.tools, toString(tool))
+			}
+		}
+	}
+
+	if i.dryRun {
+		i.log("[DRY RUN] Would send to Claude Code CLI:")
+		if i.previewLimit > 0 {
+			i.log("  Prompt: %s", i.preview(prompt))
+			return "", nil
+		}
+		i.log("  Prompt:")
+		for _, line := range strings.Split(prompt, "\n") {
+			if line == "" {
+				i.log("")
+				continue
+			}
+			i.log("    %s", line)
+		}
+		return "", nil
+	}
+
+	if output, err = i.callClaudeCode(call); err != nil {
+		return "", err
+	}
+	if capture {
+		output = i.echoCaptured(output)
+	}
+	i.remember(instruction, output)
+	if err = i.checkPostCondition(ask); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// checkPostCondition evaluates the "then assert" clause of an ask once
+// Claude has finished, failing the step when it does not hold.
+func (i *Interpreter) checkPostCondition(ask *AskStatement) error {
+	if ask.Assert == nil {
+		return nil
+	}
+	if i.fake {
+		i.log("  [FAKE] Skipped post-condition: %s", ask.Assert)
+		return nil
+	}
+
+	var holds bool
+	var err error
+	switch check := ask.Assert.(type) {
+	case *MCPCall:
+		holds, err = i.evalPredicate(check)
+	case *Condition:
+		holds, err = i.evalCondition(check)
+	}
+	if err != nil {
+		return err
+	}
+	if !holds {
+		return fmt.Errorf("post-condition failed: %s", ask.Assert)
+	}
+	i.log("  ✓ Post-condition holds: %s", ask.Assert)
+	return nil
+}
+
+// evalPredicate evaluates an MCP call used as an assertion. Only calls
+// that answer a yes/no question, such as fs.exists, are accepted.
+func (i *Interpreter) evalPredicate(call *MCPCall) (bool, error) {
+	req, err := i.resolveMCP(call)
+	if err != nil {
+		return false, err
+	}
+	if err := validateMCP(req); err != nil {
+		return false, err
+	}
+	if call.Service == "fs" && call.Method == "exists" {
+		path, err := i.fsPath(i.workDirName(), req.Arg())
+		if err != nil {
+			return false, err
+		}
+		return fileExists(path), nil
+	}
+	return false, fmt.Errorf("%s.%s cannot be used in an assertion", call.Service, call.Method)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// stepModel resolves the model for an ask. A model= modifier on the step
+// wins, then the --model-for entry for its kind= tag, then the --model
+// flag, then a model assignment in the script. An empty result leaves the
+// choice to the Claude CLI.
+func (i *Interpreter) stepModel(ask *AskStatement) (string, error) {
+	if ask.Model != nil {
+		model, err := i.evalValue(ask.Model)
+		if err != nil {
+			return "", err
+		}
+		return toString(model), nil
+	}
+	if ask.Kind != nil {
+		kind, err := i.evalValue(ask.Kind)
+		if err != nil {
+			return "", err
+		}
+		if model, ok := i.modelFor[toString(kind)]; ok {
+			return model, nil
+		}
+	}
+	if i.model != "" {
+		return i.model, nil
+	}
+	if model, ok := i.variables["model"]; ok {
+		return toString(model), nil
+	}
+	return "", nil
+}
+
+// evalTimeout evaluates a per-step timeout modifier. Strings are Go
+// durations ("90s", "20m") and plain numbers are seconds. A nil node means
+// the step has no override and zero is returned.
+func (i *Interpreter) evalTimeout(node Node) (time.Duration, error) {
+	if node == nil {
+		return 0, nil
+	}
+	val, err := i.evalValue(node)
+	if err != nil {
+		return 0, err
+	}
+	if secs, ok := val.(float64); ok {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(toString(val))
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %w", toString(val), err)
+	}
+	return d, nil
+}
+
+// commandContext derives the context for a single command, bounded by
+// timeout when it is positive.
+func (i *Interpreter) commandContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(i.ctx, timeout)
+	}
+	return context.WithCancel(i.ctx)
+}
+
+func (i *Interpreter) buildContext() map[string]interface{} {
+	context := make(map[string]interface{})
+	for k, v := range i.variables {
+		context[k] = v
+	}
+	return context
+}
+
+// controlVariables are variables the interpreter reads or sets as settings
+// or results of its own. buildPrompt leaves them out of the project
+// specification.
+var controlVariables = map[string]bool{
+	"model": true, "workdir": true, "prompt_template": true,
+	"last_exit": true, "summary": true,
+}
+
+// buildPrompt returns the prompt for one ask: the script's prompt_template
+// when it sets one, or else the project specification built from context.
+func (i *Interpreter) buildPrompt(instruction string, context map[string]interface{}) (string, error) {
+	// Settings for the interpreter itself are not part of the project
+	project := make(map[string]interface{}, len(context))
+	for name, val := range context {
+		if !controlVariables[name] {
+			project[name] = val
+		}
+	}
+
+	var fullContext string
+	if i.fullContext && len(project) > 0 {
+		if doc, err := json.MarshalIndent(maskSensitive(project), "", "  "); err == nil {
+			fullContext = string(doc)
+		}
+	}
+
+	if text, ok := context["prompt_template"]; ok {
+		return renderPromptTemplate(toString(text), instruction, context, i.history, fullContext)
+	}
+
+	var prompt strings.Builder
+
+	prompt.WriteString("You are building a project with the following specifications:\n\n")
+
+	// Well-known variables come first under their labels, then every other
+	// variable by name
+	labelled := map[string]bool{"task": true}
+	for _, known := range promptLabels {
+		labelled[known.name] = true
+		if val, ok := context[known.name]; ok {
+			prompt.WriteString(fmt.Sprintf("%s: %s\n", known.label, formatValue(val)))
+		}
+	}
+	for _, name := range sortedKeys(project) {
+		if labelled[name] {
+			continue
+		}
+		val := project[name]
+		if isSensitiveName(name) {
+			val = "***"
+		}
+		prompt.WriteString(fmt.Sprintf("%s: %s\n", name, formatValue(val)))
+	}
+	if task, ok := context["task"]; ok {
+		prompt.WriteString(fmt.Sprintf("\nMain Task: %v\n", task))
+	}
+
+	if fullContext != "" {
+		prompt.WriteString("\nAll project variables (JSON):\n```json\n")
+		prompt.WriteString(fullContext)
+		prompt.WriteString("\n```\n")
+	}
+
+	if len(i.history) > 0 {
+		prompt.WriteString("\nPrevious steps (oldest first):\n")
+		prompt.WriteString(formatHistory(i.history))
+	}
+
+	prompt.WriteString(fmt.Sprintf("\nCurrent Step: %s\n", instruction))
+	prompt.WriteString("\nPlease implement this step. Create all necessary files and code.")
+
+	return prompt.String(), nil
+}
+
+// formatHistory lists the prior asks of --max-prompt-history, numbered
+// from 1, each with the start of its captured result.
+func formatHistory(history []promptExchange) string {
+	var out strings.Builder
+	for n, exchange := range history {
+		out.WriteString(fmt.Sprintf("%d. %s\n", n+1, exchange.Instruction))
+		if exchange.Response != "" {
+			out.WriteString(fmt.Sprintf("   Result: %s\n", truncateString(strings.TrimSpace(exchange.Response), 200)))
+		}
+	}
+	return out.String()
+}
+
+// templateBuiltins are the functions and keywords of text/template. A
+// variable with one of these names is not registered as a function, so it
+// cannot change what {{len .tools}} or {{if ...}} mean.
+var templateBuiltins = map[string]bool{
+	"and": true, "call": true, "html": true, "index": true, "slice": true,
+	"js": true, "len": true, "not": true, "or": true, "print": true,
+	"printf": true, "println": true, "urlquery": true,
+	"eq": true, "ge": true, "gt": true, "le": true, "lt": true, "ne": true,
+	"block": true, "break": true, "continue": true, "define": true,
+	"else": true, "end": true, "if": true, "nil": true, "range": true,
+	"template": true, "with": true,
+}
+
+// renderPromptTemplate renders a prompt_template with text/template. Each
+// variable can be written {{name}}, formatted as ${name} would be, or
+// {{.name}} for the raw value (e.g. to range over a list); the step itself
+// is {{instruction}}. Names that are not identifiers or that are template
+// builtins are only in the data: {{.len}} or {{index . "api-spec"}}.
+//
+// The template replaces the whole built-in layout, so the --max-prompt-history
+// window and the --full-context document only appear where it places them:
+// {{history}} lists the prior asks (.history holds them as maps with
+// instruction and response) and {{full_context}} is the masked JSON
+// document, empty without --full-context. Like instruction, these two
+// names take precedence over variables of the same name.
+func renderPromptTemplate(text, instruction string, context map[string]interface{}, history []promptExchange, fullContext string) (string, error) {
+	data := map[string]interface{}{}
+	funcs := template.FuncMap{}
+	for name, val := range context {
+		if name == "prompt_template" {
+			continue
+		}
+		data[name] = val
+		if token.IsIdentifier(name) && !templateBuiltins[name] {
+			formatted := formatValue(val)
+			funcs[name] = func() string { return formatted }
+		}
+	}
+	data["instruction"] = instruction
+	funcs["instruction"] = func() string { return instruction }
+
+	exchanges := make([]interface{}, len(history))
+	for n, exchange := range history {
+		exchanges[n] = map[string]interface{}{"instruction": exchange.Instruction, "response": exchange.Response}
+	}
+	listed := formatHistory(history)
+	data["history"] = exchanges
+	funcs["history"] = func() string { return listed }
+	data["full_context"] = fullContext
+	funcs["full_context"] = func() string { return fullContext }
+
+	tmpl, err := template.New("prompt_template").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("prompt_template: %w", err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("prompt_template: %w", err)
+	}
+	return out.String(), nil
+}
+
+// promptLabels lists the well-known variables that buildPrompt shows under
+// a friendly label, in order.
+var promptLabels = []struct{ name, label string }{
+	{"project", "Project Name"},
+	{"victim", "Target Platform"},
+	{"frontend", "Frontend"},
+	{"backend", "Backend"},
+	{"db", "Database"},
+	{"ai", "AI Features"},
+	{"tools", "Tools"},
+}
+
+// sensitiveNameParts mark variable names whose values are masked in the
+// prompt and the --full-context document.
+var sensitiveNameParts = []string{"token", "secret", "password", "passwd", "apikey", "api_key", "api-key", "credential", "private_key", "private-key"}
+
+func isSensitiveName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, part := range sensitiveNameParts {
+		if strings.Contains(lower, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// minSecretLength keeps short values, such as "1" or "yes", from being
+// masked wherever they appear in the log.
+const minSecretLength = 4
+
+// sensitiveEnvValues returns the values of environment variables with
+// sensitive names.
+func sensitiveEnvValues() []string {
+	var values []string
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if isSensitiveName(name) && len(value) >= minSecretLength {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// redactSecrets replaces the values of sensitive variables, from the script
+// or the environment, with "***" in a log line, event or step record.
+func (i *Interpreter) redactSecrets(line string) string {
+	if r := i.secretReplacer(); r != nil {
+		return r.Replace(line)
+	}
+	return line
+}
+
+// secretReplacer returns a replacer masking the current secrets, or nil
+// when there are none. It is rebuilt only when the secrets change.
+func (i *Interpreter) secretReplacer() *strings.Replacer {
+	secrets := append([]string(nil), i.envSecrets...)
+	for name, val := range i.variables {
+		if str, ok := val.(string); ok && isSensitiveName(name) && len(str) >= minSecretLength {
+			secrets = append(secrets, str)
+		}
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	// Longer values first, so a secret containing another is masked whole
+	sort.Slice(secrets, func(a, b int) bool {
+		if len(secrets[a]) != len(secrets[b]) {
+			return len(secrets[a]) > len(secrets[b])
+		}
+		return secrets[a] < secrets[b]
+	})
+	if key := strings.Join(secrets, "\x00"); key != i.redactKey || i.redactor == nil {
+		pairs := make([]string, 0, 2*len(secrets))
+		for _, secret := range secrets {
+			pairs = append(pairs, secret, "***")
+		}
+		i.redactKey, i.redactor = key, strings.NewReplacer(pairs...)
+	}
+	return i.redactor
+}
+
+// redactingWriter masks secrets in command output streamed to w. Output is
+// held back until a line is complete, so that a secret split across two
+// writes is still masked; Flush writes what is left.
+type redactingWriter struct {
+	mu      sync.Mutex
+	r       *strings.Replacer
+	w       io.Writer
+	pending []byte
+}
+
+// maxPendingLine bounds how much of an unfinished line, such as a progress
+// bar redrawn with \r, a redactingWriter holds back.
+const maxPendingLine = 64 << 10
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.pending = append(rw.pending, p...)
+	end := bytes.LastIndexByte(rw.pending, '\n') + 1
+	if len(rw.pending) > maxPendingLine {
+		end = len(rw.pending)
+	}
+	if end > 0 {
+		io.WriteString(rw.w, rw.r.Replace(string(rw.pending[:end])))
+		rw.pending = append(rw.pending[:0], rw.pending[end:]...)
+	}
+	return len(p), nil
+}
+
+func (rw *redactingWriter) Flush() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if len(rw.pending) > 0 {
+		io.WriteString(rw.w, rw.r.Replace(string(rw.pending)))
+		rw.pending = nil
+	}
+}
+
+// redactStreams wraps stdout and stderr in redactingWriters when there are
+// secrets to mask. The returned flush must be called once the command has
+// finished.
+func (i *Interpreter) redactStreams(stdout, stderr io.Writer) (io.Writer, io.Writer, func()) {
+	r := i.secretReplacer()
+	if r == nil {
+		return stdout, stderr, func() {}
+	}
+	out := &redactingWriter{r: r, w: stdout}
+	errOut := &redactingWriter{r: r, w: stderr}
+	return out, errOut, func() {
+		out.Flush()
+		errOut.Flush()
+	}
+}
+
+// maskSensitive returns a copy of vars with the values of sensitive
+// variables replaced by "***".
+func maskSensitive(vars map[string]interface{}) map[string]interface{} {
+	masked := make(map[string]interface{}, len(vars))
+	for k, v := range vars {
+		if isSensitiveName(k) {
+			v = "***"
+		}
+		masked[k] = v
+	}
+	return masked
+}
+
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case []interface{}:
+		var items []string
+		for _, item := range val {
+			items = append(items, fmt.Sprintf("%v", item))
+		}
+		return strings.Join(items, ", ")
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// interpolate substitutes ${name} with the formatted value of the variable
+// name. Unknown names are left as written, or dropped with
+// SetUnknownVars("blank"). A literal "${" is written as
+// "\${" or "$${"; both escapes are resolved here, in the same pass, so that
+// substituted text is never rescanned.
+func (i *Interpreter) interpolate(s string) string {
+	return i.substitute(s, formatValue)
+}
+
+// interpolateShell interpolates a shell command. Each substituted value is
+// single-quoted, and each element of a list becomes a word of its own, so
+// values with spaces, quotes or $ reach the command intact and cannot run
+// anything.
+func (i *Interpreter) interpolateShell(s string) string {
+	return i.substitute(s, func(val interface{}) string {
+		items, ok := val.([]interface{})
+		if !ok {
+			return shellQuote(formatValue(val))
+		}
+		words := make([]string, len(items))
+		for n, item := range items {
+			words[n] = shellQuote(formatValue(item))
+		}
+		return strings.Join(words, " ")
+	})
+}
+
+// shellQuote quotes s as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// substitute replaces each ${name} in s with format applied to its value.
+func (i *Interpreter) substitute(s string, format func(interface{}) string) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+	var out strings.Builder
+	for pos := 0; pos < len(s); {
+		rest := s[pos:]
+		switch {
+		case strings.HasPrefix(rest, "\\${"), strings.HasPrefix(rest, "$${"):
+			out.WriteString("${")
+			pos += 3
+		case strings.HasPrefix(rest, "${"):
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				out.WriteString(rest)
+				return out.String()
+			}
+			name := strings.TrimSpace(rest[2:end])
+			if val, ok := i.lookupVariable(name); ok {
+				out.WriteString(format(val))
+			} else if !i.blankUnknown {
+				out.WriteString(rest[:end+1])
+			}
+			pos += end + 1
+		default:
+			out.WriteByte(s[pos])
+			pos++
+		}
+	}
+	return out.String()
+}
+
+// lookupVariable resolves an interpolated name: a variable, or an element
+// of a list variable as in ${tools[1]}. An index out of range is treated
+// like an unknown name.
+func (i *Interpreter) lookupVariable(name string) (interface{}, bool) {
+	if val, ok := i.variables[name]; ok {
+		return val, true
+	}
+	open := strings.IndexByte(name, '[')
+	if open < 0 || !strings.HasSuffix(name, "]") {
+		return nil, false
+	}
+	list, ok := i.variables[strings.TrimSpace(name[:open])]
+	if !ok {
+		return nil, false
+	}
+	pos, err := strconv.Atoi(strings.TrimSpace(name[open+1 : len(name)-1]))
+	if err != nil {
+		return nil, false
+	}
+	val, err := indexValue(list, float64(pos), name)
+	return val, err == nil
+}
+
+// claudeCall holds the settings for a single Claude CLI invocation.
+type claudeCall struct {
+	prompt  string
+	timeout time.Duration
+	tools   []string
+	model   string
+	capture bool // return stdout instead of streaming it
+	retries int  // attempts to repeat after a failure, with backoff; -1 for as many as the retry budget allows
+}
+
+// claudeInput is the user message written to the CLI's stdin in JSON mode,
+// in the CLI's stream-json input format.
+type claudeInput struct {
+	Type    string             `json:"type"`
+	Message claudeInputMessage `json:"message"`
+}
+
+type claudeInputMessage struct {
+	Role    string              `json:"role"`
+	Content []claudeContentPart `json:"content"`
+}
+
+type claudeContentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func newClaudeInput(prompt string) claudeInput {
+	return claudeInput{
+		Type: "user",
+		Message: claudeInputMessage{
+			Role:    "user",
+			Content: []claudeContentPart{{Type: "text", Text: prompt}},
+		},
+	}
+}
+
+// claudeEvent is one line of the CLI's stream-json output. Only the final
+// "result" event is used.
+type claudeEvent struct {
+	Type    string `json:"type"`
+	Result  string `json:"result"`
+	IsError bool   `json:"is_error"`
+}
+
+// claudeStreamResult returns the text of the last result event in the
+// CLI's stream-json output. Other events and lines that are not JSON are
+// ignored.
+func claudeStreamResult(out string) (string, error) {
+	var result *claudeEvent
+	for _, line := range strings.Split(out, "\n") {
+		var event claudeEvent
+		if json.Unmarshal([]byte(line), &event) == nil && event.Type == "result" {
+			result = &event
+		}
+	}
+	if result == nil {
+		return "", errors.New("Claude Code CLI output has no result event")
+	}
+	if result.IsError {
+		return "", fmt.Errorf("Claude Code CLI failed: %s", result.Result)
+	}
+	return result.Result, nil
+}
+
+func (i *Interpreter) claudeArgs(call claudeCall) []string {
+	args := []string{"--print"}
+
+	// Skip permissions for fast, non-interactive execution
+	if i.skipPermissions {
+		args = append(args, "--dangerously-skip-permissions")
+	}
+
+	// Use specific model if set (e.g., "haiku" for faster responses)
+	if call.model != "" {
+		args = append(args, "--model", call.model)
+	}
+
+	// Restrict the tools Claude may use for this step
+	if len(call.tools) > 0 {
+		args = append(args, "--allowedTools")
+		args = append(args, call.tools...)
+	}
+
+	if i.claudeMode == "json" {
+		// The prompt travels on stdin; stream-json output requires --verbose
+		return append(args, "--input-format", "stream-json", "--output-format", "stream-json", "--verbose")
+	}
+
+	// Add the prompt
+	return append(args, "-p", call.prompt)
+}
+
+func (i *Interpreter) callClaudeCode(call claudeCall) (string, error) {
+	defer i.recordTime("claude", time.Now())
+	i.log("  → Calling Claude Code CLI...")
+
+	if i.fake {
+		i.log("  [FAKE] Simulated Claude Code CLI call")
+		if call.capture {
+			return i.stubOutput("claude"), nil
+		}
+		return "", nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		output, err := i.runClaudeOnce(call)
+		if err == nil {
+			i.log("  ✓ Step completed")
+			return output, nil
+		}
+		if ctxErr := i.checkContext(); ctxErr != nil {
+			return "", ctxErr
+		}
+		// Only failures worth repeating are retried, up to the step's
+		// retries and within what is left of the run's budget
+		canRetry := retryable(err) && (call.retries < 0 || attempt <= call.retries)
+		if canRetry && i.retryBudget != 0 {
+			if i.retryBudget > 0 {
+				i.retryBudget--
+			}
+			if err := i.waitToRetry(attempt, call.retries, err); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		if i.continueOnError {
+			// Log the prompt instead of failing
+			i.log("  ⚠ %v; continuing", err)
+			i.log("  → Prompt would be: %s", truncateString(call.prompt, 100))
+			return "", nil
+		}
+		if canRetry {
+			// Only the spent budget stopped this retry
+			return "", fmt.Errorf("%w (retry budget exhausted)", err)
+		}
+		return "", err
+	}
+}
+
+// runClaudeOnce makes a single Claude CLI invocation.
+func (i *Interpreter) runClaudeOnce(call claudeCall) (string, error) {
+	args := i.claudeArgs(call)
+	dir, err := i.ensureWorkDir()
+	if err != nil {
+		return "", err
+	}
+
+	// A relative CLI path such as ./bin/claude would otherwise be looked
+	// up in the working directory
+	name := i.claudeCLI
+	if dir != "" && strings.ContainsRune(name, os.PathSeparator) {
+		if abs, err := filepath.Abs(name); err == nil {
+			name = abs
+		}
+	}
+
+	// Call Claude Code CLI
+	ctx, cancel := i.commandContext(call.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	setProcessGroup(cmd)
+	captured := &cappedBuffer{max: i.maxOutputBytes}
+	var stream bytes.Buffer
+	var flush func()
+	switch {
+	case i.claudeMode == "json":
+		payload, err := json.Marshal(newClaudeInput(call.prompt))
+		if err != nil {
+			return "", fmt.Errorf("encoding Claude request: %w", err)
+		}
+		cmd.Stdin = bytes.NewReader(append(payload, '\n'))
+		flush = i.captureOutput(cmd, &stream)
+	case call.capture:
+		flush = i.captureOutput(cmd, captured)
+	default:
+		flush = i.attachOutput(cmd, i.outputWriter)
+	}
+	// Keep the start of stderr for the error message, unless it shares a
+	// single pipe with stdout
+	stderr := &cappedBuffer{max: claudeErrorBytes}
+	if cmd.Stderr != cmd.Stdout {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	}
+
+	err = cmd.Run()
+	flush()
+	if err != nil {
+		if i.ctx.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", &TimeoutError{Step: "Claude Code CLI", Limit: call.timeout}
+		}
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			return "", fmt.Errorf("Claude Code CLI failed: %w: %s", err, msg)
+		}
+		return "", fmt.Errorf("Claude Code CLI not available or failed: %w", err)
+	}
+
+	if i.claudeMode == "json" {
+		result, err := claudeStreamResult(stream.String())
+		if err != nil {
+			return "", err
+		}
+		if !call.capture {
+			fmt.Fprintln(i.outputWriter, i.redactSecrets(result))
+			return "", nil
+		}
+		captured.Write([]byte(result))
+	}
+	return i.capturedOutput(captured), nil
+}
+
+// claudeErrorBytes is how much of the Claude CLI's stderr a failure
+// reports.
+const claudeErrorBytes = 2048
+
+// cappedBuffer collects output up to max bytes (no limit when max is 0)
+// and counts the bytes it drops. Writes never fail, so the child process
+// is not disturbed by the cap.
+type cappedBuffer struct {
+	buf     bytes.Buffer
+	max     int
+	dropped int
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if c.max > 0 {
+		if room := c.max - c.buf.Len(); len(p) > room {
+			c.dropped += len(p) - max(room, 0)
+			p = p[:max(room, 0)]
+		}
+	}
+	c.buf.Write(p)
+	return n, nil
+}
+
+// SetCombineOutput sends the stderr of Claude, shell and shell.run steps
+// to the same writer as their stdout, so the two keep the order in which
+// they were produced. The combined text is kept in the step record. Output
+// captured into a variable is still stdout only.
+func (i *Interpreter) SetCombineOutput(combine bool) {
+	i.combineOutput = combine
+}
+
+// attachOutput wires cmd's standard output to stdout and its standard
+// error to os.Stderr, or both to stdout when output is combined. Secrets
+// are masked in what is shown; call the returned flush after cmd has run.
+func (i *Interpreter) attachOutput(cmd *exec.Cmd, stdout io.Writer) (flush func()) {
+	if !i.combineOutput {
+		cmd.Stdout, cmd.Stderr, flush = i.redactStreams(stdout, os.Stderr)
+		return flush
+	}
+	// A single writer makes os/exec use one pipe for both streams
+	combined := &cappedBuffer{max: i.maxOutputBytes}
+	shown, _, flush := i.redactStreams(stdout, nil)
+	w := io.MultiWriter(shown, combined)
+	cmd.Stdout, cmd.Stderr = w, w
+	i.stepOutput = combined
+	return flush
+}
+
+// captureOutput wires cmd's standard output to captured and its standard
+// error to os.Stderr, so that a captured value never includes stderr. When
+// output is combined, both streams are also kept in the step record in the
+// order they arrive. As with attachOutput, call the returned flush after
+// cmd has run.
+func (i *Interpreter) captureOutput(cmd *exec.Cmd, captured io.Writer) (flush func()) {
+	_, stderr, flush := i.redactStreams(nil, os.Stderr)
+	if !i.combineOutput {
+		cmd.Stdout = captured
+		cmd.Stderr = stderr
+		return flush
+	}
+	combined := &cappedBuffer{max: i.maxOutputBytes}
+	record := &syncWriter{w: combined}
+	cmd.Stdout = io.MultiWriter(captured, record)
+	cmd.Stderr = io.MultiWriter(stderr, record)
+	i.stepOutput = combined
+	return flush
+}
+
+// syncWriter serialises writes to w, which the copying goroutines of a
+// command's separate stdout and stderr pipes would otherwise race on.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// echoCaptured trims trailing whitespace from output captured into a
+// variable and, when verbose, still shows it as a streamed step would.
+func (i *Interpreter) echoCaptured(output string) string {
+	output = strings.TrimRightFunc(output, unicode.IsSpace)
+	if i.verbose && output != "" {
+		fmt.Fprintln(i.outputWriter, i.redactSecrets(output))
+	}
+	return output
+}
+
+// capturedOutput returns the captured text, with a marker and a logged
+// warning when output was dropped by the --max-output-bytes cap.
+func (i *Interpreter) capturedOutput(c *cappedBuffer) string {
+	if c.dropped == 0 {
+		return c.buf.String()
+	}
+	i.log("  ⚠ Captured output truncated to %d bytes (%d bytes dropped)", c.max, c.dropped)
+	return c.buf.String() + fmt.Sprintf("\n[... output truncated: %d bytes over the %d byte limit]", c.dropped, c.max)
+}
+
+func (i *Interpreter) executeIf(ifStmt *IfStatement) error {
+	matched, err := i.evalCondition(ifStmt.Condition)
+	if err != nil {
+		return err
+	}
+	if matched {
+		for _, stmt := range ifStmt.Consequence {
+			if err := i.executeStatement(stmt); err != nil {
+				return err
+			}
+		}
+	} else if ifStmt.Alternative != nil {
+		for _, stmt := range ifStmt.Alternative {
+			if err := i.executeStatement(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// repeatCount evaluates the count of a repeat loop. A negative count runs
+// the body zero times.
+func (i *Interpreter) repeatCount(repeat *RepeatStatement) (int, error) {
+	val, err := i.evalValue(repeat.Count)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := val.(float64)
+	if str, isString := val.(string); isString {
+		n, err = strconv.ParseFloat(strings.TrimSpace(str), 64)
+		ok = err == nil
+	}
+	if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("repeat: count %s is not a number (%s)", repeat.Count, formatValue(val))
+	}
+	if n < 0 {
+		i.log("  ⚠ repeat count %s is negative (%g), skipping the loop", repeat.Count, n)
+		return 0, nil
+	}
+	return int(n), nil
+}
+
+func (i *Interpreter) executeRepeat(repeat *RepeatStatement) error {
+	count, err := i.repeatCount(repeat)
+	if err != nil {
+		return err
+	}
+	for j := 0; j < count; j++ {
+		if repeat.While != nil {
+			ok, err := i.evalCondition(repeat.While)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				i.log("  [Repeat stopped after %d/%d: %s no longer holds]", j, count, repeat.While.String())
+				break
+			}
+		}
+		i.log("  [Repeat %d/%d]", j+1, count)
+		if stop, err := loopControl(i.executeIteration(repeat.Body)); stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// executeWhile runs the loop body while its condition holds. A dry run
+// stops after one iteration, since the condition usually depends on what
+// the body would have done.
+func (i *Interpreter) executeWhile(loop *WhileStatement) error {
+	for j := 0; ; j++ {
+		ok, err := i.evalCondition(loop.Condition)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			i.log("  [While stopped after %d iteration(s): %s no longer holds]", j, loop.Condition.String())
+			return nil
+		}
+		if j >= i.maxIterations {
+			return fmt.Errorf("while: %s still holds after %d iterations", loop.Condition.String(), i.maxIterations)
+		}
+		if i.dryRun && j > 0 {
+			i.log("  [DRY RUN] Would repeat while %s (max %d)", loop.Condition.String(), i.maxIterations)
+			return nil
+		}
+		i.log("  [While %d]", j+1)
+		if stop, err := loopControl(i.executeIteration(loop.Body)); stop {
+			return err
+		}
+	}
+}
+
+// executeRefine asks until the refine's condition holds, storing each
+// response in the response variable. Running out of attempts fails the step.
+func (i *Interpreter) executeRefine(refine *RefineStatement) error {
+	for attempt := 1; attempt <= refine.Max; attempt++ {
+		i.log("  [Refine %d/%d]", attempt, refine.Max)
+		output, err := i.runAsk(refine.Ask, true)
+		if err != nil {
+			return err
+		}
+		i.variables["response"] = output
+		if i.dryRun {
+			i.log("  [DRY RUN] Would repeat until %s (max %d)", refine.Until.String(), refine.Max)
+			return nil
+		}
+
+		ok, err := i.evalCondition(refine.Until)
+		if err != nil {
+			return err
+		}
+		if ok {
+			i.log("  ✓ Refined after %d attempt(s): %s", attempt, refine.Until.String())
+			return nil
+		}
+	}
+	return fmt.Errorf("refine: %s still false after %d attempts", refine.Until.String(), refine.Max)
+}
+
+// break and continue unwind to the enclosing loop as these errors. One that
+// reaches the top of the script was used outside a loop and fails the run.
+var (
+	errBreak    = errors.New("break used outside a loop")
+	errContinue = errors.New("continue used outside a loop")
+)
+
+// loopControl interprets the result of one loop iteration: break stops the
+// loop without an error, continue goes on to the next iteration and any
+// other error stops the loop with it.
+func loopControl(err error) (stop bool, _ error) {
+	switch {
+	case err == nil, errors.Is(err, errContinue):
+		return false, nil
+	case errors.Is(err, errBreak):
+		return true, nil
+	}
+	return true, err
+}
+
+// executeIteration runs one iteration of a loop body. The body's "before
+// each" blocks run first and its "after each" blocks run last, even when
+// the iteration failed.
+func (i *Interpreter) executeIteration(body []Node) (err error) {
+	var beforeEach, afterEach, steps []Node
+	for _, stmt := range body {
+		switch s := stmt.(type) {
+		case *BeforeBlock:
+			if s.Each {
+				beforeEach = append(beforeEach, guardHooks(s.When, s.Statements)...)
+				continue
+			}
+		case *AfterBlock:
+			if s.Each {
+				afterEach = append(afterEach, guardHooks(s.When, s.Statements)...)
+				continue
+			}
+		}
+		steps = append(steps, stmt)
+	}
+	if i.hooksSkipped() {
+		beforeEach, afterEach = nil, nil
+	}
+
+	defer func() {
+		for _, stmt := range afterEach {
+			if hookErr := i.executeStatement(stmt); hookErr != nil {
+				if err == nil {
+					err = fmt.Errorf("after each failed: %w", hookErr)
+				}
+				return
+			}
+		}
+	}()
+
+	for _, stmt := range beforeEach {
+		if err := i.executeStatement(stmt); err != nil {
+			return fmt.Errorf("before each failed: %w", err)
+		}
+	}
+	for _, stmt := range steps {
+		if err := i.executeStatement(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executeFor binds the loop variables for each element of the list and
+// runs the body. The variables are restored to their previous values (or
+// removed) once the loop ends.
+func (i *Interpreter) executeFor(loop *ForStatement) error {
+	source, err := i.evalValue(loop.Iterable)
+	if err != nil {
+		return err
+	}
+	items, ok := source.([]interface{})
+	if !ok {
+		return fmt.Errorf("cannot iterate over %s: not a list", loop.Iterable.String())
+	}
+
+	names := []string{loop.Var}
+	if loop.Index != "" {
+		names = append(names, loop.Index)
+	}
+	for _, name := range names {
+		saved, hadSaved := i.variables[name]
+		defer func(name string) {
+			if hadSaved {
+				i.variables[name] = saved
+			} else {
+				delete(i.variables, name)
+			}
+		}(name)
+	}
+
+	for j, item := range items {
+		i.log("  [For %d/%d]", j+1, len(items))
+		if loop.Index != "" {
+			i.variables[loop.Index] = float64(j)
+		}
+		i.variables[loop.Var] = item
+		if stop, err := loopControl(i.executeIteration(loop.Body)); stop {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Interpreter) executeGroup(group *GroupBlock) error {
+	i.log("")
+	i.log("─── %s ───", group.Name)
+	i.groups = append(i.groups, group.Name)
+	defer func() {
+		i.groups = i.groups[:len(i.groups)-1]
+		i.log("─── end %s ───", group.Name)
+	}()
+
+	for _, stmt := range group.Body {
+		if err := i.executeStatement(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSetupCycles rejects setups that run themselves, directly or through
+// other setups, before any of them is expanded.
+func checkSetupCycles(setups map[string][]Node) error {
+	names := make([]string, 0, len(setups))
+	for name := range setups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		for idx, seen := range path {
+			if seen == name {
+				return fmt.Errorf("setup %q invokes itself: %s", name, strings.Join(append(path[idx:], name), " -> "))
+			}
+		}
+		path = append(path, name)
+		var err error
+		eachStatement(setups[name], func(stmt Node) {
+			if run, ok := stmt.(*RunStatement); ok && err == nil {
+				if _, defined := setups[run.Name]; defined {
+					err = visit(run.Name, path)
+				}
+			}
+		})
+		return err
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Interpreter) executeRun(run *RunStatement) error {
+	body, ok := i.setups[run.Name]
+	if !ok {
+		return fmt.Errorf("undefined setup: %s", run.Name)
+	}
+	if i.runningSetups[run.Name] {
+		return fmt.Errorf("setup %q invokes itself", run.Name)
+	}
+	i.runningSetups[run.Name] = true
+	defer delete(i.runningSetups, run.Name)
+
+	i.log("  ▶ Setup: %s", run.Name)
+	for _, stmt := range body {
+		if err := i.executeStatement(stmt); err != nil {
+			return fmt.Errorf("setup %q failed: %w", run.Name, err)
+		}
+	}
+	return nil
+}
+
+func (i *Interpreter) executeShell(shell *ShellCommand) error {
+	_, err := i.runShell(shell, false)
+	return err
+}
+
+// errStepSkipped is returned by a step that did not run, on --dry-run or
+// when its approval was declined. It is recorded as a skipped step.
+var errStepSkipped = errors.New("step skipped")
+
+// runShell runs a shell command. When capture is set its standard output is
+// returned, trimmed, instead of being streamed to the output writer. A
+// skipped command returns no output and no error.
+func (i *Interpreter) runShell(shell *ShellCommand, capture bool) (string, error) {
+	output, err := i.shellStep(shell, capture)
+	if errors.Is(err, errStepSkipped) {
+		return output, nil
+	}
+	return output, err
+}
+
+// shellStep runs a shell command as one step, returning errStepSkipped if
+// it did not run.
+func (i *Interpreter) shellStep(shell *ShellCommand, capture bool) (output string, err error) {
+	defer i.recordTime("shell", time.Now())
+	command := i.interpolateShell(shell.Command)
+	defer i.recordStep("shell", command, i.beginStep("shell", command), &err)
+	i.log("  → Shell: %s", command)
+
+	if err := i.checkExecAllowed("shell"); err != nil {
+		return "", err
+	}
+	if err := i.checkCommandAllowed(command); err != nil {
+		return "", err
+	}
+
+	timeout := i.shellTimeout
+	if shell.Timeout != nil {
+		if timeout, err = i.evalTimeout(shell.Timeout); err != nil {
+			return "", err
+		}
+	}
+
+	if i.dryRun {
+		i.log("  [DRY RUN] Would execute: %s", command)
+		i.variables["last_exit"] = float64(0)
+		return "", errStepSkipped
+	}
+
+	if i.fake {
+		i.log("  [FAKE] Simulated shell command")
+		i.variables["last_exit"] = float64(0)
+		if capture {
+			return i.stubOutput("shell"), nil
+		}
+		return "", nil
+	}
+
+	if !i.approved("shell", command) {
+		i.log("  ⚠ Skipped: not approved")
+		// A declined command did not succeed; -1 as for one that never started
+		i.variables["last_exit"] = float64(-1)
+		return "", errStepSkipped
+	}
+
+	dir, err := i.ensureWorkDir()
+	if err != nil {
+		return "", err
+	}
+	retries, err := i.stepRetries(shell.Retries)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		output, err = i.runShellOnce(command, dir, timeout, capture)
+		if err == nil || attempt > retries || !retryable(err) || i.checkContext() != nil {
+			return output, err
+		}
+		if err := i.waitToRetry(attempt, retries, err); err != nil {
+			return "", err
+		}
+	}
+}
+
+// runShellOnce makes a single attempt at a shell command.
+func (i *Interpreter) runShellOnce(command, dir string, timeout time.Duration, capture bool) (output string, err error) {
+	ctx, cancel := i.commandContext(timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	setProcessGroup(cmd)
+	captured := &cappedBuffer{max: i.maxOutputBytes}
+	var flush func()
+	if capture {
+		flush = i.captureOutput(cmd, captured)
+	} else {
+		flush = i.attachOutput(cmd, i.outputWriter)
+	}
+
+	err = cmd.Run()
+	flush()
+	i.setLastExit(cmd, err)
+	if err != nil {
+		if ctxErr := i.checkContext(); ctxErr != nil {
+			return "", ctxErr
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", &TimeoutError{Step: "shell command", Limit: timeout}
+		}
+		// What the command printed before failing is kept, for
+		// --continue-on-error
+		if capture {
+			output = i.echoCaptured(i.capturedOutput(captured))
+		}
+		return output, fmt.Errorf("shell command failed: %w", err)
+	}
+
+	i.log("  ✓ Shell command completed")
+	if capture {
+		output = i.echoCaptured(i.capturedOutput(captured))
+	}
+	return output, nil
+}
+
+// retryBackoff is the wait before the first retry of a failed step; it
+// doubles with every further attempt, up to maxRetryBackoff.
+var (
+	retryBackoff    = time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+// stepRetries returns how many times a failing step may be retried: its
+// retries= modifier when given, else --retries.
+func (i *Interpreter) stepRetries(node Node) (int, error) {
+	if node == nil {
+		return i.retries, nil
+	}
+	val, err := i.evalValue(node)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := val.(float64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("retries must be a non-negative number, got %s", formatValue(val))
+	}
+	return int(n), nil
+}
+
+// retryable reports whether a failed step is worth running again: the
+// command exited with a non-zero status or timed out.
+func retryable(err error) bool {
+	var exitErr *exec.ExitError
+	var timeoutErr *TimeoutError
+	return errors.As(err, &exitErr) || errors.As(err, &timeoutErr)
+}
+
+// waitToRetry logs a failed attempt and waits out its backoff, returning
+// early if the run is cancelled meanwhile.
+func (i *Interpreter) waitToRetry(attempt, retries int, err error) error {
+	delay := retryBackoff << (attempt - 1)
+	if delay > maxRetryBackoff || delay <= 0 {
+		delay = maxRetryBackoff
+	}
+	of := ""
+	if retries >= 0 {
+		of = fmt.Sprintf(" of %d", retries+1)
+	}
+	i.log("  ⚠ %v; retrying in %s (attempt %d%s)", err, delay, attempt+1, of)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-i.ctx.Done():
+		return i.checkContext()
+	}
+}
+
+// setLastExit stores the exit status of a finished command in last_exit:
+// 0 on success, the status it exited with, or -1 when it could not be
+// started or was killed by a signal. A command declined at an
+// --interactive-approve prompt also leaves -1.
+func (i *Interpreter) setLastExit(cmd *exec.Cmd, runErr error) {
+	code := 0
+	if cmd.ProcessState != nil {
+		code = cmd.ProcessState.ExitCode()
+	} else if runErr != nil {
+		code = -1
+	}
+	i.variables["last_exit"] = float64(code)
+}
+
+// tolerateExit drops the error of a command that exited with a non-zero
+// status when --continue-on-error is set; last_exit already holds the
+// status. Other errors are returned unchanged.
+func (i *Interpreter) tolerateExit(err error) error {
+	var exitErr *exec.ExitError
+	if i.continueOnError && errors.As(err, &exitErr) && i.checkContext() == nil {
+		i.log("  ⚠ %v; continuing", err)
+		return nil
+	}
+	return err
+}
+
+// mcpMethod describes the arguments an MCP method expects.
+type mcpMethod struct {
+	args     int      // number of non-empty positional arguments required
+	keys     []string // named arguments accepted; a single JSON object argument may give them instead
+	required []string // named arguments that must be given
+}
+
+// mcpServices is the registry of known MCP services and their methods. A
+// nil method map accepts any method without validation. Services missing
+// from the registry are not rejected at run time; vibe lint reports them.
+var mcpServices = map[string]map[string]mcpMethod{
+	"shell": {
+		"run": {args: 1},
+	},
+	"fs": {
+		"write":  {keys: []string{"path", "content"}, required: []string{"path"}},
+		"append": {keys: []string{"path", "content"}, required: []string{"path"}},
+		"mkdir":  {args: 1},
+		"read":   {args: 1},
+		"exists": {args: 1},
+		"copy":   {args: 2},
+		"move":   {args: 2},
+	},
+	"browser": nil,
+}
+
+// mcpRequest is an MCP call with its arguments resolved, ready to run.
+type mcpRequest struct {
+	Service string
+	Method  string
+	Args    []string
+	Named   map[string]interface{}
+}
+
+// Arg returns the first positional argument.
+func (r *mcpRequest) Arg() string {
+	if len(r.Args) == 0 {
+		return ""
+	}
+	return r.Args[0]
+}
+
+// resolveMCP interpolates the positional arguments of call and evaluates its
+// named ones. The parsed program is left untouched.
+func (i *Interpreter) resolveMCP(call *MCPCall) (*mcpRequest, error) {
+	req := &mcpRequest{Service: call.Service, Method: call.Method}
+	for _, arg := range call.Args {
+		req.Args = append(req.Args, i.interpolateArg(call, arg))
+	}
+	if len(call.Named) > 0 {
+		req.Named = make(map[string]interface{})
+		for key, node := range call.Named {
+			val, err := i.evalValue(node)
+			if err != nil {
+				return nil, err
+			}
+			req.Named[key] = val
+		}
+	}
+	return req, nil
+}
+
+// validateMCP checks a call to a registered service and returns a
+// descriptive error for unknown methods or missing arguments. For methods
+// with named arguments, a JSON object given as the only argument is decoded
+// into mcp.Named.
+func validateMCP(mcp *mcpRequest) error {
+	methods := mcpServices[mcp.Service]
+	if methods == nil {
+		return nil
+	}
+	method, ok := methods[mcp.Method]
+	if !ok {
+		return fmt.Errorf("unknown MCP method: %s.%s", mcp.Service, mcp.Method)
+	}
+
+	name := mcp.Service + "." + mcp.Method
+	for _, key := range sortedKeys(mcp.Named) {
+		known := false
+		for _, k := range method.keys {
+			known = known || k == key
+		}
+		if !known {
+			return fmt.Errorf("%s does not take %s=", name, key)
+		}
+	}
+	if len(method.keys) > 0 && len(mcp.Args) == 1 && len(mcp.Named) == 0 {
+		// The older form: fs.write "{\"path\": \"a.go\", ...}"
+		if err := json.Unmarshal([]byte(mcp.Arg()), &mcp.Named); err != nil {
+			return fmt.Errorf("%s expects named arguments or a JSON object argument: %w", name, err)
+		}
+		mcp.Args = nil
+	}
+	switch {
+	case len(mcp.Args) > method.args:
+		return fmt.Errorf("%s takes %d argument(s), got %d", name, method.args, len(mcp.Args))
+	case len(mcp.Args) < method.args && method.args == 1:
+		return fmt.Errorf("%s requires an argument", name)
+	case len(mcp.Args) < method.args:
+		return fmt.Errorf("%s requires %d arguments, got %d", name, method.args, len(mcp.Args))
+	}
+	for _, arg := range mcp.Args {
+		if arg == "" {
+			return fmt.Errorf("%s requires non-empty arguments", name)
+		}
+	}
+	for _, key := range method.required {
+		if _, ok := mcp.Named[key]; !ok {
+			return fmt.Errorf("%s requires '%s'", name, key)
+		}
+	}
+	return nil
+}
+
+func (i *Interpreter) executeMCP(call *MCPCall) (err error) {
+	defer i.recordTime("mcp", time.Now())
+	i.log("  → MCP: %s.%s", call.Service, call.Method)
+
+	mcp, err := i.resolveMCP(call)
+	if err != nil {
+		return err
+	}
+	detail := strings.TrimSpace(mcp.Service + "." + mcp.Method + " " + strings.Join(mcp.Args, " "))
+	defer i.recordStep("mcp", detail, i.beginStep("mcp", detail), &err)
+
+	// A dry run previews even a call that would fail, so that every
+	// problem shows up in a single pass
+	invalid := validateMCP(mcp)
+	if invalid != nil && !i.dryRun {
+		return invalid
+	}
+	dir, err := i.ensureWorkDir()
+	if err != nil {
+		return err
+	}
+	if mcp.Service == "fs" {
+		// Every positional fs argument is a path
+		for idx, arg := range mcp.Args {
+			if mcp.Args[idx], err = i.fsPath(dir, arg); err != nil {
+				return err
+			}
+		}
+		if path, ok := mcp.Named["path"]; ok {
+			if mcp.Named["path"], err = i.fsPath(dir, toString(path)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if mcp.Service == "shell" {
+		if err := i.checkExecAllowed("shell." + mcp.Method); err != nil {
+			return err
+		}
+		if err := i.checkCommandAllowed(mcp.Arg()); err != nil {
+			return err
+		}
+	}
+
+	if i.dryRunFS && invalid == nil && mcp.Service == "fs" && (mcp.Method == "write" || mcp.Method == "append") {
+		return i.diffFileWrite(mcp)
+	}
+
+	if i.dryRun {
+		args := make([]string, 0, len(mcp.Args)+len(mcp.Named))
+		for _, arg := range mcp.Args {
+			args = append(args, i.preview(arg))
+		}
+		for _, key := range sortedKeys(mcp.Named) {
+			args = append(args, key+"="+i.preview(formatValue(mcp.Named[key])))
+		}
+		i.log("  [DRY RUN] Would call MCP: %s.%s(%s)", mcp.Service, mcp.Method, strings.Join(args, ", "))
+		if invalid != nil {
+			i.log("  ⚠ %v", invalid)
+		}
+		return nil
+	}
+
+	if i.fake {
+		i.log("  [FAKE] Simulated MCP call %s.%s", mcp.Service, mcp.Method)
+		return nil
+	}
+
+	if !i.approved(mcp.Service+"."+mcp.Method, strings.Join(mcp.Args, " ")) {
+		i.log("  ⚠ Skipped: not approved")
+		if mcp.Service == "shell" {
+			i.variables["last_exit"] = float64(-1)
+		}
+		i.stepSkipped = true
+		return nil
+	}
+
+	// Build MCP command based on service and method
+	var cmd *exec.Cmd
+	ctx, cancel := i.commandContext(i.shellTimeout)
+	defer cancel()
+	switch mcp.Service {
+	case "shell":
+		if mcp.Method == "run" {
+			cmd = exec.CommandContext(ctx, "sh", "-c", mcp.Arg())
+			cmd.Dir = dir
+			setProcessGroup(cmd)
+		}
+	case "fs":
+		switch mcp.Method {
+		case "write":
+			path, content := fileWriteArgs(mcp)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				return fmt.Errorf("fs.write failed: %w", err)
+			}
+			i.log("  ✓ Created file: %s", path)
+			return nil
+		case "append":
+			path, content := fileWriteArgs(mcp)
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return fmt.Errorf("fs.append failed: %w", err)
+			}
+			_, err = f.WriteString(content)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("fs.append failed: %w", err)
+			}
+			i.log("  ✓ Appended to file: %s", path)
+			return nil
+		case "mkdir":
+			if err := os.MkdirAll(mcp.Arg(), 0755); err != nil {
+				return fmt.Errorf("fs.mkdir failed: %w", err)
+			}
+			i.log("  ✓ Created directory: %s", mcp.Arg())
+			return nil
+		case "read":
+			content, err := os.ReadFile(mcp.Arg())
+			if err != nil {
+				return fmt.Errorf("fs.read failed: %w", err)
+			}
+			i.log("  File content:\n%s", string(content))
+			return nil
+		case "exists":
+			if !fileExists(mcp.Arg()) {
+				return fmt.Errorf("fs.exists: %s does not exist", mcp.Arg())
+			}
+			i.log("  ✓ Exists: %s", mcp.Arg())
+			return nil
+		case "copy":
+			if err := copyFile(mcp.Args[0], mcp.Args[1]); err != nil {
+				return fmt.Errorf("fs.copy failed: %w", err)
+			}
+			i.log("  ✓ Copied %s to %s", mcp.Args[0], mcp.Args[1])
+			return nil
+		case "move":
+			if err := os.Rename(mcp.Args[0], mcp.Args[1]); err != nil {
+				return fmt.Errorf("fs.move failed: %w", err)
+			}
+			i.log("  ✓ Moved %s to %s", mcp.Args[0], mcp.Args[1])
+			return nil
+		}
+	case "browser":
+		// Browser operations would integrate with external tools
+		i.log("  ⚠ Browser MCP operations require external browser automation")
+		return nil
+	default:
+		// Not in the registry, which vibe lint reports
+		i.log("  ⚠ No built-in handler for MCP service %s", mcp.Service)
+		return nil
+	}
+
+	if cmd != nil {
+		flush := i.attachOutput(cmd, i.outputWriter)
+		err := cmd.Run()
+		flush()
+		i.setLastExit(cmd, err)
+		if err != nil {
+			if ctxErr := i.checkContext(); ctxErr != nil {
+				return ctxErr
+			}
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return &TimeoutError{Step: "shell.run", Limit: i.shellTimeout}
+			}
+			return fmt.Errorf("MCP command failed: %w", err)
+		}
+	}
+
+	i.log("  ✓ MCP call completed")
+	return nil
+}
+
+// interpolateArg interpolates a positional argument of call; the command
+// of shell.run is quoted like any other shell command.
+func (i *Interpreter) interpolateArg(call *MCPCall, arg string) string {
+	if call.Service == "shell" && call.Method == "run" {
+		return i.interpolateShell(arg)
+	}
+	return i.interpolate(arg)
+}
+
+// interpolateMCP returns a copy of call with its arguments interpolated, so
+// the parsed program is left untouched.
+func (i *Interpreter) interpolateMCP(call *MCPCall) *MCPCall {
+	interpolated := *call
+	interpolated.Args = make([]string, len(call.Args))
+	for idx, arg := range call.Args {
+		interpolated.Args[idx] = i.interpolateArg(call, arg)
+	}
+	if len(call.Named) > 0 {
+		interpolated.Named = make(map[string]Node, len(call.Named))
+		for key, value := range call.Named {
+			if str, ok := value.(*StringLiteral); ok {
+				value = &StringLiteral{Value: i.interpolate(str.Value)}
+			}
+			interpolated.Named[key] = value
+		}
+	}
+	return &interpolated
+}
+
+// copyFile copies the contents and permissions of the file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// fileWriteArgs extracts path and content from the named arguments of
+// fs.write and fs.append, which validateMCP has already checked.
+func fileWriteArgs(mcp *mcpRequest) (path, content string) {
+	path = toString(mcp.Named["path"])
+	if c, ok := mcp.Named["content"]; ok {
+		content = toString(c)
+	}
+	return path, content
+}
+
+// diffFileWrite prints what an fs.write or fs.append would change as a
+// unified diff against the current file, without touching the file.
+func (i *Interpreter) diffFileWrite(mcp *mcpRequest) error {
+	path, content := fileWriteArgs(mcp)
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("fs.%s failed: %w", mcp.Method, err)
+	}
+	exists := err == nil
+
+	updated := content
+	if mcp.Method == "append" {
+		updated = string(old) + content
+	}
+
+	oldName := "a/" + path
+	switch {
+	case !exists:
+		i.log("  [DRY RUN] new file: %s", path)
+		oldName = "/dev/null"
+	case string(old) == updated:
+		i.log("  [DRY RUN] no changes: %s", path)
+		return nil
+	default:
+		i.log("  [DRY RUN] changes to %s:", path)
+	}
+	diff, err := unifiedDiff(oldName, "b/"+path, string(old), updated)
+	if err != nil {
+		i.log("  ⚠ %s: %v", path, err)
+		return nil
+	}
+	// Through the log, like every other dry-run line, so that --quiet,
+	// --json-stream and secret masking apply to the diff too
+	for _, line := range diffLines(diff) {
+		i.log("%s", line)
+	}
+	return nil
+}
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// maxDiffCells bounds the LCS table of unifiedDiff, about 16MB.
+const maxDiffCells = 1 << 21
+
+var errDiffTooLarge = errors.New("file too large to diff")
+
+// unifiedDiff returns the line diff from oldText to newText in unified
+// format, or "" when they are equal. Lines common to the start and end are
+// matched directly, so an append costs nothing; the changed middle goes
+// through a plain LCS table, and errDiffTooLarge is returned when that
+// table would exceed maxDiffCells.
+func unifiedDiff(oldName, newName, oldText, newText string) (string, error) {
+	a, b := diffLines(oldText), diffLines(newText)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(midA)+1)*(len(midB)+1) > maxDiffCells {
+		return "", errDiffTooLarge
+	}
+
+	// lcs[x][y] is the length of the longest common subsequence of
+	// midA[x:] and midB[y:]
+	lcs := make([][]int, len(midA)+1)
+	for x := range lcs {
+		lcs[x] = make([]int, len(midB)+1)
+	}
+	for x := len(midA) - 1; x >= 0; x-- {
+		for y := len(midB) - 1; y >= 0; y-- {
+			if midA[x] == midB[y] {
+				lcs[x][y] = lcs[x+1][y+1] + 1
+			} else {
+				lcs[x][y] = max(lcs[x+1][y], lcs[x][y+1])
+			}
+		}
+	}
+
+	type edit struct {
+		op         byte // ' ', '-' or '+'
+		text       string
+		oldN, newN int // lines of a and b consumed before this edit
+	}
+	var edits []edit
+	for x := 0; x < prefix; x++ {
+		edits = append(edits, edit{' ', a[x], x, x})
+	}
+	changed := false
+	for x, y := 0, 0; x < len(midA) || y < len(midB); {
+		switch {
+		case x < len(midA) && y < len(midB) && midA[x] == midB[y]:
+			edits = append(edits, edit{' ', midA[x], prefix + x, prefix + y})
+			x++
+			y++
+		case x < len(midA) && (y == len(midB) || lcs[x+1][y] >= lcs[x][y+1]):
+			edits = append(edits, edit{'-', midA[x], prefix + x, prefix + y})
+			x++
+			changed = true
+		default:
+			edits = append(edits, edit{'+', midB[y], prefix + x, prefix + y})
+			y++
+			changed = true
+		}
+	}
+	if !changed {
+		return "", nil
+	}
+	for k := 0; k < suffix; k++ {
+		x, y := len(a)-suffix+k, len(b)-suffix+k
+		edits = append(edits, edit{' ', a[x], x, y})
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for pos := 0; pos < len(edits); {
+		first := pos
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+
+		// Extend the hunk while the gap to the next change is small enough
+		// for their contexts to overlap
+		end := first
+		for {
+			for end < len(edits) && edits[end].op != ' ' {
+				end++
+			}
+			next := end
+			for next < len(edits) && edits[next].op == ' ' {
+				next++
+			}
+			if next < len(edits) && next-end <= 2*diffContext {
+				end = next
+				continue
+			}
+			end = min(end+diffContext, len(edits))
+			break
+		}
+		start := max(first-diffContext, pos)
+
+		oldCount, newCount := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				oldCount++
+			}
+			if e.op != '-' {
+				newCount++
+			}
+		}
+		oldStart, newStart := edits[start].oldN, edits[start].newN
+		if oldCount > 0 {
+			oldStart++
+		}
+		if newCount > 0 {
+			newStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.text)
+		}
+		pos = end
+	}
+	return out.String(), nil
+}
+
+func diffLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+func (i *Interpreter) executeCompoundAssignment(stmt *CompoundAssignment) error {
+	current, ok := i.variables[stmt.Name]
+	if !ok {
+		return fmt.Errorf("%s: %s is not defined", stmt, stmt.Name)
+	}
+	left, ok := current.(float64)
+	if !ok {
+		return fmt.Errorf("%s: %s is not a number (%s)", stmt, stmt.Name, formatValue(current))
+	}
+	val, err := i.evalValue(stmt.Value)
+	if err != nil {
+		return err
+	}
+	right, ok := val.(float64)
+	if !ok {
+		return fmt.Errorf("%s: %s is not a number", stmt, stmt.Value)
+	}
+
+	switch stmt.Operator {
+	case "+=":
+		left += right
+	case "-=":
+		left -= right
+	case "*=":
+		left *= right
+	case "/=":
+		if right == 0 {
+			return fmt.Errorf("%s: division by zero", stmt)
+		}
+		left /= right
+	}
+	i.variables[stmt.Name] = left
+	return nil
+}
+
+func (i *Interpreter) executeIncrementDecrement(incDec *IncrementDecrement) error {
+	if val, ok := i.variables[incDec.Name]; ok {
+		if num, ok := val.(float64); ok {
+			if incDec.Operator == "++" {
+				i.variables[incDec.Name] = num + 1
+			} else {
+				i.variables[incDec.Name] = num - 1
+			}
+		}
+	}
+	return nil
+}
+
+func truncateString(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen-3] + "..."
+}
+
+// ============================================================================
+// SPEC INPUT (YAML / JSON)
+// ============================================================================
+
+// loadSpec converts a declarative YAML or JSON project spec into a Program.
+// Top-level keys become assignments, while the reserved "steps", "before"
+// and "after" keys hold ordered lists of ask/shell/mcp actions.
+func loadSpec(content []byte, format string) (*Program, error) {
+	var doc interface{}
+	switch format {
+	case "json":
+		if err := json.Unmarshal(content, &doc); err != nil {
+			return nil, fmt.Errorf("invalid JSON spec: %w", err)
+		}
+	case "yaml":
+		var err error
+		if doc, err = parseYAML(string(content)); err != nil {
+			return nil, fmt.Errorf("invalid YAML spec: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported input format: %s", format)
+	}
+
+	spec, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("spec must be a mapping of variables and steps")
+	}
+
+	program := &Program{}
+
+	var names []string
+	for name := range spec {
+		switch name {
+		case "steps", "before", "after":
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		program.Statements = append(program.Statements, &Assignment{Name: name, Value: specValueToNode(spec[name])})
+	}
+
+	if before, ok := spec["before"]; ok {
+		hooks, err := specSteps("before", before)
+		if err != nil {
+			return nil, err
+		}
+		program.Statements = append(program.Statements, &BeforeBlock{Statements: hooks})
+	}
+	if after, ok := spec["after"]; ok {
+		hooks, err := specSteps("after", after)
+		if err != nil {
+			return nil, err
+		}
+		program.Statements = append(program.Statements, &AfterBlock{Statements: hooks})
+	}
+	if steps, ok := spec["steps"]; ok {
+		stmts, err := specSteps("steps", steps)
+		if err != nil {
+			return nil, err
+		}
+		program.Statements = append(program.Statements, stmts...)
+	}
+
+	return program, nil
+}
+
+func specSteps(key string, raw interface{}) ([]Node, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list", key)
+	}
+
+	var stmts []Node
+	for n, item := range list {
+		step, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s[%d] must be a mapping", key, n)
+		}
+		switch {
+		case step["ask"] != nil:
+			stmts = append(stmts, &AskStatement{Instruction: toString(step["ask"])})
+		case step["shell"] != nil:
+			stmts = append(stmts, &ShellCommand{Command: toString(step["shell"])})
+		case step["mcp"] != nil:
+			service, method, ok := strings.Cut(toString(step["mcp"]), ".")
+			if !ok {
+				return nil, fmt.Errorf("%s[%d]: mcp must be of the form service.method", key, n)
+			}
+			call := &MCPCall{Service: service, Method: method}
+			if arg, ok := step["arg"]; ok {
+				call.Args = []string{toString(arg)}
+			}
+			if args, ok := step["args"].([]interface{}); ok {
+				for _, arg := range args {
+					call.Args = append(call.Args, toString(arg))
+				}
+			}
+			stmts = append(stmts, call)
+		default:
+			return nil, fmt.Errorf("%s[%d]: expected one of ask, shell or mcp", key, n)
+		}
+	}
+	return stmts, nil
+}
+
+func specValueToNode(v interface{}) Node {
+	switch val := v.(type) {
+	case string:
+		return &StringLiteral{Value: val}
+	case float64:
+		return &NumberLiteral{Value: val}
+	case bool:
+		return &BooleanLiteral{Value: val}
+	case []interface{}:
+		list := &ListLiteral{}
+		for _, elem := range val {
+			list.Elements = append(list.Elements, specValueToNode(elem))
+		}
+		return list
+	case nil:
+		return &StringLiteral{Value: ""}
+	}
+	return &StringLiteral{Value: toString(v)}
+}
+
+type yamlLine struct {
+	indent int
+	text   string
+	num    int
+}
+
+// parseYAML parses the subset of YAML used by project specs: block
+// mappings, block sequences, flow sequences and scalars.
+func parseYAML(src string) (interface{}, error) {
+	var lines []yamlLine
+	for n, raw := range strings.Split(src, "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		if strings.TrimSpace(text) == "" || text == "---" {
+			continue
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		lines = append(lines, yamlLine{indent: len(text) - len(trimmed), text: trimmed, num: n + 1})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	val, next, err := parseYAMLBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[next].num)
+	}
+	return val, nil
+}
+
+func parseYAMLBlock(lines []yamlLine, pos, indent int) (interface{}, int, error) {
+	if strings.HasPrefix(lines[pos].text, "-") {
+		return parseYAMLSequence(lines, pos, indent)
+	}
+	return parseYAMLMapping(lines, pos, indent)
+}
+
+func parseYAMLSequence(lines []yamlLine, pos, indent int) (interface{}, int, error) {
+	var result []interface{}
+	for pos < len(lines) && lines[pos].indent == indent && strings.HasPrefix(lines[pos].text, "-") {
+		line := lines[pos]
+		rest := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+
+		switch {
+		case rest == "":
+			if pos+1 >= len(lines) || lines[pos+1].indent <= indent {
+				result = append(result, nil)
+				pos++
+				continue
+			}
+			val, next, err := parseYAMLBlock(lines, pos+1, lines[pos+1].indent)
+			if err != nil {
+				return nil, pos, err
+			}
+			result = append(result, val)
+			pos = next
+		case isYAMLMappingEntry(rest):
+			// "- key: value" starts a mapping whose keys line up with "key"
+			itemIndent := indent + len(line.text) - len(rest)
+			lines[pos] = yamlLine{indent: itemIndent, text: rest, num: line.num}
+			val, next, err := parseYAMLMapping(lines, pos, itemIndent)
+			if err != nil {
+				return nil, pos, err
+			}
+			result = append(result, val)
+			pos = next
+		default:
+			val, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, pos, fmt.Errorf("line %d: %w", line.num, err)
+			}
+			result = append(result, val)
+			pos++
+		}
+	}
+	return result, pos, nil
+}
+
+func parseYAMLMapping(lines []yamlLine, pos, indent int) (interface{}, int, error) {
+	result := make(map[string]interface{})
+	for pos < len(lines) && lines[pos].indent == indent {
+		line := lines[pos]
+		if !isYAMLMappingEntry(line.text) {
+			return nil, pos, fmt.Errorf("line %d: expected key: value", line.num)
+		}
+		key, rest, _ := strings.Cut(line.text, ":")
+		key = strings.Trim(strings.TrimSpace(key), `"'`)
+		rest = strings.TrimSpace(rest)
+		pos++
+
+		if rest != "" {
+			val, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, pos, fmt.Errorf("line %d: %w", line.num, err)
+			}
+			result[key] = val
+			continue
+		}
+
+		// A nested block is either indented further or, for sequences,
+		// allowed at the same indentation as the key.
+		if pos < len(lines) && (lines[pos].indent > indent ||
+			(lines[pos].indent == indent && strings.HasPrefix(lines[pos].text, "-"))) {
+			val, next, err := parseYAMLBlock(lines, pos, lines[pos].indent)
+			if err != nil {
+				return nil, pos, err
+			}
+			result[key] = val
+			pos = next
+			continue
+		}
+		result[key] = nil
+	}
+	return result, pos, nil
+}
+
+func isYAMLMappingEntry(text string) bool {
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") || strings.HasPrefix(text, "[") {
+		return false
+	}
+	key, rest, ok := strings.Cut(text, ":")
+	return ok && key != "" && (rest == "" || rest[0] == ' ')
+}
+
+func parseYAMLScalar(text string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated list %s", text)
+		}
+		var result []interface{}
+		for _, item := range splitYAMLFlow(text[1 : len(text)-1]) {
+			val, err := parseYAMLScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, val)
+		}
+		return result, nil
+	}
+
+	switch text {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "~":
+		return nil, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, nil
+	}
+	return text, nil
+}
+
+// splitYAMLFlow splits the inside of a flow sequence on commas that are not
+// inside quotes.
+func splitYAMLFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for n := 0; n < len(s); n++ {
+		switch {
+		case quote != 0:
+			if s[n] == quote {
+				quote = 0
+			}
+		case s[n] == '"' || s[n] == '\'':
+			quote = s[n]
+		case s[n] == ',':
+			items = append(items, strings.TrimSpace(s[start:n]))
+			start = n + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+func stripYAMLComment(line string) string {
+	var quote byte
+	for n := 0; n < len(line); n++ {
+		switch {
+		case quote != 0:
+			if line[n] == quote {
+				quote = 0
+			}
+		case line[n] == '"' || line[n] == '\'':
+			quote = line[n]
+		case line[n] == '#' && (n == 0 || line[n-1] == ' ' || line[n-1] == '\t'):
+			return line[:n]
+		}
+	}
+	return line
+}
+
+// specFormat picks the input format for filename when none was given.
+func specFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	}
+	return "vibe"
+}
+
+// ============================================================================
+// LINT
+// ============================================================================
+
+// LintWarning is a problem found by a static check of a parsed program.
+type LintWarning struct {
+	Line   int
+	Column int
+	Rule   string
+	Msg    string
+}
+
+func (w LintWarning) String() string {
+	return fmt.Sprintf("line %d, column %d: %s [%s]", w.Line, w.Column, w.Msg, w.Rule)
+}
+
+// lintCheck is one lint rule. positions maps statements to the token they
+// start at; warnings about a value use the position of its statement.
+type lintCheck func(program *Program, positions map[Node]Token) []LintWarning
+
+// lintRules lists the checks run by Lint, in report order.
+var lintRules = []struct {
+	name  string
+	check lintCheck
+}{
+	{"unused-variable", lintUnusedVariables},
+	{"undefined-reference", lintUndefinedReferences},
+	{"constant-condition", lintConstantConditions},
+	{"empty-block", lintEmptyBlocks},
+	{"unknown-mcp", lintUnknownMCP},
+}
+
+// Lint runs every lint rule over program and returns the warnings sorted
+// by position.
+func Lint(program *Program, positions map[Node]Token) []LintWarning {
+	var warnings []LintWarning
+	for _, rule := range lintRules {
+		warnings = append(warnings, rule.check(program, positions)...)
+	}
+	sort.SliceStable(warnings, func(a, b int) bool {
+		if warnings[a].Line != warnings[b].Line {
+			return warnings[a].Line < warnings[b].Line
+		}
+		return warnings[a].Column < warnings[b].Column
+	})
+	return warnings
+}
+
+func lintWarning(tok Token, rule, format string, args ...interface{}) LintWarning {
+	return LintWarning{Line: tok.Line, Column: tok.Column, Rule: rule, Msg: fmt.Sprintf(format, args...)}
+}
+
+// eachStatement calls fn for every statement in stmts and in the bodies
+// nested inside them.
+func eachStatement(stmts []Node, fn func(stmt Node)) {
+	for _, stmt := range stmts {
+		fn(stmt)
+		switch s := stmt.(type) {
+		case *IfStatement:
+			eachStatement(s.Consequence, fn)
+			eachStatement(s.Alternative, fn)
+		case *RepeatStatement:
+			eachStatement(s.Body, fn)
+		case *WhileStatement:
+			eachStatement(s.Body, fn)
+		case *ForStatement:
+			eachStatement(s.Body, fn)
+		case *GroupBlock:
+			eachStatement(s.Body, fn)
+		case *SetupBlock:
+			eachStatement(s.Body, fn)
+		case *BeforeBlock:
+			eachStatement(s.Statements, fn)
+		case *AfterBlock:
+			eachStatement(s.Statements, fn)
+		}
+	}
+}
+
+// interpolationNames returns the names referenced as ${name} in s,
+// skipping escaped \${ and $${.
+func interpolationNames(s string) []string {
+	var names []string
+	for pos := 0; pos < len(s); {
+		rest := s[pos:]
+		switch {
+		case strings.HasPrefix(rest, "\\${"), strings.HasPrefix(rest, "$${"):
+			pos += 3
+		case strings.HasPrefix(rest, "${"):
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return names
+			}
+			name := strings.TrimSpace(rest[2:end])
+			if open := strings.IndexByte(name, '['); open >= 0 {
+				name = strings.TrimSpace(name[:open]) // ${tools[1]} refers to tools
+			}
+			names = append(names, name)
+			pos += end + 1
+		default:
+			pos++
+		}
+	}
+	return names
+}
+
+// nameRef is a variable reference found in a statement. Strict references
+// are the ones where an undefined name is almost certainly a mistake:
+// ${name} interpolations and identifiers used as operands. A bare
+// identifier elsewhere may be an unquoted string, as in frontend = react.
+type nameRef struct {
+	name   string
+	strict bool
+}
+
+// statementRefs returns the variable references made by stmt itself, not
+// by the statements in its body.
+func statementRefs(stmt Node) []nameRef {
+	var refs []nameRef
+	text := func(s string) {
+		for _, name := range interpolationNames(s) {
+			refs = append(refs, nameRef{name, true})
+		}
+	}
+	var value func(node Node, strict bool)
+	value = func(node Node, strict bool) {
+		switch n := node.(type) {
+		case *StringLiteral:
+			text(n.Value)
+		case *Identifier:
+			refs = append(refs, nameRef{n.Name, strict})
+		case *ListLiteral:
+			// Bare words in a list are usually strings: [react, vue]
+			for _, elem := range n.Elements {
+				value(elem, false)
+			}
+		case *ListComprehension:
+			value(n.Expr, strict)
+			value(n.Iterable, true)
+			if n.Filter != nil {
+				value(n.Filter, true)
+			}
+		case *CallExpression:
+			for _, arg := range n.Args {
+				value(arg, true)
+			}
+		case *BinaryExpression:
+			value(n.Left, true)
+			value(n.Right, true)
+		case *IndexExpression:
+			value(n.Target, true)
+			value(n.Index, true)
+		case *Condition:
+			value(n.Left, true)
+			value(n.Right, true)
+		case *TernaryExpression:
+			value(n.Condition, true)
+			value(n.Then, strict)
+			value(n.Else, strict)
+		case *SucceedsExpression:
+			value(n.Command, strict)
+		case *ShellCommand:
+			text(n.Command)
+			for _, mod := range []Node{n.Timeout, n.Retries} {
+				if mod != nil {
+					value(mod, false)
+				}
+			}
+		case *MCPCall:
+			for _, arg := range n.Args {
+				text(arg)
+			}
+			for _, key := range sortedKeys(n.Named) {
+				value(n.Named[key], true)
+			}
+		case *AskStatement:
+			text(n.Instruction)
+			for _, mod := range []Node{n.Timeout, n.Tools, n.Model, n.Kind, n.Retries, n.Assert} {
+				if mod != nil {
+					value(mod, false)
+				}
+			}
+		}
+	}
+
+	switch s := stmt.(type) {
+	case *Assignment:
+		value(s.Value, false)
+	case *DestructuringAssignment:
+		value(s.Value, false)
+	case *PromptDefinition:
+		text(s.Text)
+	case *RefineStatement:
+		value(s.Ask, false)
+		value(s.Until, true)
+	case *IfStatement:
+		value(s.Condition, true)
+	case *RepeatStatement:
+		value(s.Count, true)
+		if s.While != nil {
+			value(s.While, true)
+		}
+	case *WhileStatement:
+		value(s.Condition, true)
+	case *ForStatement:
+		value(s.Iterable, true)
+	case *BeforeBlock:
+		if s.When != nil {
+			value(s.When, true)
+		}
+	case *AfterBlock:
+		if s.When != nil {
+			value(s.When, true)
+		}
+	case *IncrementDecrement:
+		refs = append(refs, nameRef{s.Name, true})
+	case *CompoundAssignment:
+		refs = append(refs, nameRef{s.Name, true})
+		value(s.Value, true)
+	case *AskStatement, *ShellCommand, *MCPCall:
+		value(s, false)
+	}
+	return refs
+}
+
+// lintBuiltinNames are variables the interpreter reads or sets itself, so
+// assigning them without a reference in the script is not a mistake.
+var lintBuiltinNames = map[string]bool{
+	"project": true, "victim": true, "frontend": true, "backend": true,
+	"db": true, "ai": true, "tools": true, "task": true, "model": true,
+	"summary": true, "response": true, "last_exit": true,
+	"prompt_template": true, "workdir": true,
+}
+
+// definedNames returns every name the program binds: assignments, loop
+// and comprehension variables, and names listed in require (which are
+// expected to come from outside the script).
+func definedNames(program *Program) map[string]bool {
+	defined := make(map[string]bool)
+	var comprehensions func(node Node)
+	comprehensions = func(node Node) {
+		switch n := node.(type) {
+		case *ListComprehension:
+			defined[n.Var] = true
+		case *ListLiteral:
+			for _, elem := range n.Elements {
+				comprehensions(elem)
+			}
+		}
+	}
+	eachStatement(program.Statements, func(stmt Node) {
+		switch s := stmt.(type) {
+		case *Assignment:
+			defined[s.Name] = true
+			comprehensions(s.Value)
+		case *DestructuringAssignment:
+			for _, name := range s.Names {
+				defined[name] = true
+			}
+		case *ForStatement:
+			defined[s.Var] = true
+			if s.Index != "" {
+				defined[s.Index] = true
+			}
+		case *RequireStatement:
+			for _, name := range s.Names {
+				defined[name] = true
+			}
+		}
+	})
+	return defined
+}
+
+// lintUnusedVariables reports variables that are assigned but never read.
+func lintUnusedVariables(program *Program, positions map[Node]Token) []LintWarning {
+	used := make(map[string]bool)
+	eachStatement(program.Statements, func(stmt Node) {
+		for _, ref := range statementRefs(stmt) {
+			used[ref.name] = true
+		}
+	})
+
+	var warnings []LintWarning
+	reported := make(map[string]bool)
+	report := func(stmt Node, name string) {
+		if used[name] || reported[name] || lintBuiltinNames[name] || name == "_" {
+			return
+		}
+		reported[name] = true
+		warnings = append(warnings, lintWarning(positions[stmt], "unused-variable", "variable %s is assigned but never used", name))
+	}
+	eachStatement(program.Statements, func(stmt Node) {
+		switch s := stmt.(type) {
+		case *Assignment:
+			report(s, s.Name)
+		case *DestructuringAssignment:
+			for _, name := range s.Names {
+				report(s, name)
+			}
+		}
+	})
+	return warnings
+}
+
+// lintUndefinedReferences reports ${name} interpolations and operands
+// that name a variable the script never defines.
+func lintUndefinedReferences(program *Program, positions map[Node]Token) []LintWarning {
+	defined := definedNames(program)
+	var warnings []LintWarning
+	eachStatement(program.Statements, func(stmt Node) {
+		for _, ref := range statementRefs(stmt) {
+			if ref.strict && !defined[ref.name] && !lintBuiltinNames[ref.name] {
+				warnings = append(warnings, lintWarning(positions[stmt], "undefined-reference", "%s is not defined", ref.name))
+			}
+		}
+	})
+	return warnings
+}
+
+func isLiteral(node Node) bool {
+	switch node.(type) {
+	case *StringLiteral, *NumberLiteral, *BooleanLiteral:
+		return true
+	}
+	return false
+}
+
+// lintConstantConditions reports if, elif, while and when conditions that
+// compare two literals, so one branch can never run.
+func lintConstantConditions(program *Program, positions map[Node]Token) []LintWarning {
+	var warnings []LintWarning
+	check := func(stmt Node, cond *Condition, what string) {
+		if cond == nil || !isLiteral(cond.Left) || (cond.Right != nil && !isLiteral(cond.Right)) {
+			return
+		}
+		if str, ok := cond.Left.(*StringLiteral); ok && strings.Contains(str.Value, "${") {
+			return
+		}
+		if str, ok := cond.Right.(*StringLiteral); ok && strings.Contains(str.Value, "${") {
+			return
+		}
+		holds, err := NewInterpreter().evalCondition(cond)
+		if err != nil {
+			return
+		}
+		warnings = append(warnings, lintWarning(positions[stmt], "constant-condition", "%s condition %s is always %v", what, cond.String(), holds))
+	}
+	eachStatement(program.Statements, func(stmt Node) {
+		switch s := stmt.(type) {
+		case *IfStatement:
+			check(s, s.Condition, "if")
+		case *RepeatStatement:
+			check(s, s.While, "while")
+		case *WhileStatement:
+			// "while True" with a break is the usual way to loop until
+			// something happens
+			if !breaksOut(s.Body) {
+				check(s, s.Condition, "while")
+			}
+		case *BeforeBlock:
+			check(s, s.When, "when")
+		case *AfterBlock:
+			check(s, s.When, "when")
+		}
+	})
+	return warnings
+}
+
+// breaksOut reports whether a loop body contains a break that leaves that
+// loop, rather than one of a nested loop.
+func breaksOut(body []Node) bool {
+	for _, stmt := range body {
+		switch s := stmt.(type) {
+		case *BreakStatement:
+			return true
+		case *IfStatement:
+			if breaksOut(s.Consequence) || breaksOut(s.Alternative) {
+				return true
+			}
+		case *GroupBlock:
+			if breaksOut(s.Body) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lintEmptyBlocks reports blocks without any statements.
+func lintEmptyBlocks(program *Program, positions map[Node]Token) []LintWarning {
+	var warnings []LintWarning
+	report := func(stmt Node, what string, body []Node) {
+		if len(body) == 0 {
+			warnings = append(warnings, lintWarning(positions[stmt], "empty-block", "empty %s block", what))
+		}
+	}
+	eachStatement(program.Statements, func(stmt Node) {
+		switch s := stmt.(type) {
+		case *IfStatement:
+			report(s, "if", s.Consequence)
+		case *RepeatStatement:
+			report(s, "repeat", s.Body)
+		case *WhileStatement:
+			report(s, "while", s.Body)
+		case *ForStatement:
+			report(s, "for", s.Body)
+		case *GroupBlock:
+			report(s, "group", s.Body)
+		case *SetupBlock:
+			report(s, "setup", s.Body)
+		case *BeforeBlock:
+			report(s, "before", s.Statements)
+		case *AfterBlock:
+			report(s, "after", s.Statements)
+		}
+	})
+	return warnings
+}
+
+// lintUnknownMCP reports MCP calls to services or methods missing from the
+// registry, including ones used in "then assert" clauses.
+func lintUnknownMCP(program *Program, positions map[Node]Token) []LintWarning {
+	var warnings []LintWarning
+	check := func(stmt Node, call *MCPCall) {
+		methods, ok := mcpServices[call.Service]
+		switch {
+		case !ok:
+			warnings = append(warnings, lintWarning(positions[stmt], "unknown-mcp", "unknown MCP service: %s", call.Service))
+		case methods != nil:
+			if _, ok := methods[call.Method]; !ok {
+				warnings = append(warnings, lintWarning(positions[stmt], "unknown-mcp", "unknown MCP method: %s.%s", call.Service, call.Method))
+			}
+		}
+	}
+	eachStatement(program.Statements, func(stmt Node) {
+		switch s := stmt.(type) {
+		case *MCPCall:
+			check(s, s)
+		case *AskStatement:
+			if call, ok := s.Assert.(*MCPCall); ok {
+				check(s, call)
+			}
+		case *RefineStatement:
+			if call, ok := s.Ask.Assert.(*MCPCall); ok {
+				check(s, call)
+			}
+		}
+	})
+	return warnings
+}
+
+// ============================================================================
+// REPORTS
+// ============================================================================
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnitReport writes steps as a JUnit XML test suite named name, one
+// testcase per step. The classname is "vibe.<kind>", prefixed by the
+// enclosing group path when there is one.
+func writeJUnitReport(w io.Writer, name string, steps []StepRecord) error {
+	suite := junitTestSuite{Name: name, Tests: len(steps)}
+	var total time.Duration
+	for _, step := range steps {
+		classname := "vibe." + step.Kind
+		if step.Group != "" {
+			classname = step.Group + "." + classname
+		}
+		tc := junitTestCase{
+			Name:      fmt.Sprintf("%d: %s", step.Index, truncateString(step.Detail, 80)),
+			Classname: classname,
+			Time:      fmt.Sprintf("%.3f", step.Duration.Seconds()),
+			SystemOut: step.Output,
+		}
+		switch step.Status {
+		case "failed":
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: step.Err, Text: step.Detail}
+		case "skipped":
+			suite.Skipped++
+			tc.Skipped = &struct{}{}
+		}
+		total += step.Duration
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	suite.Time = fmt.Sprintf("%.3f", total.Seconds())
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// printStepSummary writes a table of the steps with their status and
+// timing, followed by the totals.
+func printStepSummary(w io.Writer, steps []StepRecord) {
+	counts := map[string]int{}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tSTATUS\tTIME\tSTEP")
+	for _, step := range steps {
+		counts[step.Status]++
+		detail := step.Kind + ": " + truncateString(strings.Join(strings.Fields(step.Detail), " "), 60)
+		if step.Group != "" {
+			detail = step.Group + " / " + detail
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", step.Index, step.Status, step.Duration.Round(time.Millisecond), detail)
+		if step.Err != "" {
+			fmt.Fprintf(tw, "\t\t\t  %s\n", step.Err)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d steps: %d passed, %d failed, %d skipped\n",
+		len(steps), counts["passed"], counts["failed"], counts["skipped"])
+}
+
+// writeReport writes the interpreter's steps to path in the given format.
+func writeReport(path, format, name string, steps []StepRecord) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "junit":
+		err = writeJUnitReport(f, name, steps)
+	default:
+		err = fmt.Errorf("unknown report format %q", format)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ============================================================================
+// CLI
+// ============================================================================
+
+// commandRunner runs a command and returns its standard output.
+type commandRunner func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+func execRunner(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+// claudeCheckTimeout bounds the "claude --version" preflight.
+const claudeCheckTimeout = 10 * time.Second
+
+// checkClaude runs "<path> --version" and returns the reported version,
+// or an error with install guidance when the CLI cannot be run.
+func checkClaude(run commandRunner, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), claudeCheckTimeout)
+	defer cancel()
+
+	out, err := run(ctx, path, "--version")
+	if err != nil {
+		switch {
+		case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+			return "", fmt.Errorf("Claude Code CLI not found at %q\n"+
+				"  Install it with: npm install -g @anthropic-ai/claude-code\n"+
+				"  or point vibe at it with --claude <path>", path)
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return "", fmt.Errorf("%s --version did not answer within %s", path, claudeCheckTimeout)
+		}
+		return "", fmt.Errorf("%s --version failed: %w", path, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// fileWatcher polls a set of files and reports when any of them changed.
+type fileWatcher struct {
+	interval time.Duration // time between polls
+	debounce time.Duration // quiet period required after the last change
+	files    func() []string
+}
+
+// fileStamps returns the modification time and size of each file, using
+// a zero stamp for files that cannot be read.
+func fileStamps(paths []string) map[string]string {
+	stamps := make(map[string]string, len(paths))
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err == nil {
+			stamps[path] = fmt.Sprintf("%d/%d", stat.ModTime().UnixNano(), stat.Size())
+		} else {
+			stamps[path] = ""
+		}
+	}
+	return stamps
+}
+
+func sameStamps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, stamp := range a {
+		if b[path] != stamp {
+			return false
+		}
+	}
+	return true
+}
+
+// wait blocks until the watched files change and then stay unchanged for
+// the debounce period, or until ctx is done.
+func (w *fileWatcher) wait(ctx context.Context) error {
+	base := fileStamps(w.files())
+	var settling map[string]string
+	var changedAt time.Time
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		current := fileStamps(w.files())
+		switch {
+		case !sameStamps(current, base) && (settling == nil || !sameStamps(current, settling)):
+			// A new change; wait for the files to settle
+			settling, changedAt = current, time.Now()
+		case settling != nil && time.Since(changedAt) >= w.debounce:
+			return nil
+		}
+	}
+}
+
+// watchedFiles returns the script and the prompt files it references with
+// ask @path, so that editing either triggers a re-run.
+func watchedFiles(filename string) []string {
+	files := []string{filename}
+	content, err := os.ReadFile(filename)
+	if err != nil || specFormat(filename) != "vibe" {
+		return files
+	}
+	program := NewParser(NewLexer(string(content))).Parse()
+	eachStatement(program.Statements, func(stmt Node) {
+		var value Node = stmt
+		switch s := stmt.(type) {
+		case *Assignment:
+			value = s.Value
+		case *DestructuringAssignment:
+			value = s.Value
+		case *RefineStatement:
+			value = s.Ask
+		}
+		if ask, ok := value.(*AskStatement); ok && ask.PromptFile != "" {
+			path := ask.PromptFile
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(filename), path)
+			}
+			files = append(files, path)
+		}
+	})
+	return files
+}
+
+// runWatch runs the script in a fresh child process (so every run starts
+// from a clean interpreter), then re-runs it whenever the script or its
+// prompt files change. Its own messages go to out, and failed runs are
+// reported on errOut. Ctrl-C stops watching.
+func runWatch(filename string, args []string, w *fileWatcher, out, errOut io.Writer) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for {
+		cmd := exec.CommandContext(ctx, self, args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(errOut, "⚠ Run failed: %v\n", err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		fmt.Fprintf(out, "\n→ Watching %s for changes (Ctrl-C to stop)\n", filename)
+		if err := w.wait(ctx); err != nil {
+			return nil
+		}
+		fmt.Fprintf(out, "\n→ Change detected, re-running %s\n\n", filename)
+	}
+}
+
+// isTerminal reports whether f looks like an interactive terminal: a
+// character device other than the null device.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(stat, null) {
+		return false
+	}
+	return true
+}
 
-	if cmd != nil {
-		cmd.Stdout = i.outputWriter
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("MCP command failed: %w", err)
+// initTemplate is the starter script written by "vibe init". PROJECT_NAME
+// is replaced with the project name.
+const initTemplate = `# PROJECT_NAME
+# Starter .vibe file: edit the values and steps, then run
+#   vibe PROJECT_NAME.vibe --dry-run
+
+# Project settings are passed to Claude with every step
+project = "PROJECT_NAME"
+victim = web-fullstack
+frontend = react
+backend = express
+tools = ["vite", "tailwind"]
+
+test = True
+
+task = "Describe what you want to build here."
+
+# Runs before the build steps
+before {
+    shell "mkdir -p PROJECT_NAME"
+}
+
+# Build steps, one Claude Code call each
+ask "scaffold the project structure"
+ask "implement the main features described in the task"
+
+# Only runs when test is True
+if test == True {
+    ask "generate unit tests"
+}
+
+# Runs after the build steps
+after {
+    shell "echo 'Build complete!'"
+}
+`
+
+// runInit implements "vibe init [name] [--force]": it writes a commented
+// starter script to <name>.vibe (project.vibe by default) and refuses to
+// overwrite an existing file unless --force is given. It reports to out.
+func runInit(args []string, out io.Writer) error {
+	name := "project"
+	force := false
+	for _, arg := range args {
+		switch {
+		case arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown init option %s", arg)
+		default:
+			name = strings.TrimSuffix(arg, ".vibe")
 		}
 	}
 
-	i.log("  ✓ MCP call completed")
+	filename := name + ".vibe"
+	if _, err := os.Stat(filename); err == nil && !force {
+		return fmt.Errorf("%s already exists (use --force to overwrite)", filename)
+	}
+
+	content := strings.ReplaceAll(initTemplate, "PROJECT_NAME", filepath.Base(name))
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "✓ Created %s\n", filename)
 	return nil
 }
 
-func (i *Interpreter) executeIncrementDecrement(incDec *IncrementDecrement) error {
-	if val, ok := i.variables[incDec.Name]; ok {
-		if num, ok := val.(float64); ok {
-			if incDec.Operator == "++" {
-				i.variables[incDec.Name] = num + 1
-			} else {
-				i.variables[incDec.Name] = num - 1
-			}
+var errLintWarnings = errors.New("lint warnings found")
+
+// runLint implements "vibe lint <file.vibe>": it parses the script and
+// prints syntax errors, or else the warnings of every lint rule, to out.
+// It returns an error when anything was reported.
+func runLint(args []string, out io.Writer) error {
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("usage: vibe lint <file.vibe>")
+	}
+	filename := args[0]
+	if specFormat(filename) != "vibe" {
+		return fmt.Errorf("lint only supports .vibe scripts")
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	parser := NewParser(NewLexer(string(content)))
+	program := parser.Parse()
+	if errs := parser.ParseErrors(); len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(out, "%s: %s\n", filename, e)
 		}
+		return errs
 	}
-	return nil
-}
 
-func truncateString(s string, maxLen int) string {
-	if len(s) <= maxLen {
-		return s
+	warnings := Lint(program, parser.Positions())
+	for _, w := range warnings {
+		fmt.Fprintf(out, "%s: %s\n", filename, w)
 	}
-	return s[:maxLen-3] + "..."
+	if len(warnings) > 0 {
+		fmt.Fprintf(out, "⚠ %d warning(s)\n", len(warnings))
+		return errLintWarnings
+	}
+	fmt.Fprintf(out, "✓ No problems found in %s\n", filename)
+	return nil
 }
 
-// ============================================================================
-// CLI
-// ============================================================================
-
 func printUsage() {
-	fmt.Println(`
+	fmt.Print(`
 Vibe DSL Interpreter v1.0
 ========================
 
@@ -1304,46 +7678,411 @@ to build full software projects programmatically.
 
 Usage:
   vibe <file.vibe> [options]
+  vibe init [name] [--force]   Write a commented starter <name>.vibe
+                               (default: project.vibe)
+  vibe lint <file.vibe>        Report unused variables, undefined
+                               references, constant conditions, empty
+                               blocks and unknown MCP calls
 
 Options:
   --dry-run       Print what would be executed without actually running
+                  (see "Dry run" below)
+  --no-hooks-on-dry-run
+                  In dry-run, skip hooks entirely instead of previewing them
+  --dry-run-fs    Show fs.write/fs.append as unified diffs against the
+                  current files instead of writing them
+  --truncate <n>  In dry-run, shorten prompts and MCP arguments to n
+                  characters instead of printing them in full
   --verbose       Enable verbose output (default: true)
   --quiet         Disable verbose output
+  --unknown-vars <keep|blank>
+                  What ${name} becomes when name is not set: keep it as
+                  written (default) or replace it with nothing
+  --symbols <auto|unicode|ascii>
+                  Glyphs for log and status output, also accepted by vibe
+                  lint and vibe init; auto (default) uses ASCII when the
+                  locale is not UTF-8
+  --summary-only  Print only a per-step status and timing table at the
+                  end; step output is suppressed, errors still go to stderr
+  --json-stream   Write one JSON event per line to stdout: run_start,
+                  step_start, log, step_end and run_end, each with schema_version,
+                  event, ts, step_index, type, status and detail. Command
+                  output goes to stderr
   --interactive   Enable permission prompts (default: auto-approve for speed)
-  --model <name>  Use specific model (e.g., "haiku" for faster responses)
+  --interactive-approve
+                  Ask for y/n confirmation before destructive actions
+                  (shell, shell.run, fs.write, fs.append, fs.mkdir,
+                  fs.copy, fs.move); other steps run unasked
+  --approve-default <yes|no>
+                  Answer used when stdin is not a terminal (default: no)
+  --model <name>  Use specific model (e.g., "haiku" for faster responses);
+                  overrides a model assignment in the script
+  --full-context  Append all variables to every prompt as a JSON document;
+                  values of names like token, secret, password or api_key
+                  are masked. With a prompt_template it is only shown
+                  where the template writes {{full_context}}
+  --model-for <kind=model>
+                  Use model for ask steps tagged kind=<kind>; may be
+                  repeated (e.g. --model-for scaffold=haiku)
   --claude <path> Path to Claude Code CLI executable (default: "claude")
+  --workdir <dir> Run shell commands and Claude in dir and resolve relative
+                  fs.* paths against it (created if missing); overrides a
+                  workdir assignment in the script
+  --expand-env    Expand $NAME in fs.* paths to the environment variable
+                  NAME (an unset NAME is an error; $$ is a literal $)
+  --claude-mode <flags|json>
+                  How prompts are passed to the CLI: with -p (default) or
+                  as a stream-json message on stdin (--claude-stdin-json)
+  --allowed-tools <list>
+                  Comma-separated tools Claude may use (e.g. "Read,Edit");
+                  overridden per step with tools=[...]
+  --fail-fast-hooks
+                  Abort on any failing hook (default: before hooks abort,
+                  after hooks only log failures)
+  --lenient-hooks Log failing hooks and keep going, before and after
+  --continue-on-error
+                  Keep going when a shell command or shell.run exits with a
+                  non-zero status (branch on last_exit, or $?, instead) or
+                  when the Claude CLI fails
+  --only-hooks    Run only the before/after hooks, skipping build steps
+  --skip-hooks    Run the build steps without the before/after hooks
+  --fake          Pretend every step succeeds without running anything;
+                  captured output comes from a stub generator
+  --seed <n>      Seed the --fake stub generator for reproducible runs
+  --dump-config   Print the effective configuration (defaults plus flags)
+                  as JSON without running anything
+  --dump-resolved Print the program with ${name} references substituted
+                  from the initial variables, without running anything
+  --dump-prompts  Print every built prompt as a JSON array without calling Claude
+  --profile       Print time spent in parsing, Claude, shell and MCP calls;
+                  with --json-stream it is the profile object of run_end
+  --no-shell      Disable all process execution (shell, shell.run, Claude);
+                  also accepted as --allow-shell=false
+  --allow-cmd <name>
+                  Only let shell commands and shell.run run this binary;
+                  repeat to allow several. Every command of a pipeline or
+                  list is checked, and $(...) or backticks are rejected.
+                  Commands given with a path (./npm, /usr/bin/npm) are
+                  only allowed if that path is listed
+  --max-prompt-history <n>
+                  Session continuity: list the last n completed asks (with
+                  captured results) in every prompt, dropping older ones.
+                  With a prompt_template they are only shown where the
+                  template writes {{history}}. Default 0 (off)
+  --combine-output
+                  Send stderr of Claude and shell steps to stdout so both keep
+                  their real order; the combined output is added to --report
+                  as system-out. Captured values remain stdout only
+  --max-output-bytes <n>
+                  Truncate Claude and shell output captured into a
+                  variable, and the output kept per step with
+                  --combine-output, after n bytes (default: 1048576; 0 for
+                  no limit)
+  --max-iterations <n>
+                  Fail a while loop whose condition still holds after n
+                  iterations (default: 10000)
+  --retries <n>   Retry an ask or shell step that exits non-zero or times
+                  out up to n times, waiting 1s, 2s, 4s... (at most 30s)
+                  between attempts; retries= on a step overrides it
+  --retry-budget <n>
+                  Cap Claude retries at n across the whole run; retries
+                  follow --retries (which defaults to the budget when not
+                  given), and once the budget is spent a failing call stops
+                  the build
+  --claude-timeout <duration>
+                  Kill a Claude call still running after this long
+                  (default: 10m; 0 for no limit); a timeout= on the ask
+                  overrides it
+  --timeout <duration>
+                  Kill any shell command or shell.run still running after
+                  this long (e.g. "10m"), with everything it started; a
+                  timeout= on the command overrides it
+  --deadline <duration>
+                  Abort the whole run after this long (e.g. "30m"); after
+                  hooks still run as cleanup
+  --input-format <vibe|yaml|json>
+                  Input file format (default: inferred from the file extension)
+  --import-env <prefix>
+                  Load environment variables starting with prefix as script
+                  variables (VIBE_PROJECT -> project), converting numbers
+                  and booleans; assignments in the script take precedence.
+                  May be repeated; also accepted as --env
+  --profile-file <file>
+                  Apply the assignments in file (e.g. prod.vars) over the
+                  script's top-level variables. May be repeated; later files
+                  win. Precedence, lowest first: --import-env, the script,
+                  profile files
+  --report <file> Write per-step results to file, even when the run fails
+  --report-format <junit>
+                  Report format (default: junit, one testcase per step)
+  --watch         Run, then re-run whenever the script or its prompt files
+                  change; each run starts fresh. Stop with Ctrl-C
+  --check-claude  Check that the Claude Code CLI runs and print its version
   --help          Show this help message
   --version       Show version information
 
+Dry run:
+  Variables, conditions, loops and groups are evaluated as usual, so the
+  same branches are taken as in a real run.
+  ask              prints the prompt it would send; Claude is not called
+                   and captured values are empty
+  shell            prints the command; nothing is executed, and captured
+                   values are empty
+  shell succeeds   prints the command and yields False
+  MCP calls        print the call; nothing is executed, except that
+                   fs.write/fs.append show a diff with --dry-run-fs
+  before/after     previewed like any other step (their commands are
+  hooks            printed, not run); --no-hooks-on-dry-run skips them
+
+Exit status:
+  0    success
+  1    a step or hook failed, or the command line was invalid
+  2    the script has syntax errors
+  124  a step or the whole run (--deadline) timed out
+
 Examples:
   vibe project.vibe                    # Execute fast (no permission prompts)
+  vibe project.yaml                    # Execute a YAML project spec
   vibe project.vibe --dry-run          # Preview without executing
   vibe project.vibe --model haiku      # Use faster Haiku model
   vibe project.vibe --interactive      # Enable permission prompts
+  vibe project.vibe --report out.xml   # JUnit results for CI dashboards
 
 DSL Syntax:
-  # Comments start with #
-
-  # Assignments
+  # A backslash at the end of a line continues a statement or a quoted
+  # string on the next line (inside a string the lines are joined by a space)
+  task = "Build a shop with login, cart and checkout, \
+          plus order history"
+
+  # Triple-quoted strings span lines and are taken literally; the common
+  # indentation is removed
+  ask """
+      Write a README with:
+        - "Install" and "Usage" sections
+        - a short FAQ
+      """
+
+  /* Block comments may span lines, e.g. to disable a section:
+  repeat 3 {
+    ask "refactor"
+  }
+  */
+
+  # Strings understand \n, \t, \r, \" and \\; other backslashes are kept
+  ask "write notes.md with these lines:\n- setup\n- \"usage\""
+
+  # Blocks are delimited by braces; indentation (tabs, spaces or none) and
+  # brace placement carry no meaning.
+  # Comments start with # and run to the end of the line. They may follow
+  # any token, e.g. between a condition and its opening brace:
+  #   if test == True   # only when tests are enabled
+  #   {
+
+  # Fail before any step runs unless these variables are set and non-empty
+  require ["project", "victim"]
+
+  # Assignments take effect in order, so a step sees the value assigned
+  # last before it (hooks see the script's final top-level values).
+  # Words such as prompt, for, in, run, setup or require are keywords only
+  # where a statement expects them, so they remain usable as names:
+  #   run = 1
+  #   prompt = "${run}"
   project = "MyProject"
   frontend = react
   tools = ["tailwind", "jwt", "vite"]
-  test = True
+  test = True            # true/false are accepted too
   count = 5
+  model = "haiku"        # default model unless --model is given
+  workdir = "out/shop"   # where steps run unless --workdir is given
+  summary = "Run 'npm start' in ${project} to launch."   # printed at the end
+
+  # String builtins
+  has_api = contains(task, "API")
+  slug = replace(project, " ", "-")
+  parts = split("a,b,c", ",")
+
+  # + joins strings, converting the other side ("v" + 2 is "v2")
+  path = "src/" + module + ".go"
+
+  # Update numbers in place with ++, --, +=, -=, *= and /=
+  count += 5
+  score -= 2
+
+  # Elements are numbered from 0; len() counts list elements or characters
+  first = tools[0]
+  total = len(tools)
+  ask "set up ${tools[1]} (${total} tools in total)"
+
+  # Lists grow with + (append or concatenate) or append()
+  tools = tools + "eslint"
+  tools = append(tools, "prettier")
+
+  # Conditional values (nest for more than two choices)
+  mode = env == "prod" ? "strict" : "loose"
+
+  # Extract a field from JSON text (numeric segments index arrays)
+  id = json_get(response, "data.items[0].id")
+
+  # Aggregates over numeric lists (sum([]) is 0, min/max of [] fail)
+  scores = [3, 9, 4]
+  best = max(scores)
+
+  # List comprehensions map (and optionally filter) a list
+  upcased = [upper(t) for t in tools]
+  others = [t for t in tools if t != "vite"]
 
   # Ask Claude Code to do something
   ask "scaffold the project structure"
   ask "implement user authentication"
 
-  # Conditional execution
-  if test == True {
+  # Capture Claude's answer (trailing whitespace is trimmed); several names
+  # destructure a JSON array or lines
+  plan = ask "summarize the plan"
+  branch = shell "git rev-parse --abbrev-ref HEAD"   # output, trimmed
+  main_file, test_file = ask "return two filenames as a JSON array"
+
+  # last_exit (or $?) holds the exit status of the last shell command
+  # (-1 if it was declined). Needs --continue-on-error: without it a
+  # failing command stops the run before the if is reached
+  shell "npm test"
+  if $? != 0 {
+    ask "fix the failing tests"
+  }
+
+  # ${name} inserts a variable into strings, asks, shell commands and MCP
+  # arguments; write \${ or $${ for a literal ${
+  ask "add a README for ${project}"
+  shell "echo $${HOME} is left to the shell"
+  # In shell and shell.run commands each value is single-quoted for you
+  # (a list gives one quoted word per element), so don't add quotes:
+  shell "mkdir -p ${project}/src"        # mkdir -p 'MyProject'/src
+  shell "npm install ${tools}"           # npm install 'tailwind' 'jwt' 'vite'
+  shell "deploy --token $DEPLOY_TOKEN"   # the shell expands $NAME itself
+  # Values of variables named like token, secret or password (in the script
+  # or the environment) are shown as *** in the log, command output, step
+  # reports and --json-stream events
+
+  # Per-step settings (timeouts are Go durations, or seconds as a number)
+  ask "big refactor" timeout="20m" model="opus"
+  shell "make" timeout="5m"
+  built = shell "make" succeeds           # True/False, never aborts
+  shell "npm install" retries=3           # retried with backoff on failure
+  ask "review the code" tools=["Read", "Grep"]
+  ask "scaffold the app" kind="scaffold"   # model chosen by --model-for
+
+  # Post-conditions fail the step when they do not hold afterwards
+  ask "create main.go" then assert fs.exists "main.go"
+  ask "bump the version" then assert version != "1.0"
+
+  # Ask again until the condition holds (at most 3 times by default); each
+  # reply is stored in response
+  refine "make the tests pass, reply DONE when they do" until contains(response, "DONE") max 5
+
+  # Reusable prompts
+  prompt scaffold = "create the folder structure and boilerplate"
+  ask scaffold
+
+  # Prompt files (relative to the script; ${name} is interpolated inside)
+  ask @prompts/scaffold.txt
+  ask @"prompts/big refactor.md" timeout="20m"
+
+  # Replace the built-in prompt layout with a text/template; variables are
+  # {{name}} (or {{.name}} for the raw value) and the step is {{instruction}}.
+  # Names like len or print stay template functions: write {{.len}}.
+  # The template replaces the whole layout: place {{history}} and
+  # {{full_context}} for --max-prompt-history and --full-context
+  prompt_template = """
+      You work on {{project}}. Follow our conventions strictly.
+      {{history}}
+      Task: {{instruction}}
+      """
+
+  # Conditional execution; a bare value tests its truthiness (False, 0,
+  # "", [] and undefined names are false)
+  if test {
     ask "generate unit tests"
   }
+  if !docs {
+    ask "write a README"
+  }
+
+  if count > 10 {
+    ask "split the work into modules"
+  } elif count > 5 {            # "else if" works too
+    ask "keep a flat layout"
+  } else {
+    ask "use a single file"
+  }
+
+  # && binds more tightly than ||; the right side is skipped when the
+  # left side already decides. Parentheses group.
+  if test == True && count > 3 {
+    ask "add integration tests"
+  }
+  if (count > 10 || big == True) && test == True {
+    ask "add load tests"
+  }
 
   # Repeat blocks
   repeat 3 {
     ask "refactor and improve code quality"
   }
+  repeat passes + 1 { # the count may be any number expression
+    ask "review the changes"
+  }
+
+  # Repeat until a guard fails, at most 10 times
+  repeat 10 while attempts < 3 {
+    ask "fix failing tests"
+    attempts++
+  }
+
+  # Loop while a condition holds (fails after --max-iterations)
+  while retries < 5 {
+    ask "fix the failing test"
+    retries++
+  }
+
+  # Loop over a list; with two names the first is the index (from 0).
+  # With one name only the element is bound. foreach is the same as for.
+  for i, t in tools {
+    ask "step ${i}: configure ${t}"
+  }
+
+  # Per-iteration hooks inside a repeat, while or for body; after each
+  # also runs when the iteration fails
+  for t in tools {
+    before each { shell "git stash" }
+    ask "integrate ${t}"
+    after each { shell "npm test" }
+  }
+
+  # break leaves the innermost loop, continue skips to its next iteration
+  for t in tools {
+    if t == "jwt" {
+      continue
+    }
+    ask "integrate ${t}"
+  }
+
+  # Groups label related steps in the output
+  group "Backend" {
+    ask "implement the REST API"
+    shell "npm test"
+  }
+
+  # Named setup phases run only when invoked
+  setup "db" {
+    shell "docker compose up -d db"
+  }
+  run "db"
+
+  # define and use are the same; once defined, the bare name runs it too
+  define lint {
+    shell "npm run lint"
+  }
+  use lint
+  lint
 
   # Pre/post hooks
   before {
@@ -1355,13 +8094,44 @@ DSL Syntax:
     shell "docker build -t myapp ."
   }
 
-  # MCP tool calls
+  # Conditional hooks; the condition is checked when the hooks run
+  before when docker == True {
+    shell "docker info"
+  }
+
+  # MCP tool calls; fs.write and fs.append take named arguments
   fs.mkdir "src/components"
+  fs.write path="src/app.go" content=src # values may be variables
+  fs.mkdir "$HOME/.config/app"   # with --expand-env, $NAME is an environment variable
+  fs.copy ".env.example" ".env"          # several arguments: spaces or commas
+  fs.move "old.go" "src/new.go"
   shell.run "npm install express"
   browser.search "latest React best practices"
 `)
 }
 
+// subcommandOutput takes "--symbols <set>" out of the arguments of a
+// subcommand such as lint and returns the remaining arguments with the
+// writer for the subcommand's output. It exits on an unknown set.
+func subcommandOutput(args []string) ([]string, io.Writer) {
+	set := "auto"
+	var rest []string
+	for n := 0; n < len(args); n++ {
+		if args[n] == "--symbols" && n+1 < len(args) {
+			set = args[n+1]
+			n++
+			continue
+		}
+		rest = append(rest, args[n])
+	}
+	ascii, err := useASCII(set)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return rest, symbolOutput(os.Stdout, ascii)
+}
+
 func printVersion() {
 	fmt.Println("Vibe DSL Interpreter v1.0")
 	fmt.Println("Built for Claude Code CLI integration")
@@ -1373,12 +8143,77 @@ func main() {
 		os.Exit(1)
 	}
 
+	if os.Args[1] == "lint" {
+		args, stdout := subcommandOutput(os.Args[2:])
+		if err := runLint(args, stdout); err != nil {
+			if !errors.Is(err, errLintWarnings) && !errors.As(err, new(ParseErrorList)) {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "init" {
+		args, stdout := subcommandOutput(os.Args[2:])
+		if err := runInit(args, stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	var filename string
 	dryRun := false
+	dryRunFS := false
+	truncate := 0
+	retryBudget := -1
+	retries := 0
+	interactiveApprove := false
+	summaryOnly := false
+	jsonStream := false
+	combineOutput := false
+	dumpConfig := false
+	maxPromptHistory := 0
+	checkClaudeOnly := false
+	fullContext := false
+	symbols := "auto"
+	unknownVars := "keep"
+	dumpResolved := false
+	maxOutputBytes := defaultMaxOutputBytes
+	maxIterations := defaultMaxIterations
+	watch := false
+	modelFor := make(map[string]string)
+	approveDefault := false
+	var envPrefixes []string
+	var profileFiles []string
+	var allowedCmds []string
 	verbose := true
 	claudePath := "claude"
-	skipPermissions := true  // Default: fast mode, no prompts
-	model := ""              // Default: use Claude's default model
+	skipPermissions := true // Default: fast mode, no prompts
+	model := ""             // Default: use Claude's default model
+	workDir := ""
+	expandEnv := false
+	onlyHooks := false
+	beforeFailFast := true
+	afterFailFast := false
+	continueOnError := false
+	skipHooks := false
+	noHooksOnDryRun := false
+	profile := false
+	inputFormat := ""
+	var deadline time.Duration
+	var shellTimeout time.Duration
+	claudeTimeout := defaultClaudeTimeout
+	allowShell := true
+	dumpPrompts := false
+	fake := false
+	seed := int64(0)
+	seedSet := false
+	var allowedTools []string
+	claudeMode := "flags"
+	reportPath := ""
+	reportFormat := "junit"
 
 	for i := 1; i < len(os.Args); i++ {
 		arg := os.Args[i]
@@ -1391,17 +8226,245 @@ func main() {
 			os.Exit(0)
 		case "--dry-run":
 			dryRun = true
+		case "--dry-run-fs":
+			dryRunFS = true
+		case "--truncate":
+			if i+1 < len(os.Args) {
+				n, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || n < 4 {
+					fmt.Fprintf(os.Stderr, "Error: invalid --truncate: %s (expected a number of at least 4)\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				truncate = n
+				i++
+			}
 		case "--verbose":
 			verbose = true
 		case "--quiet":
 			verbose = false
+		case "--summary-only":
+			summaryOnly = true
+		case "--json-stream":
+			jsonStream = true
+		case "--combine-output":
+			combineOutput = true
+		case "--check-claude":
+			checkClaudeOnly = true
+		case "--watch":
+			watch = true
+		case "--full-context":
+			fullContext = true
+		case "--unknown-vars":
+			if i+1 < len(os.Args) {
+				unknownVars = os.Args[i+1]
+				i++
+			}
+		case "--symbols":
+			if i+1 < len(os.Args) {
+				symbols = os.Args[i+1]
+				i++
+			}
 		case "--interactive":
-			skipPermissions = false  // Enable permission prompts
+			skipPermissions = false // Enable permission prompts
+		case "--interactive-approve":
+			interactiveApprove = true
+		case "--approve-default":
+			if i+1 < len(os.Args) {
+				switch os.Args[i+1] {
+				case "yes", "y":
+					approveDefault = true
+				case "no", "n":
+					approveDefault = false
+				default:
+					fmt.Fprintf(os.Stderr, "Error: invalid --approve-default: %s (expected yes or no)\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				i++
+			}
+		case "--only-hooks":
+			onlyHooks = true
+		case "--fail-fast-hooks":
+			beforeFailFast, afterFailFast = true, true
+		case "--lenient-hooks":
+			beforeFailFast, afterFailFast = false, false
+		case "--continue-on-error":
+			continueOnError = true
+		case "--skip-hooks":
+			skipHooks = true
+		case "--no-hooks-on-dry-run":
+			noHooksOnDryRun = true
+		case "--profile":
+			profile = true
+		case "--dump-prompts":
+			dumpPrompts = true
+		case "--dump-config":
+			dumpConfig = true
+		case "--dump-resolved":
+			dumpResolved = true
+		case "--fake":
+			fake = true
+		case "--seed":
+			if i+1 < len(os.Args) {
+				n, err := strconv.ParseInt(os.Args[i+1], 10, 64)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: invalid --seed: %v\n", err)
+					os.Exit(1)
+				}
+				seed, seedSet = n, true
+				i++
+			}
+		case "--no-shell", "--allow-shell=false":
+			allowShell = false
+		case "--allow-shell", "--allow-shell=true":
+			allowShell = true
+		case "--retries":
+			if i+1 < len(os.Args) {
+				n, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || n < 0 {
+					fmt.Fprintf(os.Stderr, "Error: invalid --retries: %s\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				retries = n
+				i++
+			}
+		case "--retry-budget":
+			if i+1 < len(os.Args) {
+				n, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || n < 0 {
+					fmt.Fprintf(os.Stderr, "Error: invalid --retry-budget: %s\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				retryBudget = n
+				i++
+			}
+		case "--max-prompt-history":
+			if i+1 < len(os.Args) {
+				n, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || n < 0 {
+					fmt.Fprintf(os.Stderr, "Error: invalid --max-prompt-history: %s\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				maxPromptHistory = n
+				i++
+			}
+		case "--max-output-bytes":
+			if i+1 < len(os.Args) {
+				n, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || n < 0 {
+					fmt.Fprintf(os.Stderr, "Error: invalid --max-output-bytes: %s\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				maxOutputBytes = n
+				i++
+			}
+		case "--max-iterations":
+			if i+1 < len(os.Args) {
+				n, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || n < 1 {
+					fmt.Fprintf(os.Stderr, "Error: invalid --max-iterations: %s\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				maxIterations = n
+				i++
+			}
+		case "--claude-timeout":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: invalid --claude-timeout: %v\n", err)
+					os.Exit(1)
+				}
+				claudeTimeout = d
+				i++
+			}
+		case "--timeout":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: invalid --timeout: %v\n", err)
+					os.Exit(1)
+				}
+				shellTimeout = d
+				i++
+			}
+		case "--deadline":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: invalid --deadline: %v\n", err)
+					os.Exit(1)
+				}
+				deadline = d
+				i++
+			}
+		case "--report":
+			if i+1 < len(os.Args) {
+				reportPath = os.Args[i+1]
+				i++
+			}
+		case "--report-format":
+			if i+1 < len(os.Args) {
+				reportFormat = os.Args[i+1]
+				i++
+			}
+		case "--import-env", "--env":
+			if i+1 < len(os.Args) {
+				envPrefixes = append(envPrefixes, os.Args[i+1])
+				i++
+			}
+		case "--allow-cmd":
+			if i+1 < len(os.Args) {
+				allowedCmds = append(allowedCmds, os.Args[i+1])
+				i++
+			}
+		case "--profile-file":
+			if i+1 < len(os.Args) {
+				profileFiles = append(profileFiles, os.Args[i+1])
+				i++
+			}
+		case "--input-format":
+			if i+1 < len(os.Args) {
+				inputFormat = os.Args[i+1]
+				i++
+			}
 		case "--model":
 			if i+1 < len(os.Args) {
 				model = os.Args[i+1]
 				i++
 			}
+		case "--expand-env":
+			expandEnv = true
+		case "--workdir":
+			if i+1 < len(os.Args) {
+				workDir = os.Args[i+1]
+				i++
+			}
+		case "--model-for":
+			if i+1 < len(os.Args) {
+				kind, name, ok := strings.Cut(os.Args[i+1], "=")
+				if !ok || kind == "" || name == "" {
+					fmt.Fprintf(os.Stderr, "Error: invalid --model-for: %s (expected kind=model)\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				modelFor[kind] = name
+				i++
+			}
+		case "--claude-mode":
+			if i+1 < len(os.Args) {
+				claudeMode = os.Args[i+1]
+				i++
+			}
+		case "--claude-stdin-json":
+			claudeMode = "json"
+		case "--allowed-tools":
+			if i+1 < len(os.Args) {
+				for _, tool := range strings.Split(os.Args[i+1], ",") {
+					if tool = strings.TrimSpace(tool); tool != "" {
+						allowedTools = append(allowedTools, tool)
+					}
+				}
+				i++
+			}
 		case "--claude":
 			if i+1 < len(os.Args) {
 				claudePath = os.Args[i+1]
@@ -1414,12 +8477,58 @@ func main() {
 		}
 	}
 
+	ascii, err := useASCII(symbols)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	stdout, stderr := symbolOutput(os.Stdout, ascii), symbolOutput(os.Stderr, ascii)
+
+	if checkClaudeOnly {
+		version, err := checkClaude(execRunner, claudePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(stdout, "✓ Claude Code CLI: %s\n", version)
+		os.Exit(0)
+	}
+
+	if onlyHooks && skipHooks {
+		fmt.Fprintln(os.Stderr, "Error: --only-hooks and --skip-hooks cannot be used together")
+		os.Exit(1)
+	}
+
+	if reportFormat != "junit" {
+		fmt.Fprintf(os.Stderr, "Error: unknown --report-format %q (expected junit)\n", reportFormat)
+		os.Exit(1)
+	}
+
 	if filename == "" {
 		fmt.Fprintln(os.Stderr, "Error: No .vibe file specified")
 		printUsage()
 		os.Exit(1)
 	}
 
+	if watch {
+		var childArgs []string
+		for _, arg := range os.Args[1:] {
+			if arg != "--watch" {
+				childArgs = append(childArgs, arg)
+			}
+		}
+		watcher := &fileWatcher{
+			interval: 500 * time.Millisecond,
+			debounce: 300 * time.Millisecond,
+			files:    func() []string { return watchedFiles(filename) },
+		}
+		if err := runWatch(filename, childArgs, watcher, stdout, stderr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Read the file
 	content, err := os.ReadFile(filename)
 	if err != nil {
@@ -1427,23 +8536,166 @@ func main() {
 		os.Exit(1)
 	}
 
+	interpreter := NewInterpreter()
+
+	if inputFormat == "" {
+		inputFormat = specFormat(filename)
+	}
+
 	// Lex and parse
-	lexer := NewLexer(string(content))
-	parser := NewParser(lexer)
-	program := parser.Parse()
+	parseStart := time.Now()
+	var program *Program
+	if inputFormat == "vibe" {
+		lexer := NewLexer(string(content))
+		parser := NewParser(lexer)
+		program = parser.Parse()
+		// Fail before any step runs rather than half-executing the script
+		if errs := parser.ParseErrors(); len(errs) > 0 {
+			for _, e := range errs {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", filename, e)
+			}
+			fmt.Fprintf(os.Stderr, "Parse failed with %d error(s)\n", len(errs))
+			os.Exit(exitCode(errs))
+		}
+	} else {
+		program, err = loadSpec(content, inputFormat)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading spec: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	interpreter.recordTime("parse", parseStart)
 
 	// Execute
-	interpreter := NewInterpreter()
+	for _, prefix := range envPrefixes {
+		interpreter.ImportEnv(prefix)
+	}
+	for _, path := range profileFiles {
+		if err := interpreter.LoadProfileFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading profile file: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+	interpreter.SetBaseDir(filepath.Dir(filename))
 	interpreter.SetDryRun(dryRun)
+	interpreter.SetDryRunFS(dryRunFS)
+	interpreter.SetDryRunTruncate(truncate)
+	interpreter.SetRetryBudget(retryBudget)
+	interpreter.SetRetries(retries)
+	interpreter.SetMaxOutputBytes(maxOutputBytes)
+	interpreter.SetMaxIterations(maxIterations)
+	interpreter.SetInteractiveApprove(interactiveApprove)
+	interpreter.SetApproveDefault(approveDefault)
+	interpreter.SetApproveInput(os.Stdin, isTerminal(os.Stdin))
 	interpreter.SetVerbose(verbose)
 	interpreter.SetClaudeCLI(claudePath)
 	interpreter.SetSkipPermissions(skipPermissions)
 	interpreter.SetModel(model)
-
-	if err := interpreter.Execute(program); err != nil {
-		fmt.Fprintf(os.Stderr, "Execution error: %v\n", err)
+	interpreter.SetWorkDir(workDir)
+	interpreter.SetExpandEnv(expandEnv)
+	interpreter.SetModelFor(modelFor)
+	interpreter.SetFullContext(fullContext)
+	if err := interpreter.SetSymbols(symbols); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := interpreter.SetUnknownVars(unknownVars); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	interpreter.SetAllowedTools(allowedTools)
+	if err := interpreter.SetClaudeMode(claudeMode); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	interpreter.SetOnlyHooks(onlyHooks)
+	interpreter.SetSkipHooks(skipHooks)
+	interpreter.SetNoHooksOnDryRun(noHooksOnDryRun)
+	interpreter.SetBeforeFailFast(beforeFailFast)
+	interpreter.SetAfterFailFast(afterFailFast)
+	interpreter.SetContinueOnError(continueOnError)
+	interpreter.SetProfile(profile)
+	interpreter.SetDeadline(deadline)
+	interpreter.SetShellTimeout(shellTimeout)
+	interpreter.SetClaudeTimeout(claudeTimeout)
+	interpreter.SetAllowShell(allowShell)
+	interpreter.SetAllowedCommands(allowedCmds)
+	interpreter.SetCombineOutput(combineOutput)
+	interpreter.SetMaxPromptHistory(maxPromptHistory)
+	interpreter.SetFake(fake)
+	if seedSet {
+		interpreter.SetSeed(seed)
+	}
+	if dumpPrompts {
+		// Keep stdout clean for the JSON document
+		interpreter.SetDumpPrompts(true)
+		interpreter.SetVerbose(false)
+	}
+
+	if summaryOnly {
+		// Only the summary table goes to stdout; errors still reach stderr
+		interpreter.SetVerbose(false)
+		interpreter.SetOutput(io.Discard)
+	}
+
+	if jsonStream {
+		// stdout carries only events; command output moves to stderr
+		interpreter.SetVerbose(false)
+		interpreter.SetOutput(os.Stderr)
+		interpreter.SetEventStream(os.Stdout)
+	}
+
+	if dumpConfig {
+		out, err := json.MarshalIndent(interpreter.Config(), "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding config: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+
+	if dumpResolved {
+		resolved, err := interpreter.ResolveProgram(program)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(resolved)
+		os.Exit(0)
+	}
+
+	execErr := interpreter.Execute(program)
+
+	if summaryOnly {
+		printStepSummary(os.Stdout, interpreter.Steps())
+	}
+
+	// The report is written even when the run failed so CI sees the failure
+	if reportPath != "" {
+		if err := writeReport(reportPath, reportFormat, filename, interpreter.Steps()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if execErr != nil {
+		fmt.Fprintf(os.Stderr, "Execution error: %s\n", interpreter.redactSecrets(execErr.Error()))
+		os.Exit(exitCode(execErr))
+	}
+
+	if dumpPrompts {
+		prompts := interpreter.DumpedPrompts()
+		if prompts == nil {
+			prompts = []DumpedPrompt{}
+		}
+		out, err := json.MarshalIndent(prompts, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding prompts: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	}
 
 	os.Exit(0)
 }
@@ -1516,13 +8768,24 @@ func runREPL() {
 			}
 		}
 
-		// Parse and execute
-		lexer := NewLexer(line)
-		parser := NewParser(lexer)
-		program := parser.Parse()
+		replEval(interpreter, line, os.Stdout)
+	}
+}
 
-		if err := interpreter.Execute(program); err != nil {
-			fmt.Printf("Error: %v\n", err)
+// replEval parses one REPL entry and executes it only if it is free of
+// syntax errors, so a malformed line never runs partially and leaves the
+// session's variables untouched. It reports whether the entry executed.
+func replEval(interpreter *Interpreter, src string, out io.Writer) bool {
+	program, errs := interpreter.parseSource(src)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(out, "Parse error: %s\n", e)
 		}
+		return false
+	}
+
+	if err := interpreter.Execute(program); err != nil {
+		fmt.Fprintf(out, "Error: %v\n", err)
 	}
+	return true
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplEval(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantRan bool
+		wantOut string
+	}{
+		{"valid", "x = 2", true, ""},
+		{"stray brace", "x = 2 }", false, `Parse error: line 1, column 7: unexpected token "}"`},
+		{"illegal character", "x = 2\n~", false, `Parse error: line 2, column 1: unexpected character "~"`},
+		{"runtime error", "x = 2\nbreak", true, "Error: break used outside a loop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, _ := newTestInterpreter()
+			interp.variables["x"] = float64(1)
+			var out bytes.Buffer
+			if ran := replEval(interp, tt.src, &out); ran != tt.wantRan {
+				t.Errorf("replEval() = %v, want %v", ran, tt.wantRan)
+			}
+			if !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("output = %q, want it to contain %q", out.String(), tt.wantOut)
+			}
+			if executed := interp.variables["x"] == float64(2); executed != tt.wantRan {
+				t.Errorf("x = %v; executed = %v, want %v", interp.variables["x"], executed, tt.wantRan)
+			}
+		})
+	}
+}
+
+// chdir changes to dir for the rest of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestRunInit(t *testing.T) {
+	chdir(t, t.TempDir())
+
+	if err := runInit([]string{"shop.vibe"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("shop.vibe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := parse(t, string(data))
+	if strings.Contains(string(data), "PROJECT_NAME") {
+		t.Error("template placeholder left in the script")
+	}
+	interp, _ := newTestInterpreter(dryRun)
+	if err := interp.Execute(program); err != nil {
+		t.Fatalf("dry run of the starter script: %v", err)
+	}
+	if got := interp.variables["project"]; got != "shop" {
+		t.Errorf("project = %v, want shop", got)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"exists", []string{"shop"}, "shop.vibe already exists"},
+		{"force", []string{"shop", "--force"}, ""},
+		{"default name", nil, ""},
+		{"unknown option", []string{"--template"}, "unknown init option --template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runInit(tt.args, io.Discard)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("runInit(%q) = %v, want %q", tt.args, err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := os.Stat("project.vibe"); err != nil {
+		t.Errorf("default name: %v", err)
+	}
+}
+
+func TestCheckClaude(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		err     error
+		want    string
+		wantErr string
+	}{
+		{"version", "2.0.14 (Claude Code)\n", nil, "2.0.14 (Claude Code)", ""},
+		{"not on PATH", "", exec.ErrNotFound, "", `Claude Code CLI not found at "claude"`},
+		{"missing file", "", &os.PathError{Op: "fork/exec", Path: "claude", Err: os.ErrNotExist}, "", "npm install -g @anthropic-ai/claude-code"},
+		{"fails", "", errors.New("exit status 2"), "", "claude --version failed: exit status 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotArgs []string
+			run := func(ctx context.Context, name string, args ...string) ([]byte, error) {
+				gotArgs = append([]string{name}, args...)
+				return []byte(tt.out), tt.err
+			}
+			got, err := checkClaude(run, "claude")
+			if strings.Join(gotArgs, " ") != "claude --version" {
+				t.Errorf("ran %q", gotArgs)
+			}
+			if got != tt.want {
+				t.Errorf("version = %q, want %q", got, tt.want)
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// assertASCII fails the test if out has bytes outside ASCII.
+func assertASCII(t *testing.T, what, out string) {
+	t.Helper()
+	for n := 0; n < len(out); n++ {
+		if out[n] > 0x7f {
+			t.Errorf("%s has non-ASCII output at byte %d:\n%s", what, n, out)
+			return
+		}
+	}
+}
+
+func TestASCIISymbols(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	src := `project = "shop"
+unused = 1
+before {
+  shell "echo ready"
+}
+group "build" {
+  ask "scaffold"
+  shell "false"
+}
+fs.mkdir "out"
+after {
+  shell "true"
+}
+`
+	if err := os.WriteFile("shop.vibe", []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	interp, _ := newTestInterpreter(func(i *Interpreter) {
+		i.SetOutput(&out)
+		i.SetClaudeCLI("true")
+		i.SetSymbols("ascii")
+		i.SetContinueOnError(true)
+	})
+	if err := interp.Execute(parse(t, src)); err != nil {
+		t.Fatal(err)
+	}
+	assertASCII(t, "run", out.String())
+	if !strings.Contains(out.String(), "[OK]") {
+		t.Errorf("run output has no [OK]:\n%s", out.String())
+	}
+
+	for _, tt := range []struct {
+		name string
+		run  func(io.Writer) error
+	}{
+		{"lint", func(w io.Writer) error { return runLint([]string{"shop.vibe"}, w) }},
+		{"init", func(w io.Writer) error { return runInit([]string{"new"}, w) }},
+	} {
+		var cli bytes.Buffer
+		tt.run(symbolOutput(&cli, true))
+		if cli.Len() == 0 {
+			t.Errorf("%s printed nothing", tt.name)
+		}
+		assertASCII(t, tt.name, cli.String())
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "app.vibe")
+	if err := os.WriteFile(script, []byte("ask \"go\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := &fileWatcher{
+		interval: 5 * time.Millisecond,
+		debounce: 20 * time.Millisecond,
+		files:    func() []string { return []string{script} },
+	}
+
+	// No change: wait only returns when cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := w.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait without changes = %v, want the context's error", err)
+	}
+
+	// A change is reported once the file has settled
+	done := make(chan error, 1)
+	go func() { done <- w.wait(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := os.WriteFile(script, []byte("ask \"go on\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("wait = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change was not detected")
+	}
+}
+
+func TestWatchedFiles(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "app.vibe")
+	src := "ask @prompts/a.txt\nfor t in [1] {\n  x = ask @\"b c.md\"\n}\nask \"inline\"\n" +
+		"a, b = ask @prompts/x.md\nrefine @prompts/y.md until contains(response, \"DONE\")\n"
+	if err := os.WriteFile(script, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{script, filepath.Join(dir, "prompts", "a.txt"), filepath.Join(dir, "b c.md"),
+		filepath.Join(dir, "prompts", "x.md"), filepath.Join(dir, "prompts", "y.md")}
+	if got := watchedFiles(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("watchedFiles = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parse parses src and fails the test on syntax errors.
+func parse(t *testing.T, src string) *Program {
+	t.Helper()
+	parser := NewParser(NewLexer(src))
+	program := parser.Parse()
+	if errs := parser.Errors(); len(errs) > 0 {
+		t.Fatalf("parse %q: %s", src, strings.Join(errs, "; "))
+	}
+	return program
+}
+
+// parseErrors parses src and returns its syntax errors.
+func parseErrors(src string) []string {
+	parser := NewParser(NewLexer(src))
+	parser.Parse()
+	return parser.Errors()
+}
+
+func TestParserErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{name: "valid", src: "x = 1\nask \"hi\"\n"},
+		{name: "stray brace", src: "x = 1\n}\n", want: []string{`line 2, column 1: unexpected token "}"`}},
+		{name: "two errors", src: "}\n)\n", want: []string{`line 1, column 1: unexpected token "}"`, `line 2, column 1: unexpected token ")"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseErrors(tt.src)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Errors() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// statements returns the String() form of each top-level statement of src.
+func statements(t *testing.T, src string) []string {
+	t.Helper()
+	var got []string
+	for _, stmt := range parse(t, src).Statements {
+		got = append(got, stmt.String())
+	}
+	return got
+}
+
+func TestParseStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"named prompt", "prompt scaffold = \"Create the folders\"\nask scaffold\n",
+			[]string{`prompt scaffold = "Create the folders"`, "ask scaffold"}},
+		{"keywords as names", "prompt = \"p\"\nrun = 1\nrun++\nfor, in = ask \"x\"\nrequire += 2\n",
+			[]string{`prompt = "p"`, "run = 1", "run++", `for, in = ask "x"`, "require += 2"}},
+		{"keywords as values", "x = run + prompt\n",
+			[]string{"x = run + prompt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statements(t, tt.src); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("statements = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	want := statements(t, `project = "shop"
+tools = ["vite", "jwt"]
+before {
+  shell "npm ci"
+}
+ask "scaffold the app"
+shell "npm test"
+fs.mkdir "src"
+`)
+	tests := []struct {
+		format string
+		spec   string
+	}{
+		{"yaml", `project: shop   # the name
+tools: [vite, jwt]
+before:
+  - shell: npm ci
+steps:
+  - ask: scaffold the app
+  - shell: "npm test"
+  - mcp: fs.mkdir
+    arg: src
+`},
+		{"json", `{"project": "shop", "tools": ["vite", "jwt"],
+ "before": [{"shell": "npm ci"}],
+ "steps": [{"ask": "scaffold the app"}, {"shell": "npm test"}, {"mcp": "fs.mkdir", "arg": "src"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			program, err := loadSpec([]byte(tt.spec), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, stmt := range program.Statements {
+				got = append(got, stmt.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("spec statements:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+
+	if _, err := loadSpec([]byte("steps:\n  - run: x\n"), "yaml"); err == nil {
+		t.Error("loadSpec accepted a step that is not ask, shell or mcp")
+	}
+}
+
+func TestParseComments(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"end of line", "x = 1 # one\n", []string{"x = 1"}},
+		{"before a brace", "if x == 1   # only once\n{\n  ask \"go\"\n}\n", statements(t, "if x == 1 {\n  ask \"go\"\n}\n")},
+		{"inside a list", "x = [\"a\", # first\n  \"b\"  # second\n]\n", []string{`x = ["a", "b"]`}},
+		{"inside a comprehension", "x = [f # each\n  for f in fs # of fs\n  if f != \"\" # non-empty\n]\n", statements(t, "x = [f for f in fs if f != \"\"]\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statements(t, tt.src); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("statements = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndentationIsIgnored(t *testing.T) {
+	const body = `project = "shop"
+if test == True {
+@ask "write tests"
+@for t in tools {
+@@shell "echo ${t}"
+@}
+} else {
+@ask "skip tests"
+}
+repeat 2 {
+@ask "polish"
+}
+`
+	want := parse(t, strings.ReplaceAll(body, "@", "")).Statements
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"spaces", strings.ReplaceAll(body, "@", "  ")},
+		{"tabs", strings.ReplaceAll(body, "@", "\t")},
+		{"mixed", strings.ReplaceAll(body, "@", " \t ")},
+		{"crlf", strings.ReplaceAll(strings.ReplaceAll(body, "@", "\t"), "\n", "\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parse(t, tt.src).Statements; !reflect.DeepEqual(got, want) {
+				t.Errorf("AST differs from the unindented program:\n%s", tt.src)
+			}
+		})
+	}
+}
+
+func TestLineContinuation(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"statement", "shell \\\n  \"make\"\n", []string{`shell "make"`}},
+		{"crlf", "x = 1 + \\\r\n    2\r\n", []string{"x = 1 + 2"}},
+		{"string joined with a space", "task = \"login, cart \\\n        and checkout\"\n", []string{`task = "login, cart and checkout"`}},
+		{"string without trailing space", "task = \"login,\\\n        cart\"\n", []string{`task = "login, cart"`}},
+		{"backslash mid-line", "x = \"a\\\\b\"\n", []string{`x = "a\\b"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statements(t, tt.src); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("statements = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Positions after a continuation still count the continued lines
+	if errs := parseErrors("x = 1 \\\n  + 2\n}"); len(errs) != 1 || !strings.HasPrefix(errs[0], "line 3, column 1:") {
+		t.Errorf("errors = %q", errs)
+	}
+}
+
+func TestBlockComments(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"inline", "x = /* one */ 1\n", []string{"x = 1"}},
+		{"spanning lines", "/* disabled:\nrepeat 3 {\n  ask \"go\"\n}\n*/\nx = 1\n", []string{"x = 1"}},
+		{"inside a block", "repeat 2 {\n  /* ask \"a\" */\n  ask \"b\"\n}\n", statements(t, "repeat 2 {\n  ask \"b\"\n}\n")},
+		{"with hash comments", "# a\n/* b # c */ x = 1 # d\n", []string{"x = 1"}},
+		{"hash comment hides the opener", "# /* not a block\nx = 1\n", []string{"x = 1"}},
+		{"slash assignment still works", "x = 6\nx /= 3\n", []string{"x = 6", "x /= 3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statements(t, tt.src); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("statements = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if errs := parseErrors("x = 1\n/* never\nclosed\n"); len(errs) != 1 || errs[0] != "line 2, column 1: unterminated block comment" {
+		t.Errorf("errors = %q", errs)
+	}
+	// Lines inside a comment still count
+	if errs := parseErrors("/*\n\n*/\n}"); len(errs) != 1 || !strings.HasPrefix(errs[0], "line 4, column 1:") {
+		t.Errorf("errors = %q", errs)
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string // the first error
+	}{
+		{"misspelt keyword", "repaet 3 {\n  ask \"x\"\n}\n", `line 1, column 10: unexpected token "{"`},
+		{"missing brace", "repeat 3 {\n  ask \"x\"\n", "line 3, column 1: expected '}' before end of file"},
+		{"malformed condition", "if x == {\n}\n", `line 1, column 9: expected a value, got "{"`},
+		{"missing condition", "if {\n}\n", `line 1, column 4: expected a value, got "{"`},
+		{"ask without instruction", "ask\n", "line 1, column 4: expected an instruction after 'ask', got end of line"},
+		{"missing value", "x = \n", "line 1, column 5: expected a value, got end of line"},
+		{"shell without a command", "shell 5\n", `line 1, column 7: expected a command string after 'shell', got "5"`},
+		{"unterminated string", "x = \"abc\nask \"do ${x}\"\n", "line 1, column 5: unterminated string"},
+		{"unterminated string at the end", "ask \"go", "line 1, column 5: unterminated string"},
+		{"unterminated triple-quoted string", "x = 1\ny = \"\"\"abc\n", "line 2, column 5: unterminated string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := parseErrors(tt.src); len(errs) == 0 || errs[0] != tt.want {
+				t.Errorf("errors = %q, want first %q", errs, tt.want)
+			}
+		})
+	}
+
+	// The next line parses normally after an unterminated string
+	if errs := parseErrors("x = \"abc\nask \"do ${x}\"\n"); len(errs) != 1 {
+		t.Errorf("errors = %q, want only the unterminated string", errs)
+	}
+
+	// Nothing runs when the script has a syntax error, even before it
+	dir := t.TempDir()
+	interp := NewInterpreter()
+	interp.SetOutput(io.Discard)
+	err := interp.ExecuteString("fs.mkdir \"" + filepath.Join(dir, "made") + "\"\nrepeat 3 {\n")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("err = %v, want a *ParseError", err)
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "made")); statErr == nil {
+		t.Error("a statement before the syntax error ran")
+	}
+}
+
+func TestElseIf(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		same string // an equivalent program
+	}{
+		{"alias for elif", "if a == 1 {\n  ask \"one\"\n} else if a == 2 {\n  ask \"two\"\n}\n", "if a == 1 {\n  ask \"one\"\n} elif a == 2 {\n  ask \"two\"\n}\n"},
+		{"with else", "if a == 1 {\n  ask \"one\"\n} else if a == 2 {\n  ask \"two\"\n} else {\n  ask \"other\"\n}\n",
+			"if a == 1 {\n  ask \"one\"\n} elif a == 2 {\n  ask \"two\"\n} else {\n  ask \"other\"\n}\n"},
+		{"nested else block", "if a == 1 {\n  ask \"one\"\n} else {\n  if a == 2 {\n    ask \"two\"\n  }\n}\n",
+			"if a == 1 {\n  ask \"one\"\n} elif a == 2 {\n  ask \"two\"\n}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := parse(t, tt.src).Statements, parse(t, tt.same).Statements; !reflect.DeepEqual(got, want) {
+				t.Errorf("AST of\n%s\ndiffers from\n%s", tt.src, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on Windows, where cancelling cmd kills only the
+// process itself.
+func setProcessGroup(cmd *exec.Cmd) {}